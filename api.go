@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const maxBodyBytes = 1 << 20
+
+const maxUsernameLength = 64
+
+const maxPasswordLength = 1024
+
+type validator interface {
+	Validate() *APIError
+}
+
+func decodeJSON(w http.ResponseWriter, r *http.Request, v validator) *APIError {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+
+	err := json.NewDecoder(r.Body).Decode(v); if err != nil {
+		return badRequest("invalid_json", "Request body is not valid JSON for this route")
+	}
+
+	return v.Validate()
+}
+
+//UserID accepts both 1 and "1", the welcome page has always sent ids as strings
+type UserID int64
+
+func (u *UserID) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), `"`)
+	if s == "" || s == "null" {
+		*u = 0
+		return nil
+	}
+
+	id, err := strconv.ParseInt(s, 10, 64); if err != nil {
+		return err
+	}
+
+	*u = UserID(id)
+	return nil
+}
+
+//Flag accepts both true and "true"
+type Flag bool
+
+func (f *Flag) UnmarshalJSON(b []byte) error {
+	switch strings.Trim(string(b), `"`) {
+	case "true":
+		*f = true
+	case "false", "", "null":
+		*f = false
+	default:
+		return &json.UnsupportedValueError{Str: string(b)}
+	}
+	return nil
+}
+
+func validateUsername(field string, name string) *APIError {
+	if name == "" {
+		return badRequest("missing_field", field + " is required")
+	}
+
+	if len(name) > maxUsernameLength {
+		return badRequest("invalid_field", field + " is too long")
+	}
+
+	for _, c := range name {
+		if unicode.IsControl(c) || unicode.IsSpace(c) {
+			return badRequest("invalid_field", field + " cannot contain whitespace or control characters")
+		}
+	}
+
+	return nil
+}
+
+func validatePassword(field string, password string) *APIError {
+	if password == "" {
+		return badRequest("missing_field", field + " is required")
+	}
+
+	if len(password) > maxPasswordLength {
+		return badRequest("invalid_field", field + " is too long")
+	}
+
+	return nil
+}
+
+func validateLegacyID(id UserID) *APIError {
+	if id < 0 {
+		return badRequest("invalid_field", "id must be positive")
+	}
+	return nil
+}
+
+func (c *Credentials) Validate() *APIError {
+	if c.UserName == "" || c.Password == "" {
+		return badRequest("missing_field", "username and password are required")
+	}
+	return nil
+}
+
+//Id on the request bodies below is deprecated, the acting user comes from the session.
+//It is still accepted as long as it matches, see actingUser
+
+type RegisterRequest struct {
+	Id UserID `json:"id,omitempty"`
+	UserName string `json:"username"`
+	Password string `json:"password"`
+	Admin Flag `json:"admin"`
+}
+
+func (req *RegisterRequest) Validate() *APIError {
+	if err := validateLegacyID(req.Id); err != nil {
+		return err
+	}
+
+	if err := validateUsername("username", req.UserName); err != nil {
+		return err
+	}
+
+	return validatePassword("password", req.Password)
+}
+
+type UpdateUsernameRequest struct {
+	Id UserID `json:"id,omitempty"`
+	UserName string `json:"username"`
+}
+
+func (req *UpdateUsernameRequest) Validate() *APIError {
+	if err := validateLegacyID(req.Id); err != nil {
+		return err
+	}
+
+	return validateUsername("username", req.UserName)
+}
+
+type UpdatePasswordRequest struct {
+	Id UserID `json:"id,omitempty"`
+	OldPassword string `json:"old_password"`
+	NewPassword string `json:"new_password"`
+}
+
+func (req *UpdatePasswordRequest) Validate() *APIError {
+	if err := validateLegacyID(req.Id); err != nil {
+		return err
+	}
+
+	if err := validatePassword("old_password", req.OldPassword); err != nil {
+		return err
+	}
+
+	return validatePassword("new_password", req.NewPassword)
+}
+
+//Body for every admin action that targets another user by name
+type AdminUserRequest struct {
+	Id UserID `json:"id,omitempty"`
+	UserName string `json:"username"`
+}
+
+func (req *AdminUserRequest) Validate() *APIError {
+	if err := validateLegacyID(req.Id); err != nil {
+		return err
+	}
+
+	return validateUsername("username", req.UserName)
+}
+
+type VerifyTokenRequest struct {
+	AccessToken string
+	UserId UserID
+	AppName string
+	Secret string
+}
+
+func parseVerifyTokenRequest(r *http.Request) (*VerifyTokenRequest, *APIError) {
+	q := r.URL.Query()
+	req := &VerifyTokenRequest{
+		AccessToken: q.Get("access_token"),
+		AppName: q.Get("app_name"),
+		Secret: q.Get("secret"),
+	}
+
+	if req.AccessToken == "" || q.Get("user_id") == "" || req.Secret == "" || req.AppName == "" {
+		return req, badRequest("missing_field", "Must include access_token, user_id, app_name, and secret in query params")
+	}
+
+	id, err := strconv.ParseInt(q.Get("user_id"), 10, 64); if err != nil {
+		return req, badRequest("invalid_field", "user_id must be an integer")
+	}
+	req.UserId = UserID(id)
+
+	return req, nil
+}
+
+type MessageResponse struct {
+	Message string `json:"message"`
+}
+
+//Scopes is only set for personal tokens, sessions carry every right of their user
+type VerifyTokenResponse struct {
+	Message string `json:"message"`
+	TokenType string `json:"tokenType"`
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+type UserInfoResponse struct {
+	Id int64 `json:"id"`
+	Name string `json:"name"`
+	Admin bool `json:"admin"`
+}
+
+type NewPasswordResponse struct {
+	Password string `json:"password"`
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+)
+
+func decodeError(t *testing.T, rec *httptest.ResponseRecorder) *APIError {
+	var body ErrorResponse
+	err := json.NewDecoder(rec.Body).Decode(&body); if err != nil || body.Error == nil {
+		t.Fatal("Response is not a JSON error envelope", rec.Body.String())
+	}
+	return body.Error
+}
+
+func TestDecodeTypedRequests(t *testing.T) {
+	cases := []struct{
+		body string
+		code string
+	}{
+		{`{"id": "1", "username": "foo", "password": "bar", "admin": "true"}`, ""},
+		{`{"id": 1, "username": "foo", "password": "bar", "admin": false}`, ""},
+		{`{"id": "one", "username": "foo", "password": "bar"}`, "invalid_json"},
+		{`{"id": "1", "username": "", "password": "bar"}`, "missing_field"},
+		{`{"id": "1", "username": "foo bar", "password": "bar"}`, "invalid_field"},
+		{`{"username": "foo", "password": "bar"}`, ""},
+		{`{"id": -1, "username": "foo", "password": "bar"}`, "invalid_field"},
+		{`not json`, "invalid_json"},
+	}
+
+	for _, c := range cases {
+		var req RegisterRequest
+		r := httptest.NewRequest("POST", "/register/credentials", bytes.NewBufferString(c.body))
+		apiErr := decodeJSON(httptest.NewRecorder(), r, &req)
+
+		if c.code == "" && apiErr != nil {
+			t.Fatal("Valid body was rejected", c.body, apiErr.Message)
+		}
+
+		if c.code != "" && (apiErr == nil || apiErr.Code != c.code || apiErr.Status != 400) {
+			t.Fatal("Expected a 400", c.code, "for", c.body)
+		}
+	}
+}
+
+func TestErrorEnvelopeHidesInternals(t *testing.T) {
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	internalError(rec, r, &json.SyntaxError{})
+
+	if rec.Code != 500 {
+		t.Fatal("Internal error did not answer 500")
+	}
+
+	if e := decodeError(t, rec); e.Code != "internal_error" || e.Message != "Internal server error" {
+		t.Fatal("Internal error leaked details", e.Message)
+	}
+}
+
+func TestPostMiddlewareStatusCodes(t *testing.T) {
+	handler := postMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != 405 || decodeError(t, rec).Code != "method_not_allowed" {
+		t.Fatal("GET was not rejected with 405")
+	}
+
+	rec = httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/", bytes.NewBufferString("{}"))
+	r.Header.Set("Content-Type", "text/plain")
+	handler.ServeHTTP(rec, r)
+	if rec.Code != 415 {
+		t.Fatal("Wrong Content-Type was not rejected with 415")
+	}
+
+	rec = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", "/", bytes.NewBufferString("{}"))
+	r.Header.Set("Content-Type", "application/json; charset=utf-8")
+	handler.ServeHTTP(rec, r)
+	if rec.Code != 200 {
+		t.Fatal("JSON with a charset was rejected")
+	}
+}
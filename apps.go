@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"sort"
+	"github.com/BurntSushi/toml"
+)
+
+//An app registered in apps.toml. The short form `name = "secret"` still works,
+//the table form carries everything else Portal knows about the app
+type App struct {
+	Name string `toml:"-"`
+	Secret string `toml:"secret"`
+	Origins []string `toml:"origins"`
+	//Scopes the app may request for itself with the client credentials grant
+	Scopes []string `toml:"scopes"`
+	//Service accounts are backend clients only, users never see them on the welcome page
+	Service bool `toml:"service"`
+	//Set for vendor apps that only speak SAML, Portal is their identity provider
+	SAML *SAMLServiceProvider `toml:"saml"`
+	Webhook *AppWebhook `toml:"webhook"`
+	//Where the app accepts OpenID Connect back-channel logout tokens
+	BackchannelLogoutURI string `toml:"backchannel_logout_uri"`
+	//Where the welcome page sends users with a launch code, see launch.go
+	LaunchURI string `toml:"launch_uri"`
+	//User names allowed to open the app from the welcome page, everyone when empty
+	Users []string `toml:"users"`
+}
+
+//Map holds every client, List only the apps users can open
+type Apps struct{
+	Map map[string]*App
+	List []string
+}
+
+func parseApps(tomlData string) (*Apps, error) {
+	var raw map[string]toml.Primitive
+	md, err := toml.Decode(tomlData, &raw); if err != nil {
+		return nil, err
+	}
+
+	apps := make(map[string]*App)
+	appNames := make([]string, 0)
+	for name, prim := range raw {
+		app := &App{}
+
+		var secret string
+		err = md.PrimitiveDecode(prim, &secret); if err != nil {
+			err = md.PrimitiveDecode(prim, app); if err != nil {
+				return nil, fmt.Errorf("apps.toml entry %s: %s", name, err.Error())
+			}
+		} else {
+			app.Secret = secret
+		}
+
+		if app.Secret == "" {
+			return nil, fmt.Errorf("apps.toml entry %s is missing a secret", name)
+		}
+
+		if app.SAML != nil {
+			err = app.SAML.validate(); if err != nil {
+				return nil, fmt.Errorf("apps.toml entry %s: %s", name, err.Error())
+			}
+		}
+
+		if app.Webhook != nil {
+			err = app.Webhook.validate(); if err != nil {
+				return nil, fmt.Errorf("apps.toml entry %s: %s", name, err.Error())
+			}
+		}
+
+		if app.BackchannelLogoutURI != "" {
+			u, err := url.Parse(app.BackchannelLogoutURI); if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || u.Fragment != "" {
+				return nil, fmt.Errorf("apps.toml entry %s: backchannel_logout_uri must be an absolute http or https URL", name)
+			}
+		}
+
+		if app.LaunchURI != "" {
+			err = validateLaunchURI(app.LaunchURI); if err != nil {
+				return nil, fmt.Errorf("apps.toml entry %s: %s", name, err.Error())
+			}
+			//Its launch path would be the exchange endpoint
+			if name == "exchange" {
+				return nil, fmt.Errorf("apps.toml entry %s can't have a launch_uri, /launch/exchange is taken", name)
+			}
+		}
+
+		for i, origin := range app.Origins {
+			app.Origins[i] = normalizeOrigin(origin)
+			if app.Origins[i] == "" {
+				return nil, fmt.Errorf("apps.toml entry %s has invalid origin %s", name, origin)
+			}
+		}
+
+		app.Name = name
+		apps[name] = app
+		if !app.Service {
+			appNames = append(appNames, name)
+		}
+	}
+	sort.Strings(appNames)
+
+	return &Apps{
+		Map: apps,
+		List: appNames,
+	}, nil
+}
+
+func loadApps() *Apps {
+	tomlData, err := ioutil.ReadFile("apps.toml"); if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	apps, err := parseApps(string(tomlData)); if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	return apps
+}
+
+//Returns the secret of a registered app
+func (a *Apps) Get(app string) (string, bool) {
+	v, ok := a.Map[app]; if !ok {
+		return "", false
+	}
+	return v.Secret, true
+}
+
+func (a *Apps) App(app string) (*App, bool) {
+	v, ok := a.Map[app]
+	return v, ok
+}
+
+//Where the welcome page sends users to open the app
+func (a *App) LaunchURL() string {
+	if a.SAML != nil {
+		return "/saml/launch?app=" + url.QueryEscape(a.Name)
+	}
+	if a.LaunchURI != "" {
+		return "/launch/" + url.PathEscape(a.Name)
+	}
+	return "/" + a.Name
+}
+
+type AppLink struct {
+	Name string `json:"name"`
+	URL string `json:"url"`
+}
+
+//Whether the user may open the app
+func (a *App) Permits(user string) bool {
+	if len(a.Users) == 0 {
+		return true
+	}
+	for _, name := range a.Users {
+		if name == user {
+			return true
+		}
+	}
+	return false
+}
+
+//The apps the user may open
+func (a *Apps) Links(user string) []AppLink {
+	links := make([]AppLink, 0, len(a.List))
+	for _, name := range a.List {
+		if a.Map[name].Permits(user) {
+			links = append(links, AppLink{Name: name, URL: a.Map[name].LaunchURL()})
+		}
+	}
+	return links
+}
+
+//Finds the app a SAML service provider entity id belongs to
+func (a *Apps) ServiceProvider(entityID string) (*App, bool) {
+	for _, app := range a.Map {
+		if app.SAML != nil && app.SAML.EntityID == entityID {
+			return app, true
+		}
+	}
+	return nil, false
+}
+
+//Whether the app may be granted every one of the scopes
+func (a *App) Allows(scopes []string) bool {
+	for _, scope := range scopes {
+		found := false
+		for _, allowed := range a.Scopes {
+			if allowed == scope {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+//Every origin any registered app serves its frontend from
+func (a *Apps) Origins() []string {
+	origins := make([]string, 0)
+	for _, name := range a.List {
+		origins = append(origins, a.Map[name].Origins...)
+	}
+	return origins
+}
+
+//The app whose frontend is served from origin, if any
+func (a *Apps) ForOrigin(origin string) (*App, bool) {
+	origin = normalizeOrigin(origin); if origin == "" {
+		return nil, false
+	}
+
+	for _, app := range a.Map {
+		for _, o := range app.Origins {
+			if o == origin {
+				return app, true
+			}
+		}
+	}
+	return nil, false
+}
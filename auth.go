@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//Who a request is acting as, resolved once by authMiddleware from the session
+type Principal struct {
+	Id int64
+	Name string
+	TokenType string
+	Token string
+	//Only set for tokens limited to scopes, sessions can do anything their user can
+	Scopes []string
+	//Apps a personal token is restricted to, empty means any app
+	Apps []string
+	//The one app a signed user token was issued to
+	Audience string
+}
+
+func (p *Principal) Human() bool {
+	return p.TokenType != clientTokenType
+}
+
+func (p *Principal) AllowsApp(app string) bool {
+	if p.Audience != "" && p.Audience != app {
+		return false
+	}
+
+	if len(p.Apps) == 0 {
+		return true
+	}
+
+	for _, allowed := range p.Apps {
+		if allowed == app {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+//Scopes a personal token needs for Portal's own routes, other scopes are for apps to interpret
+const (
+	portalReadScope = "portal:read"
+	portalAdminScope = "portal:admin"
+)
+
+var errInsufficientScope = forbidden("insufficient_scope", "Personal token lacks the scope for this route")
+
+//Whether p may use Portal's own routes. Sessions may, personal tokens only when they aren't
+//restricted to other apps and carry a portal scope
+func portalRouteAllowed(p *Principal) bool {
+	if p.TokenType != personalTokenType {
+		return true
+	}
+	return len(p.Apps) == 0 && (p.HasScope(portalReadScope) || p.HasScope(portalAdminScope))
+}
+
+const (
+	sessionTokenType = "session"
+	signedTokenType = "signed"
+	personalTokenType = "personal"
+	//Apps and service accounts acting for themselves through the client credentials grant
+	clientTokenType = "client"
+)
+
+type principalContextKey struct{}
+
+func withPrincipal(r *http.Request, p *Principal) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), principalContextKey{}, p))
+}
+
+func principalFrom(r *http.Request) (*Principal, bool) {
+	p, ok := r.Context().Value(principalContextKey{}).(*Principal)
+	return p, ok
+}
+
+const sessionCookieName = "portal_session"
+
+//Reads the session cookie. API clients and older pages send the bare token as
+//the whole Cookie header, which is still accepted
+func sessionToken(r *http.Request) string {
+	c, err := r.Cookie(sessionCookieName); if err == nil {
+		return c.Value
+	}
+
+	raw := r.Header.Get("Cookie")
+	if strings.ContainsAny(raw, "=;") {
+		return ""
+	}
+	return raw
+}
+
+func setSessionCookie(w http.ResponseWriter, r *http.Request, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name: sessionCookieName,
+		Value: token,
+		Path: "/",
+		MaxAge: int(config.Session.Lifetime.Seconds()),
+		HttpOnly: true,
+		Secure: r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func clearSessionCookie(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name: sessionCookieName,
+		Value: "",
+		Path: "/",
+		MaxAge: -1,
+		HttpOnly: true,
+		Secure: r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+//Scripts send personal tokens as Authorization: Bearer
+func bearerToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+const returnToCookieName = "portal_return_to"
+
+//Only paths on Portal itself, anything else would make the login page an open redirect
+func localPath(to string) bool {
+	return strings.HasPrefix(to, "/") && !strings.HasPrefix(to, "//") && !strings.Contains(to, "\\")
+}
+
+//Remembers where to send the user once they have logged in
+func setReturnTo(w http.ResponseWriter, r *http.Request, to string) {
+	http.SetCookie(w, &http.Cookie{
+		Name: returnToCookieName,
+		Value: url.QueryEscape(to),
+		Path: "/",
+		MaxAge: int(returnToLifetime.Seconds()),
+		HttpOnly: true,
+		Secure: r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func takeReturnTo(w http.ResponseWriter, r *http.Request) (string, bool) {
+	c, err := r.Cookie(returnToCookieName); if err != nil {
+		return "", false
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: returnToCookieName, Value: "", Path: "/", MaxAge: -1, HttpOnly: true, Secure: r.TLS != nil, SameSite: http.SameSiteLaxMode})
+
+	to, err := url.QueryUnescape(c.Value); if err != nil || !localPath(to) {
+		return "", false
+	}
+	return to, true
+}
+
+const returnToLifetime = 10 * time.Minute
+
+//Logins parked in memory until the user comes back are capped, so anonymous requests can't grow them without bound
+const maxPendingLogins = 10000
+
+var errTooManyPendingLogins = &APIError{Status: http.StatusServiceUnavailable, Code: "too_many_pending_logins", Message: "Too many logins are in progress, try again later"}
+
+//Sends a browser without a session to the login page, to come back to the current URL afterwards
+func loginFirst(w http.ResponseWriter, r *http.Request, to string) {
+	setReturnTo(w, r, to)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func sessionPrincipal(token string) (*Principal, bool) {
+	au, ok := activeUsers.Get(token); if !ok || au.Expired(time.Now()) {
+		return nil, false
+	}
+
+	return &Principal{
+		Id: au.Id,
+		Name: au.Name,
+		TokenType: sessionTokenType,
+		Token: token,
+	}, true
+}
+
+//A token that stands for a user, either a session or a personal token
+func userPrincipal(token string) (*Principal, bool) {
+	if isPersonalToken(token) {
+		return personalTokens.Lookup(token)
+	}
+	return sessionPrincipal(token)
+}
+
+//Resolves the session cookie or a bearer token into a Principal on the request context,
+//handlers behind it never need to be told who the user is
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := bearerToken(r)
+		if token == "" {
+			token = sessionToken(r)
+		}
+
+		p, ok := userPrincipal(token); if !ok {
+			writeError(w, errInvalidSession)
+			return
+		}
+
+		setLogUser(r, p.Id)
+		if !portalRouteAllowed(p) {
+			writeError(w, errInsufficientScope)
+			return
+		}
+
+		if p.TokenType == sessionTokenType {
+			activeUsers.Touch(p.Token, time.Now())
+		}
+
+		next.ServeHTTP(w, withPrincipal(r, p))
+	})
+}
+
+//Returns the acting user for a request behind authMiddleware.
+//Bodies used to carry the acting user's id, it is still accepted while clients
+//migrate but must match the session, and callers are told it is deprecated
+func actingUser(w http.ResponseWriter, r *http.Request, legacyID UserID) (*Principal, bool) {
+	p, ok := principalFrom(r); if !ok {
+		writeError(w, errInvalidSession)
+		return nil, false
+	}
+
+	if legacyID != 0 {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Add("Warning", `299 - "The id field is deprecated, the acting user is taken from the session"`)
+
+		if int64(legacyID) != p.Id {
+			writeError(w, errForbiddenUser)
+			return nil, false
+		}
+	}
+
+	return p, true
+}
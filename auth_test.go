@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+func TestAuthMiddlewarePrincipal(t *testing.T) {
+	activeUsers.Add(&ActiveUser{Id: 42, Name: "akita", AccessToken: "authtesttoken", LoginAt: time.Now()})
+
+	var acting *Principal
+	handler := authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var legacy UserID
+		if r.URL.Query().Get("id") != "" {
+			legacy = 7
+		}
+
+		p, ok := actingUser(w, r, legacy); if !ok {
+			return
+		}
+		acting = p
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/", nil))
+	if rec.Code != 401 {
+		t.Fatal("Request without a session was not rejected with 401")
+	}
+
+	r := httptest.NewRequest("POST", "/", nil)
+	r.Header.Set("Cookie", "authtesttoken")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+	if rec.Code != 200 || acting == nil || acting.Id != 42 || acting.TokenType != sessionTokenType {
+		t.Fatal("Acting user was not resolved from the session")
+	}
+
+	//A legacy id that doesn't match the session must not let a user act for someone else
+	r = httptest.NewRequest("POST", "/?id=7", nil)
+	r.Header.Set("Cookie", "authtesttoken")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+	if rec.Code != 403 {
+		t.Fatal("Mismatched legacy id was not rejected with 403")
+	}
+
+	if rec.Header().Get("Deprecation") == "" {
+		t.Fatal("Legacy id did not produce a deprecation header")
+	}
+}
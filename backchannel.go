@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//OpenID Connect Back-Channel Logout 1.0: when a session ends Portal posts a signed logout
+//token to every app the session was used with, so the apps end their own sessions too
+
+const (
+	backchannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+	//Queued alongside webhooks, but never something an app subscribes to
+	backchannelLogoutDelivery = "backchannel_logout"
+	logoutTokenType = "logout+jwt"
+	logoutTokenLifetime = 2 * time.Minute
+)
+
+type LogoutClaims struct {
+	Issuer string `json:"iss"`
+	Subject string `json:"sub"`
+	Audience string `json:"aud"`
+	IssuedAt int64 `json:"iat"`
+	ExpiresAt int64 `json:"exp"`
+	Id string `json:"jti"`
+	SessionId string `json:"sid"`
+	Events map[string]struct{} `json:"events"`
+}
+
+//What is queued, the token itself is signed at every attempt so retries never carry an expired one
+type logoutRequest struct {
+	Subject string `json:"sub"`
+	SessionId string `json:"sid"`
+}
+
+func newLogoutClaims(app string, req *logoutRequest, now time.Time) *LogoutClaims {
+	return &LogoutClaims{
+		Issuer: tokenIssuer(),
+		Subject: req.Subject,
+		Audience: app,
+		IssuedAt: now.Unix(),
+		ExpiresAt: now.Add(logoutTokenLifetime).Unix(),
+		Id: newSessionId(),
+		SessionId: req.SessionId,
+		Events: map[string]struct{}{backchannelLogoutEvent: {}},
+	}
+}
+
+//Queues a logout for every app each session was used with that registered a logout URI
+func backchannelLogout(sessions []ActiveUser) {
+	if webhooks == nil {
+		return
+	}
+
+	for _, au := range sessions {
+		for _, name := range au.Apps {
+			app, ok := apps.App(name); if !ok || app.BackchannelLogoutURI == "" {
+				continue
+			}
+
+			payload, _ := json.Marshal(&logoutRequest{Subject: strconv.FormatInt(au.Id, 10), SessionId: au.SessionId})
+			_, err := webhooks.enqueue.Exec(name, backchannelLogoutDelivery, newToken("evt_"), string(payload)); if err != nil {
+				logger.Error("Queueing back-channel logout failed", "component", "webhooks", "app", name, "session_id", au.SessionId, "error", err.Error())
+			}
+		}
+	}
+}
+
+//Sessions that ended before they expired, apps hear about them through webhooks and back-channel logout
+func sessionsRevoked(id int64, sessions []ActiveUser) {
+	if len(sessions) == 0 {
+		return
+	}
+
+	ids := make([]string, 0, len(sessions))
+	for _, au := range sessions {
+		ids = append(ids, au.SessionId)
+	}
+
+	webhooks.Emit(eventSessionRevoked, &SessionEventData{UserId: id, SessionIds: ids})
+	backchannelLogout(sessions)
+}
+
+//Posts the logout token as a form, the app answers 200 once the session is gone
+func (q *WebhookQueue) deliverLogout(app *App, d *webhookDelivery, now time.Time) (int, error) {
+	var req logoutRequest
+	err := json.Unmarshal([]byte(d.payload), &req); if err != nil {
+		return 0, err
+	}
+
+	token, err := signingKeys.SignTyped(logoutTokenType, newLogoutClaims(app.Name, &req, now)); if err != nil {
+		return 0, err
+	}
+
+	form := url.Values{"logout_token": {token}}
+	post, err := http.NewRequest("POST", app.BackchannelLogoutURI, strings.NewReader(form.Encode())); if err != nil {
+		return 0, err
+	}
+	post.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	post.Header.Set("User-Agent", "Portal-Webhooks")
+
+	resp, err := q.client.Do(post); if err != nil {
+		return 0, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64 << 10))
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("app answered HTTP %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackchannelLogoutRegistration(t *testing.T) {
+	registry, err := parseApps(`
+[canban]
+secret = "appsecret"
+origins = ["https://Canban.example.com"]
+backchannel_logout_uri = "https://canban.example.com/portal/logout"
+`); if err != nil {
+		t.Fatal(err)
+	}
+
+	app, ok := registry.ForOrigin("https://canban.example.com"); if !ok || app.BackchannelLogoutURI == "" {
+		t.Fatal("App was not found by its origin")
+	}
+	if _, ok := registry.ForOrigin("https://evil.example.com"); ok {
+		t.Fatal("Unknown origin matched an app")
+	}
+	if _, ok := registry.ForOrigin(""); ok {
+		t.Fatal("Missing origin matched an app")
+	}
+
+	for _, uri := range []string{"/portal/logout", "ftp://canban.example.com/logout", "https://canban.example.com/logout#frag"} {
+		_, err = parseApps("[bad]\nsecret = \"s\"\nbackchannel_logout_uri = \"" + uri + "\"\n"); if err == nil {
+			t.Fatal("Invalid logout URI was accepted", uri)
+		}
+	}
+}
+
+func TestSessionUsedBy(t *testing.T) {
+	sessions := &ActiveUsers{users: make(map[string]*ActiveUser)}
+	sessions.Add(&ActiveUser{Id: 7, AccessToken: "pst_a", SessionId: "s1", LoginAt: time.Now()})
+
+	sessions.UsedBy("pst_a", "canban")
+	snapshot := sessions.ListUser(7)[0]
+	sessions.UsedBy("pst_a", "canban")
+	sessions.UsedBy("pst_a", "reporter")
+	sessions.UsedBy("pst_unknown", "canban")
+
+	if len(snapshot.Apps) != 1 {
+		t.Fatal("Snapshot changed after it was taken", snapshot.Apps)
+	}
+
+	au, _ := sessions.Get("pst_a")
+	if strings.Join(au.Apps, ",") != "canban,reporter" {
+		t.Fatal("Unexpected apps", au.Apps)
+	}
+
+	if !sessions.DeleteSession(7, "s1") || sessions.Len() != 0 {
+		t.Fatal("Session was not revoked")
+	}
+}
+
+func TestBackchannelLogoutDelivery(t *testing.T) {
+	saved := signingKeys
+	defer func() { signingKeys = saved }()
+	signingKeys = &KeyManager{}
+	now := time.Now()
+	signingKeys.Rotate(now)
+
+	var received *http.Request
+	status := 200
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		received = r
+		w.WriteHeader(status)
+	}))
+	defer receiver.Close()
+
+	app := &App{Name: "canban", Secret: "appsecret", BackchannelLogoutURI: receiver.URL + "/portal/logout"}
+	q := &WebhookQueue{client: &http.Client{Timeout: time.Second, CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}}
+	d := &webhookDelivery{id: 3, app: "canban", event: backchannelLogoutDelivery, payload: `{"sub":"7","sid":"s1"}`}
+
+	code, err := q.deliverLogout(app, d, now); if err != nil || code != 200 {
+		t.Fatal("Logout delivery failed", code, err)
+	}
+	if received.URL.Path != "/portal/logout" || received.Header.Get("Content-Type") != "application/x-www-form-urlencoded" {
+		t.Fatal("Logout token was not posted as a form", received.URL, received.Header)
+	}
+
+	token := received.PostForm.Get("logout_token")
+	var header jwtHeader
+	raw, _ := b64.DecodeString(strings.Split(token, ".")[0])
+	json.Unmarshal(raw, &header)
+	if header.Typ != logoutTokenType {
+		t.Fatal("Logout token has the wrong typ", header.Typ)
+	}
+
+	var claims LogoutClaims
+	err = signingKeys.VerifyTyped(logoutTokenType, token, &claims); if err != nil {
+		t.Fatal(err)
+	}
+	if signingKeys.Verify(token, &AccessClaims{}) == nil {
+		t.Fatal("Logout token verified as an access token")
+	}
+	if claims.Subject != "7" || claims.SessionId != "s1" || claims.Audience != "canban" || claims.Issuer != tokenIssuer() || claims.Id == "" || claims.ExpiresAt <= now.Unix() {
+		t.Fatal("Unexpected logout claims", claims)
+	}
+	if _, ok := claims.Events[backchannelLogoutEvent]; !ok {
+		t.Fatal("Logout token is missing the logout event", claims.Events)
+	}
+	payload, _ := b64.DecodeString(strings.Split(token, ".")[1])
+	if strings.Contains(string(payload), "nonce") {
+		t.Fatal("Logout token must not carry a nonce")
+	}
+
+	status = 400
+	if code, err := q.deliverLogout(app, d, now); err == nil || code != 400 {
+		t.Fatal("Refused logout was not reported", code)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/x509"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+func loadClientCAs(filename string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(filename); if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No CA certificates found in %s", filename)
+	}
+
+	return pool, nil
+}
+
+//Maps a verified client certificate to the Portal user name it identifies,
+//using the field selected by client_cert_identity in config.toml
+func certificateUserName(cert *x509.Certificate, identity string) (string, error) {
+	switch identity {
+	case "", "common_name":
+		if cert.Subject.CommonName == "" {
+			return "", fmt.Errorf("Client certificate has no common name")
+		}
+		return cert.Subject.CommonName, nil
+	case "email":
+		if len(cert.EmailAddresses) == 0 {
+			return "", fmt.Errorf("Client certificate has no email SAN")
+		}
+		return cert.EmailAddresses[0], nil
+	case "dns":
+		if len(cert.DNSNames) == 0 {
+			return "", fmt.Errorf("Client certificate has no DNS SAN")
+		}
+		return cert.DNSNames[0], nil
+	}
+
+	return "", fmt.Errorf("Unknown client_cert_identity %s", identity)
+}
+
+//Certificate login needs TLS and a CA bundle to verify client certificates against
+func certificateLoginEnabled() bool {
+	return config.TLS.Enabled() && config.TLS.ClientCAFile != ""
+}
+
+func certificateLoginHandler() http.HandlerFunc {
+
+	stmt := prepareQuery("sql/get_active_user_by_name.sql")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		//VerifiedChains is only populated once the certificate chained to the client CA bundle
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			loginFailed("certificate", "no_certificate")
+			writeError(w, unauthorized("missing_certificate", "A verified client certificate is required"))
+			return
+		}
+
+		name, err := certificateUserName(r.TLS.VerifiedChains[0][0], config.TLS.ClientCertIdentity); if err != nil {
+			loginFailed("certificate", "no_identity")
+			writeError(w, unauthorized("invalid_certificate", err.Error()))
+			return
+		}
+
+		var u User
+		err = stmt.QueryRow(name).Scan(&u.Id, &u.Name); if err == sql.ErrNoRows {
+			loginFailed("certificate", "unknown_user")
+			requestLogger(r, "auth").Warn("Login failed", "method", "certificate", "username", name, "reason", "unknown_user")
+			writeError(w, unauthorized("invalid_certificate", "Client certificate does not belong to a Portal user"))
+			return
+		} else if err != nil {
+			loginFailed("certificate", "error")
+			internalError(w, r, err)
+			return
+		}
+
+		au := activateUser(&u, r, "certificate")
+		loginSucceeded("certificate")
+		setLogUser(r, u.Id)
+		requestLogger(r, "auth").Info("Login succeeded", "method", "certificate")
+
+		setSessionCookie(w, r, au.AccessToken)
+
+		writeJSON(w, http.StatusOK, loginResponse(r, au))
+	})
+}
@@ -0,0 +1,314 @@
+//Package client lets Go services check Portal tokens without hand rolling the HTTP calls.
+//
+//	portal, err := client.New(client.Config{URL: "https://portal.example.com", App: "canban", Secret: "supersecret"})
+//	http.Handle("/api/", portal.Middleware(api))
+//
+//Handlers behind the middleware read the user with client.UserFrom(r.Context()).
+//Tokens are checked with Portal's introspection endpoint, authenticating as the app.
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultCacheTTL = 30 * time.Second
+	DefaultCookieName = "portal_session"
+	//Bounds memory when an app sees many distinct tokens, expired entries go first
+	maxCacheEntries = 10000
+)
+
+type Config struct {
+	//Base URL of Portal, like https://portal.example.com
+	URL string
+	//App name and secret as registered in Portal's apps.toml
+	App string
+	Secret string
+	//How long a token that checked out is trusted without asking Portal again.
+	//Zero means DefaultCacheTTL, a negative value turns caching off
+	CacheTTL time.Duration
+	//Cookie the middleware reads when there is no Authorization header, zero means DefaultCookieName
+	CookieName string
+	//Zero means a client with a 10 second timeout
+	HTTPClient *http.Client
+}
+
+//Who a token belongs to. Apps and service accounts calling with client credentials
+//have ClientId set and no user id
+type User struct {
+	Id int64
+	Name string
+	ClientId string
+	//session, personal, signed or client
+	TokenType string
+	//Only set for tokens restricted to some scopes, sessions carry every right of their user
+	Scopes []string
+	//The app a signed token was issued to, empty for other tokens
+	Audience string
+}
+
+func (u *User) Human() bool {
+	return u.ClientId == ""
+}
+
+func (u *User) HasScope(scope string) bool {
+	for _, s := range u.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	//The token is unknown, expired, revoked or not valid for this app
+	ErrInvalidToken = errors.New("portal: token is invalid")
+	//Portal refused the app's own credentials, the app name or secret is wrong
+	ErrInvalidClient = errors.New("portal: app name or secret is incorrect")
+)
+
+type cacheEntry struct {
+	user *User
+	expires time.Time
+}
+
+type Client struct {
+	introspectURL string
+	app string
+	secret string
+	ttl time.Duration
+	cookieName string
+	http *http.Client
+
+	mu sync.Mutex
+	//Keyed by the token's SHA-256, tokens themselves are never kept
+	cache map[string]cacheEntry
+	now func() time.Time
+}
+
+func New(cfg Config) (*Client, error) {
+	base, err := url.Parse(cfg.URL); if err != nil || (base.Scheme != "https" && base.Scheme != "http") || base.Host == "" {
+		return nil, fmt.Errorf("portal: URL must be an absolute http or https URL")
+	}
+	if cfg.App == "" || cfg.Secret == "" {
+		return nil, fmt.Errorf("portal: App and Secret are required")
+	}
+
+	c := &Client{
+		introspectURL: strings.TrimSuffix(base.String(), "/") + "/oauth/introspect",
+		app: cfg.App,
+		secret: cfg.Secret,
+		ttl: cfg.CacheTTL,
+		cookieName: cfg.CookieName,
+		http: cfg.HTTPClient,
+		cache: make(map[string]cacheEntry),
+		now: time.Now,
+	}
+	if c.ttl == 0 {
+		c.ttl = DefaultCacheTTL
+	}
+	if c.cookieName == "" {
+		c.cookieName = DefaultCookieName
+	}
+	if c.http == nil {
+		c.http = &http.Client{Timeout: 10 * time.Second}
+	}
+	return c, nil
+}
+
+//Portal's introspection response
+type introspection struct {
+	Active bool `json:"active"`
+	PrincipalType string `json:"principal_type"`
+	TokenType string `json:"token_type"`
+	Subject string `json:"sub"`
+	Username string `json:"username"`
+	ClientId string `json:"client_id"`
+	Scope string `json:"scope"`
+	Audience string `json:"aud"`
+}
+
+//Asks Portal who token belongs to, or answers from the cache. Invalid tokens give ErrInvalidToken,
+//any other error means Portal could not be asked and the token is neither good nor bad
+func (c *Client) Verify(ctx context.Context, token string) (*User, error) {
+	if token == "" {
+		return nil, ErrInvalidToken
+	}
+
+	key := cacheKey(token)
+	if u, ok := c.cached(key); ok {
+		return u, nil
+	}
+
+	form := url.Values{"token": {token}}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.introspectURL, strings.NewReader(form.Encode())); if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(c.app), url.QueryEscape(c.secret))
+
+	resp, err := c.http.Do(req); if err != nil {
+		return nil, fmt.Errorf("portal: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, ErrInvalidClient
+	}
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64 << 10))
+		return nil, fmt.Errorf("portal: introspection answered HTTP %d", resp.StatusCode)
+	}
+
+	var in introspection
+	err = json.NewDecoder(io.LimitReader(resp.Body, 1 << 20)).Decode(&in); if err != nil {
+		return nil, fmt.Errorf("portal: reading introspection response: %w", err)
+	}
+	//Portal already refuses tokens issued to other apps, this guards against one that doesn't
+	if !in.Active || (in.Audience != "" && in.Audience != c.app) {
+		return nil, ErrInvalidToken
+	}
+
+	u := &User{Name: in.Username, ClientId: in.ClientId, TokenType: in.TokenType, Audience: in.Audience}
+	if in.Scope != "" {
+		u.Scopes = strings.Fields(in.Scope)
+	}
+	if in.PrincipalType != "client" {
+		u.Id, err = strconv.ParseInt(in.Subject, 10, 64); if err != nil {
+			return nil, fmt.Errorf("portal: unexpected subject %q", in.Subject)
+		}
+	}
+
+	c.store(key, u)
+	return u, nil
+}
+
+//Drops token from the cache, for apps that learn of a logout before the cache entry expires
+func (c *Client) Forget(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.cache, cacheKey(token))
+}
+
+func cacheKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *Client) cached(key string) (*User, bool) {
+	if c.ttl < 0 {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.cache[key]; if !ok {
+		return nil, false
+	}
+	if !c.now().Before(e.expires) {
+		delete(c.cache, key)
+		return nil, false
+	}
+	return e.user, true
+}
+
+//Only positive results are cached, so a token that was just issued is never stuck as invalid
+func (c *Client) store(key string, u *User) {
+	if c.ttl < 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if len(c.cache) >= maxCacheEntries {
+		for k, e := range c.cache {
+			if !now.Before(e.expires) {
+				delete(c.cache, k)
+			}
+		}
+	}
+	if len(c.cache) >= maxCacheEntries {
+		for k := range c.cache {
+			delete(c.cache, k)
+			break
+		}
+	}
+	c.cache[key] = cacheEntry{user: u, expires: now.Add(c.ttl)}
+}
+
+//The bearer token, or the session cookie when there is none
+func (c *Client) Token(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+
+	cookie, err := r.Cookie(c.cookieName); if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+type contextKey struct{}
+
+func WithUser(ctx context.Context, u *User) context.Context {
+	return context.WithValue(ctx, contextKey{}, u)
+}
+
+//The user the middleware verified for the request
+func UserFrom(ctx context.Context) (*User, bool) {
+	u, ok := ctx.Value(contextKey{}).(*User)
+	return u, ok && u != nil
+}
+
+//Same shape as Portal's own error responses
+type errorResponse struct {
+	Error struct {
+		Code string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	var body errorResponse
+	body.Error.Code = code
+	body.Error.Message = message
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&body)
+}
+
+//Lets through requests carrying a token Portal accepts for this app, with the user on the
+//request context. Everything else gets a 401, or a 502 when Portal could not be asked
+func (c *Client) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, err := c.Verify(r.Context(), c.Token(r))
+		switch {
+		case err == nil:
+			next.ServeHTTP(w, r.WithContext(WithUser(r.Context(), u)))
+		case errors.Is(err, ErrInvalidToken):
+			writeError(w, http.StatusUnauthorized, "invalid_token", "Access token is missing, expired or unknown")
+		default:
+			writeError(w, http.StatusBadGateway, "portal_unavailable", "Could not verify the access token")
+		}
+	})
+}
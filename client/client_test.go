@@ -0,0 +1,150 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"portal/client"
+	"portal/client/portaltest"
+)
+
+func TestMiddleware(t *testing.T) {
+	portal := portaltest.New()
+	defer portal.Close()
+	token := portal.Login(7, "shiba")
+
+	c, err := client.New(portal.Config()); if err != nil {
+		t.Fatal(err)
+	}
+
+	var seen *client.User
+	handler := c.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen, _ = client.UserFrom(r.Context())
+	}))
+
+	r := httptest.NewRequest("GET", "/api/boards", nil)
+	r.Header.Set("Authorization", "Bearer " + token)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+	if rec.Code != 200 || seen == nil || seen.Id != 7 || seen.Name != "shiba" || seen.TokenType != "session" || !seen.Human() {
+		t.Fatal("Bearer token was not accepted", rec.Code, seen)
+	}
+
+	seen = nil
+	r = httptest.NewRequest("GET", "/api/boards", nil)
+	r.AddCookie(&http.Cookie{Name: client.DefaultCookieName, Value: token})
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+	if rec.Code != 200 || seen == nil || seen.Id != 7 {
+		t.Fatal("Session cookie was not accepted", rec.Code)
+	}
+
+	for _, auth := range []string{"", "Bearer pst_unknown", "Basic dGVzdDp0ZXN0"} {
+		r = httptest.NewRequest("GET", "/api/boards", nil)
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		if rec.Code != 401 || rec.Header().Get("WWW-Authenticate") == "" {
+			t.Fatal("Request without a valid token was let through", auth, rec.Code)
+		}
+	}
+}
+
+func TestVerifyCache(t *testing.T) {
+	portal := portaltest.New()
+	defer portal.Close()
+	token := portal.Login(7, "shiba")
+
+	c, _ := client.New(portal.Config())
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if _, err := c.Verify(ctx, token); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if portal.Calls() != 1 {
+		t.Fatal("Verified token was not cached", portal.Calls())
+	}
+
+	//Revocation shows once the entry is gone
+	portal.Revoke(token)
+	if _, err := c.Verify(ctx, token); err != nil {
+		t.Fatal("Cached token was refused", err)
+	}
+	c.Forget(token)
+	if _, err := c.Verify(ctx, token); !errors.Is(err, client.ErrInvalidToken) {
+		t.Fatal("Revoked token was accepted", err)
+	}
+
+	//Invalid tokens are never cached
+	calls := portal.Calls()
+	c.Verify(ctx, token)
+	if portal.Calls() != calls + 1 {
+		t.Fatal("Invalid token was cached")
+	}
+
+	cfg := portal.Config()
+	cfg.CacheTTL = -1
+	uncached, _ := client.New(cfg)
+	other := portal.Login(8, "akita")
+	calls = portal.Calls()
+	uncached.Verify(ctx, other)
+	uncached.Verify(ctx, other)
+	if portal.Calls() != calls + 2 {
+		t.Fatal("Cache was used although it is turned off")
+	}
+}
+
+func TestVerifyClientsAndFailures(t *testing.T) {
+	portal := portaltest.New()
+	defer portal.Close()
+	portal.AddToken("cct_reporter", &client.User{ClientId: "reporter", TokenType: "client", Scopes: []string{"users:read"}})
+
+	portal.AddToken("jwt_other_app", &client.User{Id: 7, Name: "shiba", TokenType: "signed", Audience: "canban"})
+	portal.AddToken("jwt_this_app", &client.User{Id: 7, Name: "shiba", TokenType: "signed", Audience: portaltest.App})
+
+	c, _ := client.New(portal.Config())
+	if _, err := c.Verify(context.Background(), "jwt_other_app"); !errors.Is(err, client.ErrInvalidToken) {
+		t.Fatal("Signed token for another app was accepted", err)
+	}
+	if u, err := c.Verify(context.Background(), "jwt_this_app"); err != nil || u.Audience != portaltest.App {
+		t.Fatal("Signed token for this app was refused", err)
+	}
+
+	u, err := c.Verify(context.Background(), "cct_reporter"); if err != nil {
+		t.Fatal(err)
+	}
+	if u.Human() || u.ClientId != "reporter" || !u.HasScope("users:read") || u.HasScope("users:write") {
+		t.Fatal("Unexpected client principal", u)
+	}
+
+	cfg := portal.Config()
+	cfg.Secret = "wrong"
+	wrong, _ := client.New(cfg)
+	if _, err := wrong.Verify(context.Background(), "cct_reporter"); !errors.Is(err, client.ErrInvalidClient) {
+		t.Fatal("Wrong app secret was not reported", err)
+	}
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(503)
+	}))
+	defer down.Close()
+	unavailable, _ := client.New(client.Config{URL: down.URL, App: portaltest.App, Secret: portaltest.Secret})
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer pst_x")
+	unavailable.Middleware(http.NotFoundHandler()).ServeHTTP(rec, r)
+	if rec.Code != 502 {
+		t.Fatal("Unavailable Portal was not reported", rec.Code)
+	}
+
+	for _, bad := range []client.Config{{URL: "portal.example.com", App: "a", Secret: "s"}, {URL: "https://portal.example.com", App: "a"}} {
+		if _, err := client.New(bad); err == nil {
+			t.Fatal("Invalid config was accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package grpcauth_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"portal/client"
+	"portal/client/grpcauth"
+	"portal/portalpb"
+)
+
+//Answers VerifyToken like Portal for one app and one token
+type fakePortal struct {
+	portalpb.UnimplementedPortalServer
+	calls int
+}
+
+func (f *fakePortal) VerifyToken(ctx context.Context, req *portalpb.VerifyTokenRequest) (*portalpb.VerifyTokenResponse, error) {
+	f.calls++
+	md, _ := metadata.FromIncomingContext(ctx)
+	if auth := md.Get("authorization"); len(auth) != 1 || auth[0] != "Basic cmVwb3J0ZXI6cmVwb3J0ZXJzZWNyZXQ=" {
+		return nil, status.Error(codes.Unauthenticated, "invalid_client: App name or secret is incorrect")
+	}
+
+	switch req.AccessToken {
+	case "pst_good":
+		return &portalpb.VerifyTokenResponse{UserId: 7, Username: "shiba", TokenType: "session"}, nil
+	case "jwt_reporter":
+		return &portalpb.VerifyTokenResponse{UserId: 7, Username: "shiba", TokenType: "signed", Audience: "reporter"}, nil
+	case "jwt_canban":
+		return &portalpb.VerifyTokenResponse{UserId: 7, Username: "shiba", TokenType: "signed", Audience: "canban"}, nil
+	case "pat_other_app":
+		return nil, status.Error(codes.PermissionDenied, "app_not_allowed: Token is not valid for this app")
+	}
+	return nil, status.Error(codes.Unauthenticated, "invalid_token: Access token is unauthorized")
+}
+
+func dialFake(t *testing.T, portal *fakePortal) *grpc.ClientConn {
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	portalpb.RegisterPortalServer(server, portal)
+	go server.Serve(listener)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet", grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return listener.DialContext(ctx)
+	})); if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		conn.Close()
+		server.Stop()
+	})
+	return conn
+}
+
+func incoming(token string) context.Context {
+	if token == "" {
+		return context.Background()
+	}
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer " + token))
+}
+
+func TestUnaryInterceptor(t *testing.T) {
+	portal := &fakePortal{}
+	interceptor := grpcauth.New(dialFake(t, portal), "reporter", "reportersecret", "/grpc.health.v1.Health/Check").UnaryServerInterceptor()
+	info := &grpc.UnaryServerInfo{FullMethod: "/reports.v1.Reports/Get"}
+
+	var seen *client.User
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		seen, _ = client.UserFrom(ctx)
+		return "ok", nil
+	}
+
+	_, err := interceptor(incoming("pst_good"), nil, info, handler); if err != nil {
+		t.Fatal(err)
+	}
+	if seen == nil || seen.Id != 7 || seen.Name != "shiba" {
+		t.Fatal("User is missing from the context", seen)
+	}
+
+	_, err = interceptor(incoming("jwt_reporter"), nil, info, handler); if err != nil || seen.Audience != "reporter" {
+		t.Fatal("Signed token for this app was refused", err)
+	}
+
+	for _, token := range []string{"", "pst_bad", "pat_other_app", "jwt_canban"} {
+		if _, err := interceptor(incoming(token), nil, info, handler); status.Code(err) != codes.Unauthenticated {
+			t.Fatal("Call without a valid token was let through", token, err)
+		}
+	}
+
+	calls := portal.calls
+	_, err = interceptor(incoming(""), nil, &grpc.UnaryServerInfo{FullMethod: "/grpc.health.v1.Health/Check"}, handler); if err != nil || portal.calls != calls {
+		t.Fatal("Skipped method was authenticated", err)
+	}
+
+	wrong := grpcauth.New(dialFake(t, portal), "reporter", "wrong").UnaryServerInterceptor()
+	if _, err := wrong(incoming("pst_good"), nil, info, handler); status.Code(err) != codes.Unavailable {
+		t.Fatal("Wrong app secret was blamed on the caller", err)
+	}
+}
+
+type fakeStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *fakeStream) Context() context.Context {
+	return s.ctx
+}
+
+func TestStreamInterceptor(t *testing.T) {
+	interceptor := grpcauth.New(dialFake(t, &fakePortal{}), "reporter", "reportersecret").StreamServerInterceptor()
+	info := &grpc.StreamServerInfo{FullMethod: "/reports.v1.Reports/Watch"}
+
+	var seen *client.User
+	handler := func(srv interface{}, ss grpc.ServerStream) error {
+		seen, _ = client.UserFrom(ss.Context())
+		return nil
+	}
+
+	err := interceptor(nil, &fakeStream{ctx: incoming("pst_good")}, info, handler); if err != nil || seen == nil || seen.Id != 7 {
+		t.Fatal("Stream was not authenticated", err, seen)
+	}
+
+	if err := interceptor(nil, &fakeStream{ctx: incoming("pst_bad")}, info, handler); status.Code(err) != codes.Unauthenticated {
+		t.Fatal("Stream without a valid token was let through", err)
+	}
+}
@@ -0,0 +1,124 @@
+//Package portaltest fakes Portal in-process so apps can test code behind client.Middleware
+//without a running Portal.
+//
+//	portal := portaltest.New()
+//	defer portal.Close()
+//	token := portal.Login(7, "shiba")
+//	c, _ := client.New(portal.Config())
+package portaltest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"portal/client"
+)
+
+const (
+	App = "testapp"
+	Secret = "testsecret"
+)
+
+type Portal struct {
+	*httptest.Server
+
+	mu sync.Mutex
+	tokens map[string]*client.User
+	calls atomic.Int64
+}
+
+//Starts a fake Portal that knows App with Secret and no tokens yet
+func New() *Portal {
+	p := &Portal{tokens: make(map[string]*client.User)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth/introspect", p.introspect)
+	p.Server = httptest.NewServer(mux)
+	return p
+}
+
+//A client config pointing at the fake, caching left at its default
+func (p *Portal) Config() client.Config {
+	return client.Config{URL: p.URL, App: App, Secret: Secret, HTTPClient: p.Client()}
+}
+
+//Issues a session token for a user
+func (p *Portal) Login(id int64, name string) string {
+	token := "pst_" + randomHex()
+	p.AddToken(token, &client.User{Id: id, Name: name, TokenType: "session"})
+	return token
+}
+
+//Makes any token valid for u, for tests that need personal or client tokens
+func (p *Portal) AddToken(token string, u *client.User) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.tokens[token] = u
+}
+
+//Makes the token invalid from now on, like a logout
+func (p *Portal) Revoke(token string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.tokens, token)
+}
+
+//How many times tokens were introspected, to test caching
+func (p *Portal) Calls() int {
+	return int(p.calls.Load())
+}
+
+func randomHex() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (p *Portal) introspect(w http.ResponseWriter, r *http.Request) {
+	p.calls.Add(1)
+	if r.Method != "POST" || r.ParseForm() != nil {
+		http.Error(w, "invalid_request", http.StatusBadRequest)
+		return
+	}
+
+	id, secret, _ := r.BasicAuth()
+	id, _ = url.QueryUnescape(id)
+	secret, _ = url.QueryUnescape(secret)
+	if id != App || secret != Secret {
+		w.Header().Set("WWW-Authenticate", `Basic realm="portal"`)
+		http.Error(w, "invalid_client", http.StatusUnauthorized)
+		return
+	}
+
+	p.mu.Lock()
+	u, ok := p.tokens[r.PostForm.Get("token")]
+	p.mu.Unlock()
+
+	resp := map[string]interface{}{"active": ok}
+	if ok {
+		resp["token_type"] = u.TokenType
+		resp["scope"] = strings.Join(u.Scopes, " ")
+		if u.Audience != "" {
+			resp["aud"] = u.Audience
+		}
+		if u.ClientId != "" {
+			resp["principal_type"] = "client"
+			resp["sub"] = "client:" + u.ClientId
+			resp["client_id"] = u.ClientId
+		} else {
+			resp["principal_type"] = "user"
+			resp["sub"] = strconv.FormatInt(u.Id, 10)
+			resp["username"] = u.Name
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(resp)
+}
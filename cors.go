@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//What cross-origin browser callers may do on one route
+type CORSPolicy struct {
+	Origins func() []string
+	Methods []string
+	Headers []string
+	Credentials bool
+	MaxAge int
+}
+
+func (p *CORSPolicy) allowsOrigin(origin string) bool {
+	if origin == "" {
+		return false
+	}
+
+	for _, allowed := range p.Origins() {
+		if allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *CORSPolicy) allowsMethod(method string) bool {
+	for _, allowed := range p.Methods {
+		if allowed == method {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *CORSPolicy) allowsHeaders(requested string) bool {
+	for _, header := range strings.Split(requested, ",") {
+		header = strings.TrimSpace(header)
+		if header == "" {
+			continue
+		}
+
+		found := false
+		for _, allowed := range p.Headers {
+			if strings.EqualFold(allowed, header) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func isPreflight(r *http.Request) bool {
+	return r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+//Answers preflights itself so they never reach postMiddleware or auth, and only
+//reflects origins the policy allows; other origins get no CORS headers at all
+func corsMiddleware(policy *CORSPolicy, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !policy.allowsOrigin(normalizeOrigin(origin)) {
+			if isPreflight(r) {
+				writeError(w, forbidden("bad_origin", "Origin is not allowed to call this route"))
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		h.Set("Access-Control-Allow-Origin", origin)
+		if policy.Credentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if isPreflight(r) {
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+
+			if !policy.allowsMethod(r.Header.Get("Access-Control-Request-Method")) || !policy.allowsHeaders(r.Header.Get("Access-Control-Request-Headers")) {
+				writeError(w, forbidden("cors_not_allowed", "Method or headers are not allowed on this route"))
+				return
+			}
+
+			h.Set("Access-Control-Allow-Methods", strings.Join(policy.Methods, ", "))
+			if len(policy.Headers) > 0 {
+				h.Set("Access-Control-Allow-Headers", strings.Join(policy.Headers, ", "))
+			}
+			if policy.MaxAge > 0 {
+				h.Set("Access-Control-Max-Age", strconv.Itoa(policy.MaxAge))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		h.Set("Access-Control-Expose-Headers", "X-Request-ID")
+		next.ServeHTTP(w, r)
+	})
+}
+
+//Registered app frontends may read who is logged in from the browser. Token verification
+//needs the app secret, so it stays server to server and gets no CORS at all
+var appCredentialedCORS = &CORSPolicy{
+	Origins: func() []string {
+		return apps.Origins()
+	},
+	Methods: []string{"GET"},
+	Headers: []string{"Content-Type", "X-Request-ID"},
+	Credentials: true,
+	MaxAge: 600,
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+	"net/http"
+	"net/http/httptest"
+)
+
+func TestParseAppsRegistry(t *testing.T) {
+	registry, err := parseApps(`
+legacy = "supersecret"
+
+[canban]
+secret = "othersecret"
+origins = ["https://Canban.foo.portal/"]
+`); if err != nil {
+		t.Fatal("Parsing apps.toml failed", err.Error())
+	}
+
+	if secret, ok := registry.Get("legacy"); !ok || secret != "supersecret" {
+		t.Fatal("Short form app entry was not parsed")
+	}
+
+	if secret, ok := registry.Get("canban"); !ok || secret != "othersecret" {
+		t.Fatal("Table form app entry was not parsed")
+	}
+
+	origins := registry.Origins()
+	if len(origins) != 1 || origins[0] != "https://canban.foo.portal" {
+		t.Fatal("App origins were not normalized", origins)
+	}
+
+	_, err = parseApps("[nosecret]\norigins = []\n"); if err == nil {
+		t.Fatal("App without a secret was accepted")
+	}
+}
+
+func TestCORSMiddleware(t *testing.T) {
+	policy := &CORSPolicy{
+		Origins: func() []string { return []string{"https://canban.foo.portal"} },
+		Methods: []string{"GET"},
+		Headers: []string{"Content-Type"},
+		Credentials: true,
+	}
+
+	reached := false
+	handler := corsMiddleware(policy, postMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	})))
+
+	r := httptest.NewRequest("OPTIONS", "/user/info", nil)
+	r.Header.Set("Origin", "https://canban.foo.portal")
+	r.Header.Set("Access-Control-Request-Method", "GET")
+	r.Header.Set("Access-Control-Request-Headers", "content-type")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+
+	if rec.Code != 204 || reached {
+		t.Fatal("Preflight was not answered by the CORS middleware", rec.Code)
+	}
+
+	if rec.Header().Get("Access-Control-Allow-Origin") != "https://canban.foo.portal" || rec.Header().Get("Access-Control-Allow-Credentials") != "true" {
+		t.Fatal("Preflight did not allow the registered origin")
+	}
+
+	r = httptest.NewRequest("OPTIONS", "/user/info", nil)
+	r.Header.Set("Origin", "https://evil.example")
+	r.Header.Set("Access-Control-Request-Method", "GET")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+
+	if rec.Code != 403 || rec.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatal("Preflight from an unregistered origin was allowed")
+	}
+
+	r = httptest.NewRequest("OPTIONS", "/user/info", nil)
+	r.Header.Set("Origin", "https://canban.foo.portal")
+	r.Header.Set("Access-Control-Request-Method", "DELETE")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+
+	if rec.Code != 403 {
+		t.Fatal("Preflight for a method outside the policy was allowed")
+	}
+
+	r = httptest.NewRequest("GET", "/user/info", nil)
+	r.Header.Set("Origin", "https://evil.example")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+
+	if rec.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatal("Unregistered origin was reflected")
+	}
+}
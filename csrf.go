@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+)
+
+const csrfHeader = "X-CSRF-Token"
+
+var errSessionRequired = forbidden("session_required", "This route needs a browser session")
+
+func newCSRFToken() string {
+	b := make([]byte, 32)
+	_, err := rand.Read(b); if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+type CSRFTokenResponse struct {
+	CSRFToken string `json:"csrfToken"`
+}
+
+//Synchronizer token check, the token is minted with the session and must come back
+//in the X-CSRF-Token header of every state changing request. Runs behind authMiddleware
+func csrfMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, ok := principalFrom(r); if !ok {
+			writeError(w, errInvalidSession)
+			return
+		}
+
+		//Personal tokens can read but never change anything, least of all mint more tokens
+		if p.TokenType != sessionTokenType {
+			writeError(w, errSessionRequired)
+			return
+		}
+
+		au, ok := activeUsers.Get(p.Token); if !ok {
+			writeError(w, errInvalidSession)
+			return
+		}
+
+		token := r.Header.Get(csrfHeader)
+		if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(au.CSRFToken)) != 1 {
+			writeError(w, forbidden("bad_csrf_token", "CSRF token is missing or does not match the session"))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+//Lets clients that didn't get the token from the welcome page fetch it.
+//Cross-site pages can't read this response, so it doesn't help a forger
+func csrfTokenHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := principalFrom(r); if !ok {
+		writeError(w, errInvalidSession)
+		return
+	}
+
+	if p.TokenType != sessionTokenType {
+		writeError(w, errSessionRequired)
+		return
+	}
+
+	au, ok := activeUsers.Get(p.Token); if !ok {
+		writeError(w, errInvalidSession)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, &CSRFTokenResponse{CSRFToken: au.CSRFToken})
+}
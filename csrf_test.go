@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+func TestForgedCrossSitePosts(t *testing.T) {
+	au := &ActiveUser{Id: 43, Name: "corgi", AccessToken: "csrftesttoken", CSRFToken: newCSRFToken(), LoginAt: time.Now()}
+	activeUsers.Add(au)
+
+	handler := postDefense(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, &MessageResponse{Message: "done"})
+	})
+
+	cases := []struct{
+		name string
+		origin string
+		referer string
+		csrf string
+		status int
+	}{
+		{"same origin with token", allowedOrigins()[0], "", au.CSRFToken, 200},
+		{"referer fallback with token", "", allowedOrigins()[0] + "/welcome", au.CSRFToken, 200},
+		{"cross site origin", "https://evil.example", "", au.CSRFToken, 403},
+		{"lookalike localhost origin", "http://localhost.evil.example", "", au.CSRFToken, 403},
+		{"cross site origin with trusted referer", "https://evil.example", allowedOrigins()[0] + "/", au.CSRFToken, 403},
+		{"no origin or referer", "", "", au.CSRFToken, 403},
+		{"opaque origin", "null", "", au.CSRFToken, 403},
+		{"opaque origin with trusted referer", "null", allowedOrigins()[0] + "/welcome", au.CSRFToken, 403},
+		{"missing token", allowedOrigins()[0], "", "", 403},
+		{"wrong token", allowedOrigins()[0], "", newCSRFToken(), 403},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("POST", "/update/username", bytes.NewBufferString(`{"username": "pwned"}`))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("Cookie", au.AccessToken)
+		if c.origin != "" {
+			r.Header.Set("Origin", c.origin)
+		}
+		if c.referer != "" {
+			r.Header.Set("Referer", c.referer)
+		}
+		if c.csrf != "" {
+			r.Header.Set(csrfHeader, c.csrf)
+		}
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+
+		if rec.Code != c.status {
+			t.Fatal(c.name, "expected", c.status, "got", rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestCSRFTokenHandler(t *testing.T) {
+	au := &ActiveUser{Id: 44, Name: "husky", AccessToken: "csrffetchtoken", CSRFToken: newCSRFToken(), LoginAt: time.Now()}
+	activeUsers.Add(au)
+
+	handler := authMiddleware(http.HandlerFunc(csrfTokenHandler))
+
+	r := httptest.NewRequest("GET", "/csrf/token", nil)
+	r.Header.Set("Cookie", au.AccessToken)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+
+	if rec.Code != 200 || !bytes.Contains(rec.Body.Bytes(), []byte(au.CSRFToken)) {
+		t.Fatal("CSRF token was not returned for the session")
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"github.com/lib/pq"
+)
+
+//Every error response has the shape {"error": {"code": "...", "message": "..."}}.
+//Code is stable for clients to switch on, message is for humans and never carries internals
+type APIError struct {
+	Status int `json:"-"`
+	Code string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+type ErrorResponse struct {
+	Error *APIError `json:"error"`
+}
+
+func badRequest(code string, message string) *APIError {
+	return &APIError{Status: http.StatusBadRequest, Code: code, Message: message}
+}
+
+func unauthorized(code string, message string) *APIError {
+	return &APIError{Status: http.StatusUnauthorized, Code: code, Message: message}
+}
+
+func forbidden(code string, message string) *APIError {
+	return &APIError{Status: http.StatusForbidden, Code: code, Message: message}
+}
+
+func notFound(code string, message string) *APIError {
+	return &APIError{Status: http.StatusNotFound, Code: code, Message: message}
+}
+
+func conflict(code string, message string) *APIError {
+	return &APIError{Status: http.StatusConflict, Code: code, Message: message}
+}
+
+var (
+	errInvalidSession = unauthorized("invalid_session", "Access token is missing, expired or unknown")
+	errForbiddenUser = forbidden("forbidden", "Access token is not authorized for user")
+	errNotAdmin = forbidden("not_admin", "User is not an admin. Unauthorized action.")
+	errUserNotFound = notFound("user_not_found", "User does not exist")
+	errUsernameTaken = conflict("username_taken", "Username is already taken")
+	errInternal = &APIError{Status: http.StatusInternalServerError, Code: "internal_error", Message: "Internal server error"}
+)
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, e *APIError) {
+	writeJSON(w, e.Status, &ErrorResponse{Error: e})
+}
+
+//Logs the real cause with the request context and answers with an opaque 500
+func internalError(w http.ResponseWriter, r *http.Request, err error) {
+	requestLogger(r, "http").Error("Internal error", "error", err.Error())
+	writeError(w, errInternal)
+}
+
+//Maps errors from the database onto API errors, anything unexpected is an internal error
+func dbError(w http.ResponseWriter, r *http.Request, err error) {
+	if err == sql.ErrNoRows {
+		writeError(w, errUserNotFound)
+		return
+	}
+
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		writeError(w, errUsernameTaken)
+		return
+	}
+
+	internalError(w, r, err)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"portal/portalpb"
+)
+
+//gRPC service for internal backends that can't call the form style HTTP routes.
+//Apps authenticate every call with their secret, see portalpb/portal.proto
+
+type GRPCConfig struct {
+	//Address the service listens on, like ":9090". Empty turns it off
+	Address string
+}
+
+var grpcServer *grpc.Server
+
+type grpcAppKey struct{}
+
+//The app that made the call, set by grpcAuthInterceptor
+func grpcApp(ctx context.Context) string {
+	app, _ := ctx.Value(grpcAppKey{}).(string)
+	return app
+}
+
+//Reads `authorization: Basic ...` metadata. Both halves may be form-encoded like for /oauth/token
+func grpcAppCredentials(ctx context.Context) (string, string, bool) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) != 1 || len(values[0]) < 6 || !strings.EqualFold(values[0][:6], "Basic ") {
+		return "", "", false
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(values[0][6:]); if err != nil {
+		return "", "", false
+	}
+	app, secret, ok := strings.Cut(string(raw), ":"); if !ok {
+		return "", "", false
+	}
+
+	app, err = url.QueryUnescape(app); if err != nil {
+		return "", "", false
+	}
+	secret, err = url.QueryUnescape(secret); if err != nil {
+		return "", "", false
+	}
+	return app, secret, true
+}
+
+func grpcAuthInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	l := logger.With("component", "grpc", "method", info.FullMethod)
+
+	app, secret, ok := grpcAppCredentials(ctx)
+	if ok {
+		_, ok = checkAppSecret(app, secret)
+	}
+	if !ok {
+		l.Warn("gRPC call refused", "app", app, "reason", "invalid_client")
+		return nil, grpcError(errInvalidApp)
+	}
+
+	start := time.Now()
+	resp, err := handler(context.WithValue(ctx, grpcAppKey{}, app), req)
+	l.Info("gRPC call", "app", app, "code", status.Code(err).String(), "duration_ms", time.Since(start).Milliseconds())
+	return resp, err
+}
+
+//Maps Portal's API errors onto gRPC status codes, keeping the stable error code in the message
+func grpcError(e *APIError) error {
+	code := codes.Internal
+	switch e.Status {
+	case http.StatusBadRequest:
+		code = codes.InvalidArgument
+	case http.StatusUnauthorized:
+		code = codes.Unauthenticated
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusConflict:
+		code = codes.AlreadyExists
+	}
+	return status.Error(code, e.Code + ": " + e.Message)
+}
+
+func grpcStoreError(ctx context.Context, err error) error {
+	if err == sql.ErrNoRows {
+		return grpcError(errUserNotFound)
+	}
+
+	logger.Error("gRPC call failed", "component", "grpc", "app", grpcApp(ctx), "error", err.Error())
+	return grpcError(errInternal)
+}
+
+type portalService struct {
+	portalpb.UnimplementedPortalServer
+}
+
+func (s *portalService) VerifyToken(ctx context.Context, req *portalpb.VerifyTokenRequest) (*portalpb.VerifyTokenResponse, error) {
+	if req.AccessToken == "" {
+		return nil, grpcError(badRequest("missing_field", "access_token is required"))
+	}
+
+	//Ids start at 1, so 0 means the app wants to know whose token it is
+	var userId *int64
+	if req.UserId != 0 {
+		userId = &req.UserId
+	}
+
+	p, apiErr := verifyAppToken(grpcApp(ctx), req.AccessToken, userId); if apiErr != nil {
+		return nil, grpcError(apiErr)
+	}
+
+	return &portalpb.VerifyTokenResponse{
+		UserId: p.Id,
+		Username: p.Name,
+		TokenType: p.TokenType,
+		Scopes: p.Scopes,
+		Audience: p.Audience,
+	}, nil
+}
+
+func (s *portalService) account(req *portalpb.GetUserRequest) (*Account, error) {
+	switch user := req.User.(type) {
+	case *portalpb.GetUserRequest_Id:
+		return userStore.Get(user.Id)
+	case *portalpb.GetUserRequest_Username:
+		name := user.Username
+		accounts, _, err := userStore.List(&AccountFilter{Name: &name}, 0, 1); if err != nil {
+			return nil, err
+		}
+		if len(accounts) == 0 {
+			return nil, sql.ErrNoRows
+		}
+		return accounts[0], nil
+	}
+	return nil, grpcError(badRequest("missing_field", "id or username is required"))
+}
+
+func (s *portalService) GetUser(ctx context.Context, req *portalpb.GetUserRequest) (*portalpb.User, error) {
+	a, err := s.account(req); if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return nil, err
+		}
+		return nil, grpcStoreError(ctx, err)
+	}
+
+	return &portalpb.User{
+		Id: a.Id,
+		Username: a.Name,
+		Admin: a.Admin,
+		Active: a.Active,
+		ExternalId: a.ExternalId,
+	}, nil
+}
+
+func (s *portalService) ListUserGroups(ctx context.Context, req *portalpb.ListUserGroupsRequest) (*portalpb.ListUserGroupsResponse, error) {
+	a, err := userStore.Get(req.UserId); if err != nil {
+		return nil, grpcStoreError(ctx, err)
+	}
+
+	//A deactivated user is in no group, so group checks fail closed
+	groups := []string{}
+	if a.Active {
+		groups = userGroups(a.Admin)
+	}
+	return &portalpb.ListUserGroupsResponse{Groups: groups}, nil
+}
+
+func (s *portalService) RevokeSession(ctx context.Context, req *portalpb.RevokeSessionRequest) (*portalpb.RevokeSessionResponse, error) {
+	if req.UserId == 0 || req.SessionId == "" {
+		return nil, grpcError(badRequest("missing_field", "user_id and session_id are required"))
+	}
+
+	//An app may only end sessions that were used with it
+	app := grpcApp(ctx)
+	for _, au := range activeUsers.ListUser(req.UserId) {
+		if au.SessionId == req.SessionId && !au.UsedWith(app) {
+			return nil, grpcError(forbidden("session_not_used_by_app", "Session was never used with this app"))
+		}
+	}
+
+	revoked := activeUsers.DeleteSession(req.UserId, req.SessionId)
+	logger.Info("Session revoked by app", "component", "session", "app", app, "target_user_id", req.UserId, "session_id", req.SessionId, "revoked", revoked)
+	return &portalpb.RevokeSessionResponse{Revoked: revoked}, nil
+}
+
+func newGRPCServer(tlsConfig *tls.Config) *grpc.Server {
+	options := []grpc.ServerOption{grpc.UnaryInterceptor(grpcAuthInterceptor)}
+	if tlsConfig != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+
+	server := grpc.NewServer(options...)
+	portalpb.RegisterPortalServer(server, &portalService{})
+	return server
+}
+
+//Starts the gRPC service when an address is configured, with the same TLS setup as the HTTP server
+func startGRPC() {
+	if config.GRPC.Address == "" {
+		return
+	}
+	l := logger.With("component", "grpc")
+
+	var tlsConfig *tls.Config
+	if config.TLS.Enabled() {
+		var err error
+		tlsConfig, err = newTLSConfig(&config.TLS); if err != nil {
+			fatal(l, "Configuring TLS failed", err)
+		}
+	}
+
+	listener, err := net.Listen("tcp", config.GRPC.Address); if err != nil {
+		fatal(l, "Listening for gRPC failed", err)
+	}
+
+	grpcServer = newGRPCServer(tlsConfig)
+	l.Info("Running gRPC service", "address", config.GRPC.Address, "tls", tlsConfig != nil)
+	go func() {
+		err := grpcServer.Serve(listener); if err != nil {
+			fatal(l, "gRPC service stopped unexpectedly", err)
+		}
+	}()
+}
+
+//Lets in-flight calls finish until ctx is done, then cuts the rest off
+func stopGRPC(ctx context.Context) {
+	if grpcServer == nil {
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		grpcServer.Stop()
+	}
+}
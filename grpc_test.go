@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"portal/portalpb"
+)
+
+func withGRPCService(t *testing.T) portalpb.PortalClient {
+	savedApps := apps
+	registry, err := parseApps("[reporter]\nsecret = \"reportersecret\"\n"); if err != nil {
+		t.Fatal(err)
+	}
+	apps = registry
+
+	listener := bufconn.Listen(1 << 20)
+	server := newGRPCServer(nil)
+	go server.Serve(listener)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet", grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return listener.DialContext(ctx)
+	})); if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		conn.Close()
+		server.Stop()
+		apps = savedApps
+	})
+	return portalpb.NewPortalClient(conn)
+}
+
+func appContext(app string, secret string) context.Context {
+	credentials := base64.StdEncoding.EncodeToString([]byte(app + ":" + secret))
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Basic " + credentials)
+}
+
+func TestGRPCVerifyToken(t *testing.T) {
+	portal := withGRPCService(t)
+	activeUsers.Add(&ActiveUser{Id: 7, Name: "shiba", AccessToken: "pst_grpc", SessionId: "grpc-session", LoginAt: time.Now()})
+	defer activeUsers.DeleteSession(7, "grpc-session")
+
+	ctx := appContext("reporter", "reportersecret")
+	resp, err := portal.VerifyToken(ctx, &portalpb.VerifyTokenRequest{AccessToken: "pst_grpc"}); if err != nil {
+		t.Fatal(err)
+	}
+	if resp.UserId != 7 || resp.Username != "shiba" || resp.TokenType != sessionTokenType {
+		t.Fatal("Unexpected verification", resp)
+	}
+
+	au, _ := activeUsers.Get("pst_grpc")
+	if len(au.Apps) != 1 || au.Apps[0] != "reporter" {
+		t.Fatal("Session was not marked as used by the app", au.Apps)
+	}
+
+	checks := []struct {
+		ctx context.Context
+		req *portalpb.VerifyTokenRequest
+		code codes.Code
+	}{
+		{appContext("reporter", "wrong"), &portalpb.VerifyTokenRequest{AccessToken: "pst_grpc"}, codes.Unauthenticated},
+		{appContext("nobody", "reportersecret"), &portalpb.VerifyTokenRequest{AccessToken: "pst_grpc"}, codes.Unauthenticated},
+		{context.Background(), &portalpb.VerifyTokenRequest{AccessToken: "pst_grpc"}, codes.Unauthenticated},
+		{ctx, &portalpb.VerifyTokenRequest{AccessToken: "pst_unknown"}, codes.Unauthenticated},
+		{ctx, &portalpb.VerifyTokenRequest{AccessToken: "pst_grpc", UserId: 8}, codes.PermissionDenied},
+		{ctx, &portalpb.VerifyTokenRequest{}, codes.InvalidArgument},
+	}
+	for _, c := range checks {
+		_, err := portal.VerifyToken(c.ctx, c.req); if status.Code(err) != c.code {
+			t.Fatal("Unexpected status", c.req, err)
+		}
+	}
+}
+
+//Leaving out the user only asks whose token it is over gRPC, /verify/token always checks it
+func TestVerifyTokenUserIdOnlyOptionalForGRPC(t *testing.T) {
+	portal := withGRPCService(t)
+	activeUsers.Add(&ActiveUser{Id: 7, Name: "shiba", AccessToken: "pst_grpc_any", SessionId: "grpc-any", LoginAt: time.Now()})
+	defer activeUsers.DeleteSession(7, "grpc-any")
+
+	resp, err := portal.VerifyToken(appContext("reporter", "reportersecret"), &portalpb.VerifyTokenRequest{AccessToken: "pst_grpc_any"}); if err != nil || resp.UserId != 7 {
+		t.Fatal("Token without an expected user was refused", err)
+	}
+
+	for _, id := range []string{"0", "8"} {
+		rec := httptest.NewRecorder()
+		verifyTokenHandler(rec, httptest.NewRequest("GET", "/verify/token?app_name=reporter&secret=reportersecret&access_token=pst_grpc_any&user_id=" + id, nil))
+		if rec.Code != http.StatusForbidden {
+			t.Fatal("Token was verified for the wrong user", id, rec.Code)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	verifyTokenHandler(rec, httptest.NewRequest("GET", "/verify/token?app_name=reporter&secret=reportersecret&access_token=pst_grpc_any&user_id=7", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatal("Token was not verified for its user", rec.Code)
+	}
+}
+
+func TestGRPCRevokeSession(t *testing.T) {
+	portal := withGRPCService(t)
+	activeUsers.Add(&ActiveUser{Id: 7, Name: "shiba", AccessToken: "pst_grpc_revoke", SessionId: "grpc-revoke", LoginAt: time.Now()})
+	activeUsers.UsedBy("pst_grpc_revoke", "reporter")
+	activeUsers.Add(&ActiveUser{Id: 7, Name: "shiba", AccessToken: "pst_grpc_other", SessionId: "grpc-other", LoginAt: time.Now()})
+	activeUsers.UsedBy("pst_grpc_other", "canban")
+	defer activeUsers.DeleteSession(7, "grpc-other")
+
+	ctx := appContext("reporter", "reportersecret")
+
+	//A session only ever used with canban is none of reporter's business
+	if _, err := portal.RevokeSession(ctx, &portalpb.RevokeSessionRequest{UserId: 7, SessionId: "grpc-other"}); status.Code(err) != codes.PermissionDenied {
+		t.Fatal("App revoked a session it was never used with", err)
+	}
+	if _, ok := activeUsers.Get("pst_grpc_other"); !ok {
+		t.Fatal("Session of another app was revoked")
+	}
+
+	if _, err := portal.RevokeSession(ctx, &portalpb.RevokeSessionRequest{UserId: 7}); status.Code(err) != codes.InvalidArgument {
+		t.Fatal("Revocation without a session id was accepted", err)
+	}
+
+	//Session ids are only honored for the user they belong to
+	resp, err := portal.RevokeSession(ctx, &portalpb.RevokeSessionRequest{UserId: 8, SessionId: "grpc-revoke"}); if err != nil || resp.Revoked {
+		t.Fatal("Another user's session was revoked", err)
+	}
+
+	resp, err = portal.RevokeSession(ctx, &portalpb.RevokeSessionRequest{UserId: 7, SessionId: "grpc-revoke"}); if err != nil || !resp.Revoked {
+		t.Fatal("Session was not revoked", err)
+	}
+	if _, ok := activeUsers.Get("pst_grpc_revoke"); ok {
+		t.Fatal("Revoked session is still active")
+	}
+}
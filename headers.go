@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+//Security headers for a route, an empty field falls back to the default policy.
+//{nonce} in CSP is replaced with a fresh nonce for every response
+type SecurityHeaders struct {
+	CSP string `toml:"csp"`
+	FrameOptions string `toml:"frame_options"`
+	ReferrerPolicy string `toml:"referrer_policy"`
+	PermissionsPolicy string `toml:"permissions_policy"`
+}
+
+type SecurityHeadersConfig struct {
+	Default SecurityHeaders
+	Routes map[string]SecurityHeaders
+}
+
+//Scripts only run from Portal itself or with the response nonce. Styles allow inline
+//because the login page's elm-css injects <style> elements at runtime
+var defaultSecurityHeaders = SecurityHeaders{
+	CSP: "default-src 'self'; script-src 'self' 'nonce-{nonce}'; style-src 'self' 'unsafe-inline'; img-src 'self' data:; object-src 'none'; base-uri 'none'; frame-ancestors 'none'; form-action 'self'",
+	FrameOptions: "DENY",
+	//same-origin keeps Referer for originMiddleware's fallback without leaking tokens in URLs to other sites
+	ReferrerPolicy: "same-origin",
+	PermissionsPolicy: "camera=(), microphone=(), geolocation=(), payment=(), usb=(), interest-cohort=()",
+}
+
+func (h SecurityHeaders) merge(override SecurityHeaders) SecurityHeaders {
+	if override.CSP != "" {
+		h.CSP = override.CSP
+	}
+	if override.FrameOptions != "" {
+		h.FrameOptions = override.FrameOptions
+	}
+	if override.ReferrerPolicy != "" {
+		h.ReferrerPolicy = override.ReferrerPolicy
+	}
+	if override.PermissionsPolicy != "" {
+		h.PermissionsPolicy = override.PermissionsPolicy
+	}
+	return h
+}
+
+func securityHeadersFor(route string) SecurityHeaders {
+	h := defaultSecurityHeaders.merge(config.SecurityHeaders.Default)
+	if override, ok := config.SecurityHeaders.Routes[route]; ok {
+		h = h.merge(override)
+	}
+	return h
+}
+
+type nonceContextKey struct{}
+
+func newNonce() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b); if err != nil {
+		panic(err)
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+//The nonce the CSP of this response allows inline scripts with
+func cspNonce(r *http.Request) string {
+	nonce, _ := r.Context().Value(nonceContextKey{}).(string)
+	return nonce
+}
+
+//Applies the policy of the mux route that serves the request, like metricsMiddleware
+//looks routes up by pattern so every static file shares the "/" policy
+func securityHeadersMiddleware(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route := mux.Handler(r)
+		policy := securityHeadersFor(route)
+		nonce := newNonce()
+
+		h := w.Header()
+		h.Set("X-Content-Type-Options", "nosniff")
+		if policy.CSP != "none" {
+			h.Set("Content-Security-Policy", strings.Replace(policy.CSP, "{nonce}", nonce, -1))
+		}
+		if policy.FrameOptions != "none" {
+			h.Set("X-Frame-Options", policy.FrameOptions)
+		}
+		if policy.ReferrerPolicy != "none" {
+			h.Set("Referrer-Policy", policy.ReferrerPolicy)
+		}
+		if policy.PermissionsPolicy != "none" {
+			h.Set("Permissions-Policy", policy.PermissionsPolicy)
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), nonceContextKey{}, nonce)))
+	})
+}
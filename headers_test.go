@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+func TestSecurityHeadersMiddleware(t *testing.T) {
+	saved := config.SecurityHeaders
+	defer func() { config.SecurityHeaders = saved }()
+	config.SecurityHeaders = SecurityHeadersConfig{
+		Routes: map[string]SecurityHeaders{
+			"/embed": SecurityHeaders{FrameOptions: "none", CSP: "frame-ancestors https://canban.foo.portal"},
+		},
+	}
+
+	var nonce string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		nonce = cspNonce(r)
+	})
+	mux.HandleFunc("/embed", func(w http.ResponseWriter, r *http.Request) {})
+	handler := securityHeadersMiddleware(mux, mux)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/welcome.css", nil))
+
+	csp := rec.Header().Get("Content-Security-Policy")
+	if nonce == "" || !strings.Contains(csp, "'nonce-" + nonce + "'") {
+		t.Fatal("CSP does not carry the nonce handed to the handler", csp)
+	}
+
+	for _, header := range []string{"X-Frame-Options", "Referrer-Policy", "Permissions-Policy", "X-Content-Type-Options"} {
+		if rec.Header().Get(header) == "" {
+			t.Fatal("Missing security header", header)
+		}
+	}
+
+	first := nonce
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if nonce == first {
+		t.Fatal("Nonce was reused across responses")
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/embed", nil))
+
+	if rec.Header().Get("X-Frame-Options") != "" {
+		t.Fatal("Route override did not drop X-Frame-Options")
+	}
+
+	if rec.Header().Get("Content-Security-Policy") != "frame-ancestors https://canban.foo.portal" {
+		t.Fatal("Route override did not replace the CSP")
+	}
+
+	if rec.Header().Get("Referrer-Policy") != defaultSecurityHeaders.ReferrerPolicy {
+		t.Fatal("Route override did not inherit the default Referrer-Policy")
+	}
+}
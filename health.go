@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+type ComponentStatus struct {
+	Status string `json:"status"`
+}
+
+type HealthStatus struct {
+	Status string `json:"status"`
+	Components map[string]ComponentStatus `json:"components,omitempty"`
+}
+
+const readinessTimeout = 2 * time.Second
+
+//Liveness only says the process is serving requests, it never touches dependencies
+//so a slow database can't get the process restarted
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&HealthStatus{Status: "ok"})
+}
+
+//Readiness checks what can break while Portal runs. The schema isn't among them: startup runs
+//sql/migrate.sql and prepares every query, so a missing table or column stops Portal before it serves
+func readyzHandler() http.HandlerFunc {
+
+	stmt := prepareQuery("sql/ping.sql")
+
+	checks := map[string]func(ctx context.Context) error{
+		"database": func(ctx context.Context) error {
+			return db.PingContext(ctx)
+		},
+		"statements": func(ctx context.Context) error {
+			var one int
+			return stmt.QueryRowContext(ctx).Scan(&one)
+		},
+		"sessions": func(ctx context.Context) error {
+			return activeUsers.Ping()
+		},
+		"signing_keys": func(ctx context.Context) error {
+			return signingKeys.Ping()
+		},
+		"apps": func(ctx context.Context) error {
+			if apps == nil || len(apps.Map) == 0 {
+				return fmt.Errorf("No apps registered in apps.toml")
+			}
+			return nil
+		},
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+		defer cancel()
+
+		status := HealthStatus{
+			Status: "ok",
+			Components: make(map[string]ComponentStatus),
+		}
+
+		for name, check := range checks {
+			err := check(ctx); if err != nil {
+				//The reason is logged, probes only get to see which component is down
+				requestLogger(r, "health").Warn("Readiness check failed", "check", name, "error", err.Error())
+				status.Status = "unavailable"
+				status.Components[name] = ComponentStatus{Status: "unavailable"}
+				continue
+			}
+			status.Components[name] = ComponentStatus{Status: "ok"}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if status.Status != "ok" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(&status)
+	})
+}
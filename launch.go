@@ -0,0 +1,214 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Launching an app from the welcome page: Portal sends the browser to the app's launch URI with a
+//signed single use code, and the app trades the code server to server for who clicked
+
+const (
+	launchTokenType = "launch+jwt"
+	launchCodeLifetime = time.Minute
+)
+
+type LaunchClaims struct {
+	Issuer string `json:"iss"`
+	Subject string `json:"sub"`
+	Audience string `json:"aud"`
+	SessionId string `json:"sid"`
+	IssuedAt int64 `json:"iat"`
+	ExpiresAt int64 `json:"exp"`
+	Id string `json:"jti"`
+}
+
+func newLaunchClaims(app *App, au *ActiveUser, now time.Time) *LaunchClaims {
+	return &LaunchClaims{
+		Issuer: tokenIssuer(),
+		Subject: strconv.FormatInt(au.Id, 10),
+		Audience: app.Name,
+		SessionId: au.SessionId,
+		IssuedAt: now.Unix(),
+		ExpiresAt: now.Add(launchCodeLifetime).Unix(),
+		Id: newSessionId(),
+	}
+}
+
+//Ids of redeemed codes, kept until the code would have expired anyway
+type LaunchCodes struct {
+	mu sync.Mutex
+	used map[string]time.Time
+}
+
+var launchCodes = &LaunchCodes{used: make(map[string]time.Time)}
+
+//Marks a code as used, false when it already was
+func (l *LaunchCodes) Redeem(id string, expires time.Time, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for used, exp := range l.used {
+		if now.After(exp) {
+			delete(l.used, used)
+		}
+	}
+
+	if _, ok := l.used[id]; ok {
+		return false
+	}
+	l.used[id] = expires
+	return true
+}
+
+var (
+	errInvalidLaunchCode = oauthRequest("invalid_grant", "Launch code is invalid, expired or already used")
+	errAppNotPermitted = forbidden("app_not_permitted", "User may not open this app")
+)
+
+//Checks a code presented by app, its session must still be active
+func redeemLaunchCode(app *App, code string, now time.Time) (*LaunchClaims, *ActiveUser, *OAuthError) {
+	var claims LaunchClaims
+	err := signingKeys.VerifyTyped(launchTokenType, code, &claims); if err != nil {
+		return nil, nil, errInvalidLaunchCode
+	}
+
+	if claims.Issuer != tokenIssuer() || claims.Audience != app.Name || now.Unix() >= claims.ExpiresAt {
+		return nil, nil, errInvalidLaunchCode
+	}
+
+	if !launchCodes.Redeem(claims.Id, time.Unix(claims.ExpiresAt, 0), now) {
+		return nil, nil, errInvalidLaunchCode
+	}
+
+	id, err := strconv.ParseInt(claims.Subject, 10, 64); if err != nil {
+		return nil, nil, errInvalidLaunchCode
+	}
+	for _, au := range activeUsers.ListUser(id) {
+		if au.SessionId == claims.SessionId && !au.Expired(now) && app.Permits(au.Name) {
+			//The app authenticated to redeem the code, so it can be told when the session ends
+			activeUsers.SessionUsedBy(au.Id, au.SessionId, app.Name)
+			return &claims, &au, nil
+		}
+	}
+	return nil, nil, errInvalidLaunchCode
+}
+
+//Where the browser goes with the code, any query the app registered is kept
+func launchRedirect(app *App, code string) string {
+	u, _ := url.Parse(app.LaunchURI)
+	q := u.Query()
+	q.Set("code", code)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+//GET /launch/<app> from the welcome page
+func launchHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireGet(w, r) {
+		return
+	}
+
+	//Service accounts are not on the welcome page
+	name := strings.TrimPrefix(r.URL.Path, "/launch/")
+	app, ok := apps.App(name); if !ok || app.Service || app.LaunchURI == "" {
+		writeError(w, notFound("app_not_found", "No app with a launch URI is registered with that name"))
+		return
+	}
+	setLogApp(r, app.Name)
+
+	now := time.Now()
+	token := sessionToken(r)
+	au, ok := activeUsers.Get(token); if !ok || au.Expired(now) {
+		loginFirst(w, r, app.LaunchURL())
+		return
+	}
+	setLogUser(r, au.Id)
+
+	if !app.Permits(au.Name) {
+		requestLogger(r, "launch").Warn("App launch refused")
+		writeError(w, errAppNotPermitted)
+		return
+	}
+
+	code, err := signingKeys.SignTyped(launchTokenType, newLaunchClaims(app, au, now)); if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	activeUsers.Touch(token, now)
+	signedTokenIssued("launch")
+	requestLogger(r, "launch").Info("App launched")
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	http.Redirect(w, r, launchRedirect(app, code), http.StatusSeeOther)
+}
+
+type LaunchExchangeResponse struct {
+	Id int64 `json:"id"`
+	Name string `json:"name"`
+	Admin bool `json:"admin"`
+	SessionId string `json:"sessionId"`
+}
+
+//POST /launch/exchange, the app authenticates like at /oauth/token and trades the code for the user
+func launchExchangeHandler() http.HandlerFunc {
+	stmt := prepareQuery("sql/check_admin.sql")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		oauthErr := parseOAuthForm(w, r); if oauthErr != nil {
+			writeOAuthError(w, oauthErr)
+			return
+		}
+
+		app, oauthErr := authenticateClient(r); if oauthErr != nil {
+			writeOAuthError(w, oauthErr)
+			return
+		}
+
+		code := r.PostForm.Get("code")
+		if code == "" {
+			writeOAuthError(w, oauthRequest("invalid_request", "code is required"))
+			return
+		}
+
+		claims, au, oauthErr := redeemLaunchCode(app, code, time.Now()); if oauthErr != nil {
+			requestLogger(r, "launch").Warn("Launch code refused")
+			writeOAuthError(w, oauthErr)
+			return
+		}
+		setLogUser(r, au.Id)
+
+		var admin bool
+		err := stmt.QueryRow(au.Id).Scan(&admin); if err == sql.ErrNoRows {
+			writeOAuthError(w, errInvalidLaunchCode)
+			return
+		} else if err != nil {
+			requestLogger(r, "launch").Error("Looking up launched user failed", "error", err.Error())
+			writeOAuthError(w, &OAuthError{Status: http.StatusInternalServerError, Code: "server_error"})
+			return
+		}
+
+		requestLogger(r, "launch").Info("Launch code redeemed", "session_id", claims.SessionId)
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusOK, &LaunchExchangeResponse{
+			Id: au.Id,
+			Name: au.Name,
+			Admin: admin,
+			SessionId: au.SessionId,
+		})
+	})
+}
+
+func validateLaunchURI(uri string) error {
+	u, err := url.Parse(uri); if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || u.Fragment != "" {
+		return fmt.Errorf("launch_uri must be an absolute http or https URL")
+	}
+	return nil
+}
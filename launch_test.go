@@ -0,0 +1,177 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func withLaunchApps(t *testing.T) func() {
+	return withApps(t, `
+[canban]
+secret = "appsecret"
+launch_uri = "https://canban.example.com/portal/launch?tenant=acme"
+
+[wiki]
+secret = "wikisecret"
+
+[ops]
+secret = "opssecret"
+launch_uri = "https://ops.example.com/launch"
+users = ["akita"]
+
+[reporter]
+secret = "reportersecret"
+service = true
+launch_uri = "https://reporter.example.com/launch"
+`)
+}
+
+func launch(app string, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/launch/" + app, nil)
+	if token != "" {
+		r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: token})
+	}
+	rec := httptest.NewRecorder()
+	launchHandler(rec, r)
+	return rec
+}
+
+func TestLaunchLinks(t *testing.T) {
+	defer withLaunchApps(t)()
+
+	links := apps.Links("shiba")
+	if len(links) != 2 || links[0].URL != "/launch/canban" || links[1].URL != "/wiki" {
+		t.Fatal("Unexpected welcome page links", links)
+	}
+
+	if links := apps.Links("akita"); len(links) != 3 || links[1].URL != "/launch/ops" {
+		t.Fatal("Allowed user does not see the app", links)
+	}
+
+	_, err := parseApps("[exchange]\nsecret = \"s\"\nlaunch_uri = \"https://exchange.example.com/launch\"\n"); if err == nil {
+		t.Fatal("App shadowing the exchange endpoint was accepted")
+	}
+
+	for _, uri := range []string{"/portal/launch", "javascript:alert(1)", "https://canban.example.com/launch#code"} {
+		_, err := parseApps("[bad]\nsecret = \"s\"\nlaunch_uri = \"" + uri + "\"\n"); if err == nil {
+			t.Fatal("Invalid launch URI was accepted", uri)
+		}
+	}
+}
+
+func TestLaunchHandoff(t *testing.T) {
+	defer withLaunchApps(t)()
+	activeUsers.Add(&ActiveUser{Id: 7, Name: "shiba", AccessToken: "pst_launch", SessionId: "launch-session", LoginAt: time.Now()})
+	defer activeUsers.DeleteSession(7, "launch-session")
+
+	rec := launch("canban", "pst_launch")
+	if rec.Code != http.StatusSeeOther {
+		t.Fatal("Launch did not redirect", rec.Code)
+	}
+
+	to, _ := url.Parse(rec.Header().Get("Location"))
+	code := to.Query().Get("code")
+	if to.Host != "canban.example.com" || to.Path != "/portal/launch" || to.Query().Get("tenant") != "acme" || code == "" {
+		t.Fatal("Unexpected launch redirect", to)
+	}
+
+	//Only the app redeeming the code counts, anyone can send the browser here
+	au, _ := activeUsers.Get("pst_launch")
+	if len(au.Apps) != 0 {
+		t.Fatal("Session was marked as used before the app redeemed the code", au.Apps)
+	}
+
+	canban, _ := apps.App("canban")
+	wiki, _ := apps.App("wiki")
+	if _, _, e := redeemLaunchCode(wiki, code, time.Now()); e == nil {
+		t.Fatal("Code was redeemed by another app")
+	}
+
+	claims, user, e := redeemLaunchCode(canban, code, time.Now()); if e != nil {
+		t.Fatal("Code was refused", e.Description)
+	}
+	if user.Id != 7 || user.Name != "shiba" || claims.SessionId != "launch-session" {
+		t.Fatal("Code does not name who launched", claims, user)
+	}
+
+	if used, _ := activeUsers.Get("pst_launch"); len(used.Apps) != 1 || used.Apps[0] != "canban" {
+		t.Fatal("Session was not marked as used by the app", used.Apps)
+	}
+
+	if _, _, e := redeemLaunchCode(canban, code, time.Now()); e == nil {
+		t.Fatal("Code was redeemed twice")
+	}
+
+	to, _ = url.Parse(launch("canban", "pst_launch").Header().Get("Location"))
+	if _, _, e := redeemLaunchCode(canban, to.Query().Get("code"), time.Now().Add(launchCodeLifetime)); e == nil {
+		t.Fatal("Expired code was redeemed")
+	}
+
+	//An access token is signed with the same keys but is no launch code
+	access, _ := signingKeys.Sign(newAccessClaims(au, canban, time.Now()))
+	if _, _, e := redeemLaunchCode(canban, access, time.Now()); e == nil {
+		t.Fatal("Access token was redeemed as a launch code")
+	}
+
+	to, _ = url.Parse(launch("canban", "pst_launch").Header().Get("Location"))
+	activeUsers.DeleteSession(7, "launch-session")
+	if _, _, e := redeemLaunchCode(canban, to.Query().Get("code"), time.Now()); e == nil {
+		t.Fatal("Code was redeemed after its session ended")
+	}
+}
+
+func TestLaunchRequiresSession(t *testing.T) {
+	defer withLaunchApps(t)()
+
+	rec := launch("canban", "")
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/" {
+		t.Fatal("Launch without a session did not go to the login page", rec.Code)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, c := range rec.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	if to, ok := takeReturnTo(httptest.NewRecorder(), r); !ok || to != "/launch/canban" {
+		t.Fatal("Launch is not resumed after login", to)
+	}
+
+	for _, app := range []string{"reporter", "wiki", "nobody"} {
+		if rec := launch(app, ""); rec.Code != http.StatusNotFound {
+			t.Fatal("App without a launch URI was launched", app, rec.Code)
+		}
+	}
+}
+
+func TestLaunchAllowedUsers(t *testing.T) {
+	defer withLaunchApps(t)()
+	activeUsers.Add(&ActiveUser{Id: 7, Name: "shiba", AccessToken: "pst_shiba", SessionId: "shiba-session", LoginAt: time.Now()})
+	defer activeUsers.DeleteSession(7, "shiba-session")
+	activeUsers.Add(&ActiveUser{Id: 8, Name: "akita", AccessToken: "pst_akita", SessionId: "akita-session", LoginAt: time.Now()})
+	defer activeUsers.DeleteSession(8, "akita-session")
+
+	if rec := launch("ops", "pst_shiba"); rec.Code != http.StatusForbidden {
+		t.Fatal("User outside the allow list launched the app", rec.Code)
+	}
+
+	rec := launch("ops", "pst_akita")
+	if rec.Code != http.StatusSeeOther {
+		t.Fatal("Allowed user could not launch the app", rec.Code)
+	}
+
+	ops, _ := apps.App("ops")
+	to, _ := url.Parse(rec.Header().Get("Location"))
+	if _, user, e := redeemLaunchCode(ops, to.Query().Get("code"), time.Now()); e != nil || user.Id != 8 {
+		t.Fatal("Allowed user's code was refused", e)
+	}
+
+	//A code for someone else, as if the list changed after it was issued
+	au, _ := activeUsers.Get("pst_shiba")
+	code, _ := signingKeys.SignTyped(launchTokenType, newLaunchClaims(ops, au, time.Now()))
+	if _, _, e := redeemLaunchCode(ops, code, time.Now()); e == nil {
+		t.Fatal("Code of a user outside the allow list was redeemed")
+	}
+}
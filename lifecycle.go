@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+//Duration lets config.toml spell durations the way time.ParseDuration does, e.g. "30s" or "2h"
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+type ServerConfig struct {
+	ReadTimeout Duration `toml:"read_timeout"`
+	WriteTimeout Duration `toml:"write_timeout"`
+	IdleTimeout Duration `toml:"idle_timeout"`
+	ShutdownTimeout Duration `toml:"shutdown_timeout"`
+}
+
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr: addr,
+		Handler: handler,
+		ReadTimeout: config.Server.ReadTimeout.Duration,
+		WriteTimeout: config.Server.WriteTimeout.Duration,
+		IdleTimeout: config.Server.IdleTimeout.Duration,
+	}
+}
+
+func serve(listen func() error) {
+	err := listen(); if err != nil && err != http.ErrServerClosed {
+		fatal(logger.With("component", "lifecycle"), "Server stopped unexpectedly", err)
+	}
+}
+
+//Blocks until SIGINT or SIGTERM, then drains in-flight requests before
+//stopping background jobs and releasing the database
+func waitForShutdown(servers []*http.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	l := logger.With("component", "lifecycle")
+	l.Info("Shutting down", "signal", sig.String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.Server.ShutdownTimeout.Duration)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			err := server.Shutdown(ctx); if err != nil {
+				l.Warn("Server did not shut down cleanly", "addr", server.Addr, "error", err.Error())
+			}
+		}(server)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		stopGRPC(ctx)
+	}()
+	wg.Wait()
+
+	shutdown(l)
+}
+
+func shutdown(l *slog.Logger) {
+	//Sessions go first, dropping them queues back-channel logouts
+	activeUsers.Close()
+	signingKeys.Close()
+	webhooks.Close()
+
+	closeStatements()
+
+	err := db.Close(); if err != nil {
+		l.Error("Closing database failed", "error", err.Error())
+	}
+
+	l.Info("Portal server stopped")
+}
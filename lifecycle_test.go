@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+	"github.com/BurntSushi/toml"
+)
+
+func TestDurationConfig(t *testing.T) {
+	var c Config
+	_, err := toml.Decode("[server]\nshutdown_timeout = \"45s\"\n[session]\ngc_interval = \"10m\"", &c); if err != nil {
+		t.Fatal("Decoding durations failed", err.Error())
+	}
+
+	if c.Server.ShutdownTimeout.Duration != 45 * time.Second {
+		t.Fatal("shutdown_timeout was not decoded")
+	}
+
+	if c.Session.GCInterval.Duration != 10 * time.Minute {
+		t.Fatal("gc_interval was not decoded")
+	}
+}
+
+func TestActiveUsersSweep(t *testing.T) {
+	store := &ActiveUsers{users: make(map[string]*ActiveUser)}
+	now := time.Now()
+
+	store.Add(&ActiveUser{Id: 1, AccessToken: "fresh", LoginAt: now})
+	store.Add(&ActiveUser{Id: 2, AccessToken: "stale", LoginAt: now.Add(-config.Session.Lifetime.Duration - time.Minute)})
+
+	if removed := store.sweep(now); removed != 1 {
+		t.Fatal("Expected exactly one expired session to be collected, got", removed)
+	}
+
+	if _, ok := store.Get("fresh"); !ok {
+		t.Fatal("Fresh session was collected")
+	}
+
+	if store.Ping() != nil {
+		t.Fatal("Open session store reported unavailable")
+	}
+
+	store.Close()
+
+	if _, ok := store.Get("fresh"); ok {
+		t.Fatal("Close did not drop remaining sessions")
+	}
+
+	if store.Ping() == nil {
+		t.Fatal("Closed session store reported ready")
+	}
+}
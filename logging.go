@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+type LogConfig struct {
+	Level string
+}
+
+//Keys whose values must never reach the logs, wherever they show up:
+//slog attributes, query parameters or JSON bodies echoed back in error messages
+var redactedKeys = map[string]bool{
+	"password": true,
+	"old_password": true,
+	"new_password": true,
+	"access_token": true,
+	"accesstoken": true,
+	"token": true,
+	"secret": true,
+	"client_secret": true,
+	"code": true,
+	"state": true,
+	"cookie": true,
+	"set-cookie": true,
+	"authorization": true,
+}
+
+const redacted = "REDACTED"
+
+func isRedacted(key string) bool {
+	return redactedKeys[strings.ToLower(key)]
+}
+
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	if isRedacted(a.Key) {
+		return slog.String(a.Key, redacted)
+	}
+	return a
+}
+
+func newLogger(c *LogConfig) *slog.Logger {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(c.Level)); if err != nil {
+		level = slog.LevelInfo
+	}
+
+	return slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: redactAttr,
+	}))
+}
+
+var logger *slog.Logger = newLogger(&config.Log)
+
+func fatal(l *slog.Logger, msg string, err error) {
+	l.Error(msg, "error", err.Error())
+	os.Exit(1)
+}
+
+func redactQuery(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.Path
+	}
+
+	q := u.Query()
+	for key := range q {
+		if isRedacted(key) {
+			q.Set(key, redacted)
+		}
+	}
+
+	return u.Path + "?" + q.Encode()
+}
+
+var jsonSecret = regexp.MustCompile(`"(password|old_password|new_password|access_token|accessToken|token|secret)"\s*:\s*"[^"]*"`)
+
+//Error bodies are logged as the client saw them, scrub anything that looks like a credential first
+func redactMessage(message string) string {
+	return jsonSecret.ReplaceAllString(message, `"$1":"` + redacted + `"`)
+}
+
+//Per request logging state, handlers fill in who the request was for as they learn it
+type requestLog struct {
+	requestID string
+	remoteIP string
+	userID int64
+	app string
+}
+
+type logContextKey struct{}
+
+func requestLogFrom(r *http.Request) *requestLog {
+	rl, ok := r.Context().Value(logContextKey{}).(*requestLog); if !ok {
+		return &requestLog{}
+	}
+	return rl
+}
+
+func setLogUser(r *http.Request, id int64) {
+	requestLogFrom(r).userID = id
+}
+
+func setLogApp(r *http.Request, app string) {
+	requestLogFrom(r).app = app
+}
+
+//Logger for a component carrying everything known about the request so far
+func requestLogger(r *http.Request, component string) *slog.Logger {
+	rl := requestLogFrom(r)
+	l := logger.With("component", component, "request_id", rl.requestID, "remote_ip", rl.remoteIP)
+
+	if rl.userID != 0 {
+		l = l.With("user_id", rl.userID)
+	}
+
+	if rl.app != "" {
+		l = l.With("app", rl.app)
+	}
+
+	return l
+}
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b); if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr); if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+//Reuses a well formed X-Request-ID from a proxy or caller, otherwise mints one,
+//and echoes it back so clients can quote it when reporting problems
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+
+		w.Header().Set("X-Request-ID", id)
+
+		rl := &requestLog{
+			requestID: id,
+			remoteIP: remoteIP(r),
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), logContextKey{}, rl)))
+	})
+}
+
+func accessLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w, status: 200}
+		start := time.Now()
+
+		next.ServeHTTP(recorder, r)
+
+		attrs := []any{
+			"method", r.Method,
+			"path", redactQuery(r.URL),
+			"status", recorder.status,
+			"bytes", recorder.bytes,
+			"duration_ms", time.Since(start).Milliseconds(),
+			"user_agent", r.UserAgent(),
+		}
+
+		l := requestLogger(r, "http")
+		switch {
+		case recorder.status >= 500:
+			l.Error("request failed", append(attrs, "error", redactMessage(recorder.errorBody()))...)
+		case recorder.status >= 400:
+			l.Warn("request rejected", append(attrs, "error", redactMessage(recorder.errorBody()))...)
+		default:
+			l.Info("request", attrs...)
+		}
+	})
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+)
+
+func TestLogRedaction(t *testing.T) {
+	var buf bytes.Buffer
+	l := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{ReplaceAttr: redactAttr}))
+
+	l.Info("login", "password", "hunter2", "Access_Token", "abcdef", "username", "shiba")
+
+	out := buf.String()
+	if strings.Contains(out, "hunter2") || strings.Contains(out, "abcdef") {
+		t.Fatal("Secret attribute reached the log:", out)
+	}
+
+	if !strings.Contains(out, "shiba") {
+		t.Fatal("Non secret attribute was redacted:", out)
+	}
+
+	u, _ := url.Parse("/welcome?user_id=1&access_token=abcdef")
+	if path := redactQuery(u); strings.Contains(path, "abcdef") || !strings.Contains(path, "user_id=1") {
+		t.Fatal("Query string was not redacted correctly:", path)
+	}
+
+	message := redactMessage(`bad request {"username":"shiba","old_password":"hunter2"}`)
+	if strings.Contains(message, "hunter2") {
+		t.Fatal("Secret in error body reached the log:", message)
+	}
+}
+
+func TestRequestIDMiddleware(t *testing.T) {
+	var seen string
+	handler := requestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestLogFrom(r).requestID
+	}))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Request-ID", "upstream-id.1")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if seen != "upstream-id.1" || rec.Header().Get("X-Request-ID") != "upstream-id.1" {
+		t.Fatal("Upstream request id was not propagated")
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Request-ID", "bad id\nwith newline")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if seen == "" || strings.Contains(seen, " ") || rec.Header().Get("X-Request-ID") != seen {
+		t.Fatal("Malformed request id was not replaced")
+	}
+}
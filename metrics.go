@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	loginAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "portal_login_attempts_total",
+		Help: "Login attempts by method, result and failure reason.",
+	}, []string{"method", "result", "reason"})
+
+	tokenVerifications = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "portal_token_verifications_total",
+		Help: "Token verifications requested by apps, by app and outcome.",
+	}, []string{"app", "outcome"})
+
+	adminActions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "portal_admin_actions_total",
+		Help: "Successful admin actions by type.",
+	}, []string{"action"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "portal_http_request_duration_seconds",
+		Help: "HTTP request latency by route, method and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "code"})
+
+	gcSweeps = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "portal_session_gc_sweeps_total",
+		Help: "Session garbage collector sweeps.",
+	})
+
+	gcCollected = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "portal_session_gc_collected_total",
+		Help: "Expired sessions removed by the session garbage collector.",
+	})
+
+	gcLastSweep = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "portal_session_gc_last_sweep_timestamp_seconds",
+		Help: "Unix time of the last session garbage collector sweep.",
+	})
+
+	signedTokens = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "portal_signed_tokens_issued_total",
+		Help: "Signed access tokens issued by kind.",
+	}, []string{"kind"})
+
+	keyRotations = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "portal_signing_key_rotations_total",
+		Help: "Signing keys generated by scheduled rotation.",
+	})
+
+	webhookAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "portal_webhook_attempts_total",
+		Help: "Webhook delivery attempts by result: delivered, pending for a retry, or failed for good.",
+	}, []string{"result"})
+
+	activeSessions = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "portal_active_sessions",
+		Help: "Sessions currently held in the session store.",
+	}, func() float64 {
+		return float64(activeUsers.Len())
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		loginAttempts,
+		tokenVerifications,
+		adminActions,
+		requestDuration,
+		gcSweeps,
+		gcCollected,
+		gcLastSweep,
+		signedTokens,
+		keyRotations,
+		webhookAttempts,
+		activeSessions,
+		collectors.NewDBStatsCollector(db, "portal"),
+	)
+}
+
+func loginSucceeded(method string) {
+	loginAttempts.WithLabelValues(method, "success", "").Inc()
+}
+
+func loginFailed(method string, reason string) {
+	loginAttempts.WithLabelValues(method, "failure", reason).Inc()
+}
+
+//Only registered app names become label values, anything else could blow up cardinality
+func tokenVerified(app string, outcome string) {
+	if _, ok := apps.Get(app); !ok {
+		app = "unknown"
+	}
+	tokenVerifications.WithLabelValues(app, outcome).Inc()
+}
+
+func adminActionDone(action string) {
+	adminActions.WithLabelValues(action).Inc()
+}
+
+func signedTokenIssued(kind string) {
+	signedTokens.WithLabelValues(kind).Inc()
+}
+
+func signingKeyRotated() {
+	keyRotations.Inc()
+}
+
+func webhookAttempted(result string) {
+	webhookAttempts.WithLabelValues(result).Inc()
+}
+
+func gcSwept(collected int, now time.Time) {
+	gcSweeps.Inc()
+	gcCollected.Add(float64(collected))
+	gcLastSweep.Set(float64(now.Unix()))
+}
+
+//Remembers the status and size of a response, and the start of the body for
+//error responses so the access log can say why a request was rejected
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes int
+	errBody []byte
+}
+
+const maxLoggedErrorBody = 512
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status >= 400 && len(s.errBody) < maxLoggedErrorBody {
+		n := maxLoggedErrorBody - len(s.errBody)
+		if n > len(b) {
+			n = len(b)
+		}
+		s.errBody = append(s.errBody, b[:n]...)
+	}
+
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += n
+	return n, err
+}
+
+func (s *statusRecorder) errorBody() string {
+	return strings.TrimSpace(string(s.errBody))
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+//Labels latency by the mux pattern that served the request rather than the raw path,
+//so the static file server can't create a series per requested file
+func metricsMiddleware(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "unmatched"
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w, status: 200}
+		start := time.Now()
+
+		next.ServeHTTP(recorder, r)
+
+		requestDuration.WithLabelValues(route, r.Method, strconv.Itoa(recorder.status)).Observe(time.Since(start).Seconds())
+	})
+}
+
+type MetricsConfig struct {
+	//Address of the internal listener serving /metrics, like "127.0.0.1:9100". Empty turns it off
+	Address string
+	//Scrapers must send it as a bearer token when set
+	Token string
+}
+
+func metricsHandler(token string) http.Handler {
+	metrics := promhttp.Handler()
+	if token == "" {
+		return metrics
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer " + token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		metrics.ServeHTTP(w, r)
+	})
+}
+
+//Metrics stay off the public listener, they get a server of their own
+func metricsServer(c *MetricsConfig) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler(c.Token))
+	return newServer(c.Address, mux)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"net/http"
+	"net/http/httptest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsMiddlewareRouteLabel(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/files/", http.NotFoundHandler())
+	handler := metricsMiddleware(mux, mux)
+
+	before := testutil.CollectAndCount(requestDuration)
+
+	for _, path := range []string{"/files/a", "/files/b", "/files/c"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	//All three paths share the /files/ pattern, so only one new series is expected
+	if after := testutil.CollectAndCount(requestDuration); after != before + 1 {
+		t.Fatal("Expected one latency series for the /files/ route, got", after - before)
+	}
+}
+
+func TestTokenVerifiedUnknownApp(t *testing.T) {
+	tokenVerified("not-a-registered-app", "unknown_app")
+
+	if testutil.ToFloat64(tokenVerifications.WithLabelValues("unknown", "unknown_app")) < 1 {
+		t.Fatal("Unregistered app name was not folded into the unknown label")
+	}
+}
+
+func TestMetricsHandlerToken(t *testing.T) {
+	handler := metricsHandler("scrapersecret")
+
+	for header, code := range map[string]int{"": 401, "Bearer wrong": 401, "Bearer scrapersecret": 200} {
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		if header != "" {
+			r.Header.Set("Authorization", header)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		if rec.Code != code {
+			t.Fatal("Unexpected status for", header, rec.Code)
+		}
+	}
+
+	//Only the metrics listener serves them, the public mux doesn't know the route
+	if _, pattern := http.DefaultServeMux.Handler(httptest.NewRequest("GET", "/metrics", nil)); pattern == "/metrics" {
+		t.Fatal("Metrics are registered on the public mux")
+	}
+}
@@ -2,24 +2,27 @@ package main
 
 import (
 	"net/http"
-	"fmt"
+	"mime"
 	"net/url"
+	"strings"
 )
 
 func postMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
-			http.Error(w, "This route only accepts POST request", 400)
+			w.Header().Set("Allow", "POST")
+			writeError(w, &APIError{Status: http.StatusMethodNotAllowed, Code: "method_not_allowed", Message: "This route only accepts POST request"})
 			return
 		}
 
-		if r.Header.Get("Content-Type") != "application/json" {
-			http.Error(w, "Content-Type not set to application/json", 400)
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if mediaType != "application/json" {
+			writeError(w, &APIError{Status: http.StatusUnsupportedMediaType, Code: "unsupported_media_type", Message: "Content-Type not set to application/json"})
 			return
 		}
 
-		if r.Body == nil {
-			http.Error(w, "Request body is missing", 400)
+		if r.Body == nil || r.Body == http.NoBody {
+			writeError(w, badRequest("missing_body", "Request body is missing"))
 			return
 		}
 		
@@ -27,38 +30,54 @@ func postMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-//var localhost string = fmt.Sprintf("http://localhost%s/", config.Port)
+//Normalizes an origin to scheme://host[:port], the form browsers send in the Origin header
+func normalizeOrigin(raw string) string {
+	u, err := url.Parse(raw); if err != nil || u.Scheme == "" || u.Host == "" {
+		return ""
+	}
+	return strings.ToLower(u.Scheme + "://" + u.Host)
+}
 
-//TODO: Review this origin policy, may still be insecure
-//Probably need to check localhost
-func badOrigin(origin string, referer string) bool {
-	originUrl, _ := url.Parse(origin)
-	refererUrl, _ := url.Parse(referer)
-	return originUrl.Hostname() != config.Domain && refererUrl.Hostname() != config.Domain && originUrl.Hostname() != "localhost" && refererUrl.Hostname() != "localhost"
+func allowedOrigins() []string {
+	if len(config.AllowedOrigins) > 0 {
+		return config.AllowedOrigins
+	}
+	return []string{"https://" + config.Domain}
 }
 
-func originMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		
-		origin := r.Header.Get("Origin")
-		referer := r.Header.Get("Referer")
-		
-		if badOrigin(origin, referer) {
-			refererUrl, _ := url.Parse(referer)
-			errorMessage := fmt.Sprintf("Origin: %s nor Referer: %s are authorized", origin, refererUrl.Hostname())
-			http.Error(w, errorMessage, 400)
-			return
+func allowedOrigin(origin string) bool {
+	if origin == "" {
+		return false
+	}
+
+	for _, allowed := range allowedOrigins() {
+		if normalizeOrigin(allowed) == origin {
+			return true
 		}
-		
-		next.ServeHTTP(w, r)
-	})
+	}
+	return false
 }
 
-func cookieMiddleware(next http.Handler) http.Handler {
+//Browsers send Origin on every cross-site POST; Referer is only consulted when
+//Origin is missing, and a request with neither is refused rather than trusted.
+//An opaque origin like a sandboxed iframe's is sent as "null" and never falls back to Referer
+func requestOrigin(r *http.Request) string {
+	origin := r.Header.Get("Origin")
+	if origin == "null" {
+		return ""
+	}
+	if origin != "" {
+		return normalizeOrigin(origin)
+	}
+
+	return normalizeOrigin(r.Header.Get("Referer"))
+}
+
+func originMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		
-		if (!verifyAccessToken(r.Header.Get("Cookie"))) {
-			http.Error(w, "Access token is unauthorized, yikes!", 400)
+		if !allowedOrigin(requestOrigin(r)) {
+			writeError(w, forbidden("bad_origin", "Request origin is not allowed"))
 			return
 		}
 		
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"crypto/subtle"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//OAuth endpoints answer errors the way RFC 6749 spells them instead of the usual envelope,
+//so off the shelf OAuth clients understand them
+type OAuthError struct {
+	Status int `json:"-"`
+	Code string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func writeOAuthError(w http.ResponseWriter, e *OAuthError) {
+	if e.Status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="portal"`)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, e.Status, e)
+}
+
+var errInvalidClient = &OAuthError{Status: http.StatusUnauthorized, Code: "invalid_client", Description: "Client authentication failed"}
+
+func oauthRequest(code string, description string) *OAuthError {
+	return &OAuthError{Status: http.StatusBadRequest, Code: code, Description: description}
+}
+
+//Token endpoints take form bodies, not JSON, so postMiddleware can't guard them
+func parseOAuthForm(w http.ResponseWriter, r *http.Request) *OAuthError {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		return &OAuthError{Status: http.StatusMethodNotAllowed, Code: "invalid_request", Description: "This route only accepts POST request"}
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/x-www-form-urlencoded" {
+		return oauthRequest("invalid_request", "Content-Type must be application/x-www-form-urlencoded")
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+	err := r.ParseForm(); if err != nil {
+		return oauthRequest("invalid_request", "Request body is not a valid form")
+	}
+
+	return nil
+}
+
+//Authenticates a registered app or service account with HTTP Basic, or with
+//client_id and client_secret in the body for clients that can't send Basic
+func authenticateClient(r *http.Request) (*App, *OAuthError) {
+	id, secret, basic := r.BasicAuth()
+	if basic {
+		//RFC 6749 has clients form-encode both halves before base64
+		var err error
+		id, err = url.QueryUnescape(id); if err != nil {
+			return nil, errInvalidClient
+		}
+		secret, err = url.QueryUnescape(secret); if err != nil {
+			return nil, errInvalidClient
+		}
+	} else {
+		id = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+
+	if id == "" || secret == "" {
+		loginFailed("client_credentials", "missing_credentials")
+		return nil, errInvalidClient
+	}
+
+	app, ok := apps.App(id); if !ok || subtle.ConstantTimeCompare([]byte(app.Secret), []byte(secret)) != 1 {
+		//Unknown clients and wrong secrets look the same so client ids can't be probed
+		loginFailed("client_credentials", "bad_credentials")
+		return nil, errInvalidClient
+	}
+
+	setLogApp(r, app.Name)
+	return app, nil
+}
+
+type ClientTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType string `json:"token_type"`
+	ExpiresIn int64 `json:"expires_in"`
+	Scope string `json:"scope,omitempty"`
+}
+
+const clientSubjectPrefix = "client:"
+
+func newClientClaims(app *App, scopes []string, now time.Time) *AccessClaims {
+	return &AccessClaims{
+		Issuer: tokenIssuer(),
+		//Prefixed so a client can never be mistaken for the user with the same numeric id
+		Subject: clientSubjectPrefix + app.Name,
+		ClientId: app.Name,
+		Scope: strings.Join(scopes, " "),
+		IssuedAt: now.Unix(),
+		ExpiresAt: now.Add(config.Tokens.Lifetime.Duration).Unix(),
+		Id: newSessionId(),
+	}
+}
+
+//Client credentials grant, the only grant Portal issues tokens for here.
+//Clients get at most the scopes apps.toml allows them, all of them when they ask for none
+func oauthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	oauthErr := parseOAuthForm(w, r); if oauthErr != nil {
+		writeOAuthError(w, oauthErr)
+		return
+	}
+
+	app, oauthErr := authenticateClient(r); if oauthErr != nil {
+		writeOAuthError(w, oauthErr)
+		return
+	}
+
+	if r.PostForm.Get("grant_type") != "client_credentials" {
+		writeOAuthError(w, oauthRequest("unsupported_grant_type", "Only the client_credentials grant is supported"))
+		return
+	}
+
+	scopes := strings.Fields(r.PostForm.Get("scope"))
+	if len(scopes) == 0 {
+		scopes = app.Scopes
+	}
+
+	if !app.Allows(scopes) {
+		loginFailed("client_credentials", "invalid_scope")
+		writeOAuthError(w, oauthRequest("invalid_scope", "Requested scope is not allowed for this client"))
+		return
+	}
+
+	claims := newClientClaims(app, scopes, time.Now())
+	token, err := signingKeys.Sign(claims); if err != nil {
+		requestLogger(r, "oauth").Error("Signing client token failed", "error", err.Error())
+		writeOAuthError(w, &OAuthError{Status: http.StatusInternalServerError, Code: "server_error"})
+		return
+	}
+
+	loginSucceeded("client_credentials")
+	signedTokenIssued("client_credentials")
+	requestLogger(r, "oauth").Info("Client token issued", "scope", claims.Scope)
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, &ClientTokenResponse{
+		AccessToken: token,
+		TokenType: "Bearer",
+		ExpiresIn: claims.ExpiresAt - claims.IssuedAt,
+		Scope: claims.Scope,
+	})
+}
+
+//Resolves a signed token into who it speaks for
+func signedPrincipal(token string, now time.Time) (*Principal, bool) {
+	claims, err := parseAccessToken(token, now); if err != nil {
+		return nil, false
+	}
+
+	if claims.ClientId != "" {
+		return &Principal{
+			Name: claims.ClientId,
+			TokenType: clientTokenType,
+			Token: token,
+			Scopes: strings.Fields(claims.Scope),
+		}, true
+	}
+
+	//User tokens are only good at the app they were issued to
+	if claims.Audience == "" {
+		return nil, false
+	}
+
+	id, err := strconv.ParseInt(claims.Subject, 10, 64); if err != nil {
+		return nil, false
+	}
+
+	//A signed user token dies with the session it was issued for
+	if !activeUsers.HasSession(id, claims.SessionId, now) {
+		return nil, false
+	}
+
+	return &Principal{
+		Id: id,
+		Name: claims.Name,
+		TokenType: signedTokenType,
+		Token: token,
+		Audience: claims.Audience,
+	}, true
+}
+
+//Any token Portal issued, whatever its type
+func tokenPrincipal(token string) (*Principal, bool) {
+	if isSessionToken(token) || isPersonalToken(token) {
+		return userPrincipal(token)
+	}
+	return signedPrincipal(token, time.Now())
+}
+
+//RFC 7662 introspection response. principal_type tells apps whether a human is behind the token
+type IntrospectionResponse struct {
+	Active bool `json:"active"`
+	PrincipalType string `json:"principal_type,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	Subject string `json:"sub,omitempty"`
+	Username string `json:"username,omitempty"`
+	ClientId string `json:"client_id,omitempty"`
+	Scope string `json:"scope,omitempty"`
+	Audience string `json:"aud,omitempty"`
+}
+
+func introspect(p *Principal) *IntrospectionResponse {
+	if !p.Human() {
+		return &IntrospectionResponse{
+			Active: true,
+			PrincipalType: "client",
+			TokenType: p.TokenType,
+			Subject: clientSubjectPrefix + p.Name,
+			ClientId: p.Name,
+			Scope: strings.Join(p.Scopes, " "),
+		}
+	}
+
+	return &IntrospectionResponse{
+		Active: true,
+		PrincipalType: "user",
+		TokenType: p.TokenType,
+		Subject: strconv.FormatInt(p.Id, 10),
+		Username: p.Name,
+		Scope: strings.Join(p.Scopes, " "),
+		Audience: p.Audience,
+	}
+}
+
+//Lets authenticated apps and service accounts ask what any Portal token stands for.
+//Unknown, expired and malformed tokens are all just inactive
+func oauthIntrospectHandler(w http.ResponseWriter, r *http.Request) {
+	oauthErr := parseOAuthForm(w, r); if oauthErr != nil {
+		writeOAuthError(w, oauthErr)
+		return
+	}
+
+	app, oauthErr := authenticateClient(r); if oauthErr != nil {
+		writeOAuthError(w, oauthErr)
+		return
+	}
+
+	token := r.PostForm.Get("token")
+	if token == "" {
+		writeOAuthError(w, oauthRequest("invalid_request", "token is required"))
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	//A personal token restricted to other apps or a signed token issued to another is none of this app's business
+	p, ok := tokenPrincipal(token); if !ok || !p.AllowsApp(app.Name) {
+		tokenVerified(app.Name, "inactive")
+		writeJSON(w, http.StatusOK, &IntrospectionResponse{Active: false})
+		return
+	}
+
+	if p.TokenType == sessionTokenType {
+		activeUsers.UsedBy(token, app.Name)
+	}
+
+	resp := introspect(p)
+	tokenVerified(app.Name, "active_" + resp.PrincipalType)
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+//Registers the apps in registry, written like apps.toml, with fresh signing keys.
+//The returned func puts the previous apps and keys back
+func withApps(t *testing.T, registry string) func() {
+	savedApps, savedKeys := apps, signingKeys
+	parsed, err := parseApps(registry); if err != nil {
+		t.Fatal(err)
+	}
+
+	apps = parsed
+	signingKeys = &KeyManager{}
+	signingKeys.Rotate(time.Now())
+
+	return func() {
+		apps, signingKeys = savedApps, savedKeys
+	}
+}
+
+func withOAuthClients(t *testing.T) func() {
+	return withApps(t, `
+canban = "appsecret"
+
+[reporter]
+secret = "servicesecret"
+service = true
+scopes = ["users:read", "sessions:read"]
+`)
+}
+
+func oauthPost(handler http.HandlerFunc, form url.Values, id string, secret string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/oauth/token", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if id != "" {
+		r.SetBasicAuth(id, secret)
+	}
+	rec := httptest.NewRecorder()
+	handler(rec, r)
+	return rec
+}
+
+func TestServiceAccountsAreHidden(t *testing.T) {
+	defer withOAuthClients(t)()
+
+	if len(apps.List) != 1 || apps.List[0] != "canban" {
+		t.Fatal("Service account is listed as an app", apps.List)
+	}
+
+	if _, ok := apps.App("reporter"); !ok {
+		t.Fatal("Service account is not registered")
+	}
+}
+
+func TestClientCredentialsGrant(t *testing.T) {
+	defer withOAuthClients(t)()
+
+	grant := url.Values{"grant_type": {"client_credentials"}}
+
+	rec := oauthPost(oauthTokenHandler, grant, "reporter", "wrong")
+	if rec.Code != 401 || rec.Header().Get("WWW-Authenticate") == "" {
+		t.Fatal("Wrong secret was not refused", rec.Code)
+	}
+
+	rec = oauthPost(oauthTokenHandler, url.Values{"grant_type": {"password"}}, "reporter", "servicesecret")
+	if rec.Code != 400 || !strings.Contains(rec.Body.String(), "unsupported_grant_type") {
+		t.Fatal("Unsupported grant was not refused", rec.Body.String())
+	}
+
+	rec = oauthPost(oauthTokenHandler, url.Values{"grant_type": {"client_credentials"}, "scope": {"users:write"}}, "reporter", "servicesecret")
+	if rec.Code != 400 || !strings.Contains(rec.Body.String(), "invalid_scope") {
+		t.Fatal("Scope beyond the client's was granted", rec.Body.String())
+	}
+
+	//client_secret_post
+	rec = oauthPost(oauthTokenHandler, url.Values{"grant_type": {"client_credentials"}, "scope": {"users:read"}, "client_id": {"reporter"}, "client_secret": {"servicesecret"}}, "", "")
+	if rec.Code != 200 || rec.Header().Get("Cache-Control") != "no-store" {
+		t.Fatal("Client credentials grant failed", rec.Code, rec.Body.String())
+	}
+
+	var token ClientTokenResponse
+	json.NewDecoder(rec.Body).Decode(&token)
+	if token.TokenType != "Bearer" || token.Scope != "users:read" || token.ExpiresIn != int64(config.Tokens.Lifetime.Seconds()) {
+		t.Fatal("Unexpected token response", token)
+	}
+
+	p, ok := tokenPrincipal(token.AccessToken); if !ok {
+		t.Fatal("Client token does not resolve to a principal")
+	}
+	if p.Human() || p.Name != "reporter" || len(p.Scopes) != 1 || p.Id != 0 {
+		t.Fatal("Client token resolved to the wrong principal", p)
+	}
+
+	rec = oauthPost(oauthTokenHandler, grant, "canban", "appsecret")
+	var unscoped ClientTokenResponse
+	json.NewDecoder(rec.Body).Decode(&unscoped)
+	if rec.Code != 200 || unscoped.Scope != "" {
+		t.Fatal("App without scopes should get an unscoped token", rec.Code, unscoped)
+	}
+}
+
+func TestIntrospection(t *testing.T) {
+	defer withOAuthClients(t)()
+
+	rec := oauthPost(oauthTokenHandler, url.Values{"grant_type": {"client_credentials"}}, "reporter", "servicesecret")
+	var token ClientTokenResponse
+	json.NewDecoder(rec.Body).Decode(&token)
+
+	au := &ActiveUser{Id: 49, Name: "dingo", AccessToken: newSessionToken(), SessionId: newSessionId(), LoginAt: time.Now()}
+	activeUsers.Add(au)
+	defer activeUsers.Delete(au.AccessToken)
+	canban, _ := apps.App("canban")
+	reporter, _ := apps.App("reporter")
+	signed, _ := signingKeys.Sign(newAccessClaims(au, canban, time.Now()))
+	other, _ := signingKeys.Sign(newAccessClaims(au, reporter, time.Now()))
+
+	introspectToken := func(value string) *IntrospectionResponse {
+		rec := oauthPost(oauthIntrospectHandler, url.Values{"token": {value}}, "canban", "appsecret")
+		if rec.Code != 200 {
+			t.Fatal("Introspection failed", rec.Code, rec.Body.String())
+		}
+		var resp IntrospectionResponse
+		json.NewDecoder(rec.Body).Decode(&resp)
+		return &resp
+	}
+
+	if resp := introspectToken(token.AccessToken); !resp.Active || resp.PrincipalType != "client" || resp.ClientId != "reporter" || resp.Scope != "users:read sessions:read" {
+		t.Fatal("Client token introspected wrong", resp)
+	}
+
+	if resp := introspectToken(au.AccessToken); !resp.Active || resp.PrincipalType != "user" || resp.Subject != "49" || resp.TokenType != sessionTokenType {
+		t.Fatal("Session token introspected wrong", resp)
+	}
+
+	if resp := introspectToken(signed); !resp.Active || resp.PrincipalType != "user" || resp.Username != "dingo" || resp.TokenType != signedTokenType || resp.Audience != "canban" {
+		t.Fatal("Signed user token introspected wrong", resp)
+	}
+
+	if resp := introspectToken(other); resp.Active {
+		t.Fatal("Signed token issued to another app is active", resp)
+	}
+
+	if _, apiErr := verifyAppToken("canban", signed, nil); apiErr != nil {
+		t.Fatal("Signed token was refused by the app it was issued to", apiErr)
+	}
+	if _, apiErr := verifyAppToken("canban", other, nil); apiErr == nil {
+		t.Fatal("Signed token issued to another app was verified")
+	}
+	if _, apiErr := verifyAppToken("canban", token.AccessToken, nil); apiErr == nil {
+		t.Fatal("Client token was verified as a user")
+	}
+
+	if resp := introspectToken("pst_nope"); resp.Active || resp.PrincipalType != "" {
+		t.Fatal("Unknown token is active", resp)
+	}
+
+	activeUsers.Delete(au.AccessToken)
+	if resp := introspectToken(signed); resp.Active {
+		t.Fatal("Signed user token is active after its session ended", resp)
+	}
+
+	rec = oauthPost(oauthIntrospectHandler, url.Values{"token": {token.AccessToken}}, "", "")
+	if rec.Code != 401 {
+		t.Fatal("Anonymous introspection was allowed", rec.Code)
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/lib/pq"
+	"golang.org/x/oauth2"
+)
+
+//An upstream OpenID Connect provider users may log in with, configured under [oidc.<id>]
+type OIDCProviderConfig struct {
+	//Shown on the login page, defaults to the id
+	Name string
+	Issuer string
+	ClientID string `toml:"client_id"`
+	ClientSecret string `toml:"client_secret"`
+	//openid is always requested
+	Scopes []string
+	//Claim a provisioned user's name is taken from, defaults to preferred_username
+	UsernameClaim string `toml:"username_claim"`
+	//Create a local user the first time someone logs in, otherwise they must link an existing one
+	Provision bool
+}
+
+type upstreamProvider struct {
+	id string
+	config OIDCProviderConfig
+
+	mu sync.Mutex
+	oauth *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+const upstreamTimeout = 10 * time.Second
+
+func oidcRedirectURL() string {
+	return tokenIssuer() + "/login/oidc/callback"
+}
+
+//Discovery happens on first use and is retried until it succeeds,
+//so a partner IdP being down never keeps Portal from starting
+func (p *upstreamProvider) discover(ctx context.Context) (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.oauth != nil {
+		return p.oauth, p.verifier, nil
+	}
+
+	provider, err := oidc.NewProvider(ctx, p.config.Issuer); if err != nil {
+		return nil, nil, err
+	}
+
+	scopes := []string{oidc.ScopeOpenID}
+	for _, scope := range p.config.Scopes {
+		if scope != oidc.ScopeOpenID {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	p.oauth = &oauth2.Config{
+		ClientID: p.config.ClientID,
+		ClientSecret: p.config.ClientSecret,
+		Endpoint: provider.Endpoint(),
+		RedirectURL: oidcRedirectURL(),
+		Scopes: scopes,
+	}
+	p.verifier = provider.Verifier(&oidc.Config{ClientID: p.config.ClientID})
+	return p.oauth, p.verifier, nil
+}
+
+type oidcPending struct {
+	provider string
+	nonce string
+	verifier string
+	expires time.Time
+}
+
+type Federation struct {
+	providers map[string]*upstreamProvider
+	names []string
+
+	mu sync.Mutex
+	//Logins waiting for the upstream IdP to redirect back, keyed by state
+	pending map[string]*oidcPending
+}
+
+//Nil without [oidc.<id>] providers, /login/providers then lists none
+var federation *Federation
+
+func newFederation(configs map[string]OIDCProviderConfig) (*Federation, error) {
+	f := &Federation{
+		providers: make(map[string]*upstreamProvider),
+		pending: make(map[string]*oidcPending),
+	}
+
+	for id, c := range configs {
+		if c.Issuer == "" || c.ClientID == "" {
+			return nil, fmt.Errorf("oidc.%s needs issuer and client_id", id)
+		}
+		if c.Name == "" {
+			c.Name = id
+		}
+		if c.UsernameClaim == "" {
+			c.UsernameClaim = "preferred_username"
+		}
+
+		f.providers[id] = &upstreamProvider{id: id, config: c}
+		f.names = append(f.names, id)
+	}
+	sort.Strings(f.names)
+
+	return f, nil
+}
+
+//Remembers a login until the IdP redirects back, false when too many are waiting already
+func (f *Federation) start(provider string, now time.Time) (string, *oidcPending, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for state, old := range f.pending {
+		if now.After(old.expires) {
+			delete(f.pending, state)
+		}
+	}
+	if len(f.pending) >= maxPendingLogins {
+		return "", nil, false
+	}
+
+	state := newToken("")
+	p := &oidcPending{
+		provider: provider,
+		nonce: newToken(""),
+		verifier: oauth2.GenerateVerifier(),
+		expires: now.Add(returnToLifetime),
+	}
+	f.pending[state] = p
+	return state, p, true
+}
+
+func (f *Federation) finish(state string, now time.Time) (*oidcPending, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, ok := f.pending[state]; if !ok || now.After(p.expires) {
+		return nil, false
+	}
+	delete(f.pending, state)
+	return p, true
+}
+
+const oidcStateCookieName = "portal_oidc_state"
+
+var errUpstreamUnavailable = &APIError{Status: http.StatusBadGateway, Code: "upstream_unavailable", Message: "The identity provider can't be reached"}
+
+//Sends the browser to the upstream IdP with PKCE, a nonce for the ID token and a state
+//bound to this browser by cookie so nobody can complete a login they didn't start
+func (f *Federation) loginHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireGet(w, r) {
+		return
+	}
+
+	provider, ok := f.providers[r.URL.Query().Get("provider")]; if !ok {
+		writeError(w, notFound("provider_not_found", "No identity provider is configured with that name"))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), upstreamTimeout)
+	defer cancel()
+
+	oauth, _, err := provider.discover(ctx); if err != nil {
+		requestLogger(r, "oidc").Error("Identity provider discovery failed", "provider", provider.id, "error", err.Error())
+		writeError(w, errUpstreamUnavailable)
+		return
+	}
+
+	state, pending, ok := f.start(provider.id, time.Now()); if !ok {
+		writeError(w, errTooManyPendingLogins)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name: oidcStateCookieName,
+		Value: state,
+		Path: "/login/oidc",
+		MaxAge: int(returnToLifetime.Seconds()),
+		HttpOnly: true,
+		Secure: r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, oauth.AuthCodeURL(state, oidc.Nonce(pending.nonce), oauth2.S256ChallengeOption(pending.verifier)), http.StatusSeeOther)
+}
+
+//Who the upstream IdP says logged in
+type ExternalIdentity struct {
+	Provider string
+	Subject string
+	Username string
+}
+
+//Checks the callback belongs to a login this browser started, redeems the code with
+//the PKCE verifier and verifies the ID token's signature, audience, expiry and nonce
+func (f *Federation) authenticate(r *http.Request) (*ExternalIdentity, *APIError) {
+	q := r.URL.Query()
+	if q.Get("error") != "" {
+		return nil, unauthorized("upstream_denied", "The identity provider did not log you in")
+	}
+
+	state := q.Get("state")
+	c, err := r.Cookie(oidcStateCookieName)
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(c.Value), []byte(state)) != 1 {
+		return nil, badRequest("invalid_state", "Login was not started from this browser, start again")
+	}
+
+	pending, ok := f.finish(state, time.Now()); if !ok {
+		return nil, badRequest("invalid_state", "Login expired, start again")
+	}
+	provider := f.providers[pending.provider]
+
+	ctx, cancel := context.WithTimeout(r.Context(), upstreamTimeout)
+	defer cancel()
+
+	oauth, verifier, err := provider.discover(ctx); if err != nil {
+		return nil, errUpstreamUnavailable
+	}
+
+	token, err := oauth.Exchange(ctx, q.Get("code"), oauth2.VerifierOption(pending.verifier)); if err != nil {
+		requestLogger(r, "oidc").Warn("Code exchange failed", "provider", provider.id, "error", err.Error())
+		return nil, unauthorized("upstream_denied", "The identity provider did not log you in")
+	}
+
+	raw, ok := token.Extra("id_token").(string); if !ok {
+		return nil, unauthorized("upstream_denied", "The identity provider sent no ID token")
+	}
+
+	idToken, err := verifier.Verify(ctx, raw); if err != nil || subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(pending.nonce)) != 1 {
+		if err != nil {
+			requestLogger(r, "oidc").Warn("ID token verification failed", "provider", provider.id, "error", err.Error())
+		}
+		return nil, unauthorized("invalid_id_token", "The identity provider sent an invalid ID token")
+	}
+
+	var claims map[string]interface{}
+	err = idToken.Claims(&claims); if err != nil {
+		return nil, unauthorized("invalid_id_token", "The identity provider sent an invalid ID token")
+	}
+
+	username, _ := claims[provider.config.UsernameClaim].(string)
+	return &ExternalIdentity{Provider: provider.id, Subject: idToken.Subject, Username: username}, nil
+}
+
+type LoginProvider struct {
+	Id string `json:"id"`
+	Name string `json:"name"`
+	URL string `json:"url"`
+}
+
+type LoginProvidersResponse struct {
+	Providers []LoginProvider `json:"providers"`
+	//Whether /login/certificate is served, the login page only offers it then
+	Certificate bool `json:"certificate"`
+}
+
+//What the login page offers besides passwords
+func loginProvidersHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireGet(w, r) {
+		return
+	}
+
+	providers := make([]LoginProvider, 0)
+	if federation != nil {
+		for _, id := range federation.names {
+			providers = append(providers, LoginProvider{
+				Id: id,
+				Name: federation.providers[id].config.Name,
+				URL: "/login/oidc?provider=" + id,
+			})
+		}
+	}
+
+	writeJSON(w, http.StatusOK, &LoginProvidersResponse{Providers: providers, Certificate: certificateLoginEnabled()})
+}
+
+var errDeactivated = forbidden("account_deactivated", "This account has been deactivated")
+
+var errNotLinked = forbidden("identity_not_linked", "This account is not linked to a Portal user, log in with your password and link it first")
+
+//Finishes an upstream login with a normal Portal session. Known identities log in as their
+//user, a browser that already has a session links the identity to its user, and otherwise
+//a user is provisioned when the provider allows it
+func federatedCallbackHandler() http.HandlerFunc {
+	lookup := prepareQuery("sql/get_external_identity.sql")
+	link := prepareQuery("sql/link_external_identity.sql")
+	provision := prepareQuery("sql/new_external_user.sql")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !requireGet(w, r) {
+			return
+		}
+
+		identity, apiErr := federation.authenticate(r); if apiErr != nil {
+			loginFailed("oidc", apiErr.Code)
+			writeError(w, apiErr)
+			return
+		}
+		l := requestLogger(r, "oidc").With("provider", identity.Provider)
+
+		var u User
+		active := true
+		err := lookup.QueryRow(identity.Provider, identity.Subject).Scan(&u.Id, &u.Name, &active)
+		if err == nil && !active {
+			loginFailed("oidc", "deactivated")
+			writeError(w, errDeactivated)
+			return
+		} else if err == sql.ErrNoRows {
+			if p, ok := sessionPrincipal(sessionToken(r)); ok {
+				u = User{Id: p.Id, Name: p.Name}
+				_, err = link.Exec(identity.Provider, identity.Subject, u.Id); if err == nil {
+					l.Info("External identity linked", "user_id", u.Id)
+				}
+			} else if federation.providers[identity.Provider].config.Provision {
+				if apiErr := validateUsername(federation.providers[identity.Provider].config.UsernameClaim, identity.Username); apiErr != nil {
+					loginFailed("oidc", "invalid_username")
+					writeError(w, apiErr)
+					return
+				}
+
+				u.Name = identity.Username
+				err = provision.QueryRow(identity.Provider, identity.Subject, identity.Username).Scan(&u.Id)
+				if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+					loginFailed("oidc", "username_taken")
+					writeError(w, errUsernameTaken)
+					return
+				}
+				if err == nil {
+					webhooks.Emit(eventUserCreated, &UserEventData{UserId: u.Id, Username: u.Name})
+					l.Info("User provisioned from external identity", "user_id", u.Id)
+				}
+			} else {
+				loginFailed("oidc", "not_linked")
+				writeError(w, errNotLinked)
+				return
+			}
+		}
+
+		if err != nil {
+			internalError(w, r, err)
+			return
+		}
+
+		au := activateUser(&u, r, "oidc:" + identity.Provider)
+		loginSucceeded("oidc")
+		setLogUser(r, u.Id)
+		l.Info("Logged in with external identity", "session_id", au.SessionId)
+
+		http.SetCookie(w, &http.Cookie{Name: oidcStateCookieName, Value: "", Path: "/login/oidc", MaxAge: -1, HttpOnly: true, Secure: r.TLS != nil, SameSite: http.SameSiteLaxMode})
+		//The token only travels in the cookie, never in a URL that ends up in history and logs
+		setSessionCookie(w, r, au.AccessToken)
+		http.Redirect(w, r, "/welcome", http.StatusSeeOther)
+	})
+}
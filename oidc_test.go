@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//An in-process OpenID provider, just enough of one to log users in with the code flow and PKCE
+type fakeIdP struct {
+	server *httptest.Server
+	key *rsa.PrivateKey
+
+	mu sync.Mutex
+	//Who logs in at the authorize endpoint
+	subject string
+	username string
+	//Hands out ID tokens with the wrong nonce
+	badNonce bool
+	codes map[string]url.Values
+}
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048); if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	idp := &fakeIdP{key: key, subject: "u-1", username: "otter", codes: make(map[string]url.Values)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", idp.discovery)
+	mux.HandleFunc("/authorize", idp.authorize)
+	mux.HandleFunc("/token", idp.token)
+	mux.HandleFunc("/jwks", idp.jwks)
+	idp.server = httptest.NewServer(mux)
+	return idp
+}
+
+func (idp *fakeIdP) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, 200, map[string]interface{}{
+		"issuer": idp.server.URL,
+		"authorization_endpoint": idp.server.URL + "/authorize",
+		"token_endpoint": idp.server.URL + "/token",
+		"jwks_uri": idp.server.URL + "/jwks",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (idp *fakeIdP) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != "portal" || q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		http.Error(w, "bad authorization request", 400)
+		return
+	}
+
+	idp.mu.Lock()
+	code := newToken("code_")
+	q.Set("sub", idp.subject)
+	q.Set("preferred_username", idp.username)
+	idp.codes[code] = q
+	idp.mu.Unlock()
+
+	http.Redirect(w, r, q.Get("redirect_uri") + "?" + url.Values{"code": {code}, "state": {q.Get("state")}}.Encode(), http.StatusFound)
+}
+
+func (idp *fakeIdP) token(w http.ResponseWriter, r *http.Request) {
+	id, secret, _ := r.BasicAuth()
+	if id != "portal" || secret != "partnersecret" || r.PostFormValue("grant_type") != "authorization_code" {
+		writeJSON(w, 401, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	idp.mu.Lock()
+	q, ok := idp.codes[r.PostFormValue("code")]
+	delete(idp.codes, r.PostFormValue("code"))
+	idp.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !ok || b64.EncodeToString(sum[:]) != q.Get("code_challenge") {
+		writeJSON(w, 400, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	nonce := q.Get("nonce")
+	if idp.badNonce {
+		nonce = "replayed"
+	}
+
+	now := time.Now()
+	writeJSON(w, 200, map[string]interface{}{
+		"access_token": "upstream",
+		"token_type": "Bearer",
+		"expires_in": 300,
+		"id_token": idp.sign(map[string]interface{}{
+			"iss": idp.server.URL,
+			"aud": "portal",
+			"sub": q.Get("sub"),
+			"preferred_username": q.Get("preferred_username"),
+			"nonce": nonce,
+			"iat": now.Unix(),
+			"exp": now.Add(5 * time.Minute).Unix(),
+		}),
+	})
+}
+
+func (idp *fakeIdP) sign(claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": "fake"})
+	payload, _ := json.Marshal(claims)
+	input := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(input))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, sum[:])
+	return input + "." + b64.EncodeToString(signature)
+}
+
+func (idp *fakeIdP) jwks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, 200, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "fake",
+			"alg": "RS256",
+			"use": "sig",
+			"n": b64.EncodeToString(idp.key.N.Bytes()),
+			"e": b64.EncodeToString(big.NewInt(int64(idp.key.E)).Bytes()),
+		}},
+	})
+}
+
+func withFederation(t *testing.T, idp *fakeIdP) func() {
+	saved := federation
+	f, err := newFederation(map[string]OIDCProviderConfig{
+		"partner": {Name: "Partner", Issuer: idp.server.URL, ClientID: "portal", ClientSecret: "partnersecret", Scopes: []string{"profile"}, Provision: true},
+	}); if err != nil {
+		t.Fatal(err.Error())
+	}
+	federation = f
+
+	return func() {
+		federation = saved
+		idp.server.Close()
+	}
+}
+
+//Walks a browser through Portal's login redirect and the IdP's authorize
+//endpoint, returning the callback request the IdP sent it back with
+func oidcCallback(t *testing.T, idp *fakeIdP) *http.Request {
+	rec := httptest.NewRecorder()
+	federation.loginHandler(rec, httptest.NewRequest("GET", "/login/oidc?provider=partner", nil))
+	if rec.Code != 303 {
+		t.Fatal("Login was not redirected to the identity provider", rec.Code, rec.Body.String())
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(rec.Header().Get("Location")); if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp.Body.Close()
+
+	callback, err := url.Parse(resp.Header.Get("Location")); if err != nil || callback.Path != "/login/oidc/callback" {
+		t.Fatal("Identity provider did not redirect back", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	r := httptest.NewRequest("GET", callback.RequestURI(), nil)
+	for _, c := range rec.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+func TestFederatedLoginRedirect(t *testing.T) {
+	idp := newFakeIdP(t)
+	defer withFederation(t, idp)()
+
+	rec := httptest.NewRecorder()
+	federation.loginHandler(rec, httptest.NewRequest("GET", "/login/oidc?provider=partner", nil))
+	to, _ := url.Parse(rec.Header().Get("Location"))
+	q := to.Query()
+	if !strings.HasPrefix(to.String(), idp.server.URL + "/authorize") || q.Get("code_challenge_method") != "S256" || q.Get("nonce") == "" || q.Get("scope") != "openid profile" || q.Get("redirect_uri") != oidcRedirectURL() {
+		t.Fatal("Unexpected authorization request", to)
+	}
+
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != oidcStateCookieName || cookies[0].Value != q.Get("state") || !cookies[0].HttpOnly {
+		t.Fatal("State was not bound to the browser", cookies)
+	}
+
+	rec = httptest.NewRecorder()
+	federation.loginHandler(rec, httptest.NewRequest("GET", "/login/oidc?provider=nobody", nil))
+	if rec.Code != 404 {
+		t.Fatal("Unknown provider was accepted", rec.Code)
+	}
+
+	now := time.Now()
+	for len(federation.pending) < maxPendingLogins {
+		federation.start("partner", now)
+	}
+	rec = httptest.NewRecorder()
+	federation.loginHandler(rec, httptest.NewRequest("GET", "/login/oidc?provider=partner", nil))
+	if rec.Code != 503 || len(federation.pending) != maxPendingLogins {
+		t.Fatal("Pending logins are not capped", rec.Code, len(federation.pending))
+	}
+	if _, _, ok := federation.start("partner", now.Add(returnToLifetime + time.Second)); !ok {
+		t.Fatal("Expired logins still count against the cap")
+	}
+
+	rec = httptest.NewRecorder()
+	loginProvidersHandler(rec, httptest.NewRequest("GET", "/login/providers", nil))
+	var providers LoginProvidersResponse
+	json.NewDecoder(rec.Body).Decode(&providers)
+	if len(providers.Providers) != 1 || providers.Providers[0].Name != "Partner" || providers.Providers[0].URL != "/login/oidc?provider=partner" || providers.Certificate {
+		t.Fatal("Unexpected login providers", providers)
+	}
+}
+
+func TestFederatedLoginCallback(t *testing.T) {
+	idp := newFakeIdP(t)
+	defer withFederation(t, idp)()
+
+	r := oidcCallback(t, idp)
+	identity, apiErr := federation.authenticate(r); if apiErr != nil {
+		t.Fatal("Upstream login failed", apiErr.Code, apiErr.Message)
+	}
+	if identity.Provider != "partner" || identity.Subject != "u-1" || identity.Username != "otter" {
+		t.Fatal("Unexpected identity", identity)
+	}
+
+	if _, apiErr := federation.authenticate(r); apiErr == nil || apiErr.Code != "invalid_state" {
+		t.Fatal("Callback was replayed")
+	}
+
+	//A callback carried to another browser has no state cookie
+	r = oidcCallback(t, idp)
+	stolen := httptest.NewRequest("GET", r.URL.RequestURI(), nil)
+	if _, apiErr := federation.authenticate(stolen); apiErr == nil || apiErr.Code != "invalid_state" {
+		t.Fatal("Callback without the state cookie was accepted")
+	}
+
+	//The code is bound to the PKCE verifier of the login that asked for it
+	r = oidcCallback(t, idp)
+	state, _ := r.Cookie(oidcStateCookieName)
+	federation.pending[state.Value].verifier = "someone else's verifier, long enough to pass as a PKCE verifier"
+	if _, apiErr := federation.authenticate(r); apiErr == nil || apiErr.Code != "upstream_denied" {
+		t.Fatal("Code was redeemed with the wrong verifier")
+	}
+
+	idp.badNonce = true
+	if _, apiErr := federation.authenticate(oidcCallback(t, idp)); apiErr == nil || apiErr.Code != "invalid_id_token" {
+		t.Fatal("ID token with the wrong nonce was accepted")
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+	"github.com/lib/pq"
+)
+
+//Personal access tokens are for scripts and CLIs, they live in the database so
+//they survive restarts and only their hash is ever stored
+type PersonalTokenStore struct {
+	create *sql.Stmt
+	list *sql.Stmt
+	get *sql.Stmt
+	touch *sql.Stmt
+	delete *sql.Stmt
+}
+
+//Lookup finds no token while it is nil, so auth tests can run without a database
+var personalTokens *PersonalTokenStore
+
+func newPersonalTokenStore() *PersonalTokenStore {
+	return &PersonalTokenStore{
+		create: prepareQuery("sql/new_personal_token.sql"),
+		list: prepareQuery("sql/list_personal_tokens.sql"),
+		get: prepareQuery("sql/get_personal_token.sql"),
+		touch: prepareQuery("sql/touch_personal_token.sql"),
+		delete: prepareQuery("sql/delete_personal_token.sql"),
+	}
+}
+
+//last_used_at is only written when it is older than this, so a busy token doesn't write on every request
+const personalTokenTouchInterval = time.Minute
+
+func (s *PersonalTokenStore) Lookup(token string) (*Principal, bool) {
+	if s == nil {
+		return nil, false
+	}
+
+	var tokenId int64
+	var scopes, tokenApps []string
+	var recentlyUsed bool
+	p := &Principal{TokenType: personalTokenType, Token: token}
+	interval := personalTokenTouchInterval.Seconds()
+	err := s.get.QueryRow(hashToken(token), interval).Scan(&tokenId, &p.Id, &p.Name, pq.Array(&scopes), pq.Array(&tokenApps), &recentlyUsed); if err != nil {
+		if err != sql.ErrNoRows {
+			logger.Error("Looking up personal token failed", "component", "tokens", "error", err.Error())
+		}
+		return nil, false
+	}
+	p.Scopes = scopes
+	p.Apps = tokenApps
+
+	if recentlyUsed {
+		return p, true
+	}
+	_, err = s.touch.Exec(tokenId, interval); if err != nil {
+		logger.Warn("Recording personal token use failed", "component", "tokens", "error", err.Error())
+	}
+
+	return p, true
+}
+
+const (
+	maxPersonalTokenNameLength = 64
+	maxPersonalTokenScopes = 20
+	defaultPersonalTokenDays = 30
+	maxPersonalTokenDays = 365
+)
+
+var validScope = regexp.MustCompile(`^[a-z0-9][a-z0-9_.:-]{0,63}$`)
+
+type CreatePersonalTokenRequest struct {
+	Name string `json:"name"`
+	ExpiresInDays int `json:"expires_in_days"`
+	Scopes []string `json:"scopes"`
+	//Empty means the token works with every app
+	Apps []string `json:"apps"`
+}
+
+func (req *CreatePersonalTokenRequest) Validate() *APIError {
+	if apiErr := validateUsername("name", req.Name); apiErr != nil {
+		return apiErr
+	}
+
+	if len(req.Name) > maxPersonalTokenNameLength {
+		return badRequest("invalid_field", "name is too long")
+	}
+
+	if req.ExpiresInDays == 0 {
+		req.ExpiresInDays = defaultPersonalTokenDays
+	}
+
+	if req.ExpiresInDays < 0 || req.ExpiresInDays > maxPersonalTokenDays {
+		return badRequest("invalid_field", "expires_in_days must be between 1 and " + strconv.Itoa(maxPersonalTokenDays))
+	}
+
+	if len(req.Scopes) > maxPersonalTokenScopes {
+		return badRequest("invalid_field", "Too many scopes")
+	}
+
+	for _, scope := range req.Scopes {
+		if !validScope.MatchString(scope) {
+			return badRequest("invalid_field", "Invalid scope " + strconv.Quote(scope))
+		}
+	}
+
+	for _, app := range req.Apps {
+		if _, ok := apps.App(app); !ok {
+			return badRequest("invalid_field", "Unknown app " + strconv.Quote(app))
+		}
+	}
+
+	if req.Scopes == nil {
+		req.Scopes = []string{}
+	}
+	if req.Apps == nil {
+		req.Apps = []string{}
+	}
+
+	return nil
+}
+
+type PersonalTokenInfo struct {
+	Id int64 `json:"id"`
+	Name string `json:"name"`
+	Scopes []string `json:"scopes"`
+	Apps []string `json:"apps"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+}
+
+//The token itself is only ever shown in this response
+type NewPersonalTokenResponse struct {
+	Token string `json:"token"`
+	PersonalTokenInfo
+}
+
+type PersonalTokensResponse struct {
+	Tokens []PersonalTokenInfo `json:"tokens"`
+}
+
+type RevokePersonalTokenRequest struct {
+	Id int64 `json:"id"`
+}
+
+func (req *RevokePersonalTokenRequest) Validate() *APIError {
+	if req.Id <= 0 {
+		return badRequest("missing_field", "id is required")
+	}
+	return nil
+}
+
+var errPersonalTokenNotFound = notFound("token_not_found", "Personal token does not exist")
+
+func createPersonalTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var req CreatePersonalTokenRequest
+	if apiErr := decodeJSON(w, r, &req); apiErr != nil {
+		writeError(w, apiErr)
+		return
+	}
+
+	p, ok := principalFrom(r); if !ok {
+		writeError(w, errInvalidSession)
+		return
+	}
+
+	token := newPersonalToken()
+	resp := &NewPersonalTokenResponse{
+		Token: token,
+		PersonalTokenInfo: PersonalTokenInfo{Name: req.Name, Scopes: req.Scopes, Apps: req.Apps},
+	}
+
+	err := personalTokens.create.QueryRow(p.Id, req.Name, hashToken(token), pq.Array(req.Scopes), pq.Array(req.Apps), req.ExpiresInDays).Scan(&resp.Id, &resp.CreatedAt, &resp.ExpiresAt); if err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+			writeError(w, conflict("token_name_taken", "You already have a personal token with that name"))
+			return
+		}
+		internalError(w, r, err)
+		return
+	}
+	requestLogger(r, "tokens").Info("Personal token created", "token_id", resp.Id, "expires_at", resp.ExpiresAt)
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func listPersonalTokensHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireGet(w, r) {
+		return
+	}
+
+	p, ok := principalFrom(r); if !ok {
+		writeError(w, errInvalidSession)
+		return
+	}
+
+	rows, err := personalTokens.list.Query(p.Id); if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	tokens := make([]PersonalTokenInfo, 0)
+	for rows.Next() {
+		var info PersonalTokenInfo
+		var lastUsed sql.NullTime
+		err = rows.Scan(&info.Id, &info.Name, pq.Array(&info.Scopes), pq.Array(&info.Apps), &info.CreatedAt, &info.ExpiresAt, &lastUsed); if err != nil {
+			internalError(w, r, err)
+			return
+		}
+		if lastUsed.Valid {
+			info.LastUsedAt = &lastUsed.Time
+		}
+		tokens = append(tokens, info)
+	}
+
+	err = rows.Err(); if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, &PersonalTokensResponse{Tokens: tokens})
+}
+
+func revokePersonalTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var req RevokePersonalTokenRequest
+	if apiErr := decodeJSON(w, r, &req); apiErr != nil {
+		writeError(w, apiErr)
+		return
+	}
+
+	p, ok := principalFrom(r); if !ok {
+		writeError(w, errInvalidSession)
+		return
+	}
+
+	var id int64
+	err := personalTokens.delete.QueryRow(req.Id, p.Id).Scan(&id); if err == sql.ErrNoRows {
+		writeError(w, errPersonalTokenNotFound)
+		return
+	} else if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	requestLogger(r, "tokens").Info("Personal token revoked", "token_id", id)
+
+	writeJSON(w, http.StatusOK, &MessageResponse{Message: "Personal token has been revoked"})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCreatePersonalTokenValidation(t *testing.T) {
+	cases := []struct{
+		body string
+		code string
+	}{
+		{`{"name": "ci"}`, ""},
+		{`{"name": "ci", "expires_in_days": 90, "scopes": ["read", "deploy:canban"], "apps": ["canban"]}`, ""},
+		{`{"name": ""}`, "missing_field"},
+		{`{"name": "ci", "expires_in_days": 400}`, "invalid_field"},
+		{`{"name": "ci", "scopes": ["Read Everything"]}`, "invalid_field"},
+		{`{"name": "ci", "apps": ["nope"]}`, "invalid_field"},
+	}
+
+	defer withOAuthClients(t)()
+
+	for _, c := range cases {
+		var req CreatePersonalTokenRequest
+		r := httptest.NewRequest("POST", "/tokens/create", bytes.NewBufferString(c.body))
+		apiErr := decodeJSON(httptest.NewRecorder(), r, &req)
+
+		if c.code == "" && apiErr != nil {
+			t.Fatal("Valid body was rejected", c.body, apiErr.Message)
+		}
+		if c.code != "" && (apiErr == nil || apiErr.Code != c.code) {
+			t.Fatal("Expected", c.code, "for", c.body)
+		}
+		if c.code == "" && (req.ExpiresInDays == 0 || req.Scopes == nil || req.Apps == nil) {
+			t.Fatal("Defaults were not filled in", req)
+		}
+	}
+}
+
+func TestPersonalTokensCannotChangeAnything(t *testing.T) {
+	if bearerToken(httptest.NewRequest("GET", "/", nil)) != "" {
+		t.Fatal("Bearer token found without an Authorization header")
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "bearer pat_abc")
+	if bearerToken(r) != "pat_abc" {
+		t.Fatal("Bearer token was not read")
+	}
+
+	if _, ok := userPrincipal(newPersonalToken()); ok {
+		t.Fatal("Personal token resolved without a token store")
+	}
+
+	reached := false
+	handler := csrfMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	}))
+
+	r = withPrincipal(httptest.NewRequest("POST", "/tokens/create", nil), &Principal{Id: 1, TokenType: personalTokenType, Token: "pat_abc"})
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+	if reached || rec.Code != 403 || decodeError(t, rec).Code != "session_required" {
+		t.Fatal("Personal token passed the CSRF check", rec.Code)
+	}
+}
+
+func TestPersonalTokenPortalScopes(t *testing.T) {
+	cases := []struct{
+		p *Principal
+		allowed bool
+	}{
+		{&Principal{TokenType: sessionTokenType}, true},
+		{&Principal{TokenType: personalTokenType, Scopes: []string{"read"}}, false},
+		{&Principal{TokenType: personalTokenType, Scopes: []string{portalReadScope}}, true},
+		{&Principal{TokenType: personalTokenType, Scopes: []string{portalAdminScope}}, true},
+		{&Principal{TokenType: personalTokenType, Scopes: []string{portalAdminScope}, Apps: []string{"canban"}}, false},
+	}
+
+	for _, c := range cases {
+		if portalRouteAllowed(c.p) != c.allowed {
+			t.Fatal("Unexpected access to Portal routes", c.p)
+		}
+	}
+
+	//Refused before the admin flag is even looked up
+	for _, scopes := range [][]string{{"read"}, {portalReadScope}} {
+		r := httptest.NewRequest("GET", "/admin/sessions?username=shiba", nil)
+		rec := httptest.NewRecorder()
+		if requireAdmin(rec, r, nil, &Principal{Id: 1, TokenType: personalTokenType, Scopes: scopes, Apps: []string{"canban"}}) || rec.Code != 403 || decodeError(t, rec).Code != "insufficient_scope" {
+			t.Fatal("Personal token without portal:admin acted as admin", scopes)
+		}
+	}
+}
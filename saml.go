@@ -0,0 +1,557 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+type SAMLConfig struct {
+	CertFile string `toml:"cert_file"`
+	KeyFile string `toml:"key_file"`
+	//Defaults to <issuer>/saml/metadata
+	EntityID string `toml:"entity_id"`
+	AssertionLifetime Duration `toml:"assertion_lifetime"`
+}
+
+func (c *SAMLConfig) Enabled() bool {
+	return c.CertFile != "" && c.KeyFile != ""
+}
+
+func samlEntityID() string {
+	if config.SAML.EntityID != "" {
+		return config.SAML.EntityID
+	}
+	return tokenIssuer() + "/saml/metadata"
+}
+
+//How an app registered in apps.toml receives SAML assertions
+type SAMLServiceProvider struct {
+	EntityID string `toml:"entity_id"`
+	ACSURL string `toml:"acs_url"`
+	//username (the default) or id
+	NameID string `toml:"name_id"`
+	//Portal attribute (username, id, admin or groups) to the attribute name the app expects
+	Attributes map[string]string `toml:"attributes"`
+	//Sent along with assertions Portal starts from the welcome page
+	RelayState string `toml:"relay_state"`
+}
+
+var samlUserAttributes = map[string]bool{"username": true, "id": true, "admin": true, "groups": true}
+
+func (sp *SAMLServiceProvider) validate() error {
+	if sp.EntityID == "" {
+		return fmt.Errorf("saml.entity_id is required")
+	}
+
+	acs, err := url.Parse(sp.ACSURL); if err != nil || acs.Scheme == "" || acs.Host == "" {
+		return fmt.Errorf("saml.acs_url must be an absolute URL")
+	}
+
+	switch sp.NameID {
+	case "":
+		sp.NameID = "username"
+	case "username", "id":
+	default:
+		return fmt.Errorf("saml.name_id must be username or id")
+	}
+
+	for attribute := range sp.Attributes {
+		if !samlUserAttributes[attribute] {
+			return fmt.Errorf("saml.attributes has unknown user attribute %s", attribute)
+		}
+	}
+
+	return nil
+}
+
+//What an assertion says about a user
+type SAMLUser struct {
+	Id int64
+	Name string
+	Admin bool
+	SessionId string
+	AuthnInstant time.Time
+}
+
+//The groups apps see for the user in the groups attribute
+func (u *SAMLUser) Groups() []string {
+	return userGroups(u.Admin)
+}
+
+func (u *SAMLUser) attribute(name string) []string {
+	switch name {
+	case "username":
+		return []string{u.Name}
+	case "id":
+		return []string{strconv.FormatInt(u.Id, 10)}
+	case "admin":
+		return []string{strconv.FormatBool(u.Admin)}
+	case "groups":
+		return u.Groups()
+	}
+	return nil
+}
+
+type samlPending struct {
+	request *samlAuthnRequest
+	relayState string
+	expires time.Time
+}
+
+type SAMLIdentityProvider struct {
+	cert *x509.Certificate
+	signer crypto.Signer
+	chain [][]byte
+
+	mu sync.Mutex
+	//AuthnRequests waiting for the user to log in
+	pending map[string]*samlPending
+}
+
+//The /saml routes are only registered when [saml] sets it up
+var samlIdP *SAMLIdentityProvider
+
+func newSAMLIdentityProvider(c *SAMLConfig) (*SAMLIdentityProvider, error) {
+	pair, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile); if err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(pair.Certificate[0]); if err != nil {
+		return nil, err
+	}
+
+	signer, ok := pair.PrivateKey.(crypto.Signer); if !ok {
+		return nil, fmt.Errorf("SAML key can't sign")
+	}
+
+	return &SAMLIdentityProvider{
+		cert: cert,
+		signer: signer,
+		chain: pair.Certificate,
+		pending: make(map[string]*samlPending),
+	}, nil
+}
+
+//Keeps a request until the user has logged in, false when too many are waiting already
+func (idp *SAMLIdentityProvider) park(p *samlPending, now time.Time) (string, bool) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	for id, old := range idp.pending {
+		if now.After(old.expires) {
+			delete(idp.pending, id)
+		}
+	}
+	if len(idp.pending) >= maxPendingLogins {
+		return "", false
+	}
+
+	id := newSessionId()
+	p.expires = now.Add(returnToLifetime)
+	idp.pending[id] = p
+	return id, true
+}
+
+func (idp *SAMLIdentityProvider) resume(id string, now time.Time) (*samlPending, bool) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	p, ok := idp.pending[id]; if !ok || now.After(p.expires) {
+		return nil, false
+	}
+	delete(idp.pending, id)
+	return p, true
+}
+
+const (
+	samlProtocolNS = "urn:oasis:names:tc:SAML:2.0:protocol"
+	samlAssertionNS = "urn:oasis:names:tc:SAML:2.0:assertion"
+	samlMetadataNS = "urn:oasis:names:tc:SAML:2.0:metadata"
+	samlRedirectBinding = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	samlPostBinding = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+	samlNameIDUnspecified = "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified"
+	samlTimeFormat = "2006-01-02T15:04:05Z"
+)
+
+type samlAuthnRequest struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol AuthnRequest"`
+	ID string `xml:"ID,attr"`
+	AssertionConsumerServiceURL string `xml:"AssertionConsumerServiceURL,attr"`
+	Issuer string `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+}
+
+const maxSAMLRequestBytes = 64 << 10
+
+var errBadSAMLRequest = badRequest("invalid_saml_request", "SAMLRequest is missing or malformed")
+
+//Redirect binding requests are deflated, POST binding requests are not
+func decodeSAMLRequest(encoded string, deflated bool) (*samlAuthnRequest, *APIError) {
+	raw, err := base64.StdEncoding.DecodeString(encoded); if err != nil {
+		return nil, errBadSAMLRequest
+	}
+
+	if deflated {
+		raw, err = io.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(raw)), maxSAMLRequestBytes)); if err != nil {
+			return nil, errBadSAMLRequest
+		}
+	}
+
+	var req samlAuthnRequest
+	err = xml.Unmarshal(raw, &req); if err != nil || req.ID == "" || req.Issuer == "" {
+		return nil, errBadSAMLRequest
+	}
+
+	return &req, nil
+}
+
+//Authn requests aren't signed by our vendors, so nothing in one is trusted beyond picking
+//the app. Assertions only ever go to the ACS URL registered in apps.toml
+func (req *samlAuthnRequest) serviceProvider() (*App, *APIError) {
+	app, ok := apps.ServiceProvider(req.Issuer); if !ok {
+		return nil, badRequest("unknown_service_provider", "No app is registered for this SAML issuer")
+	}
+
+	if req.AssertionConsumerServiceURL != "" && req.AssertionConsumerServiceURL != app.SAML.ACSURL {
+		return nil, badRequest("invalid_acs_url", "AssertionConsumerServiceURL is not registered for this app")
+	}
+
+	return app, nil
+}
+
+func samlID() string {
+	//XML ids can't start with a digit
+	return "_" + newSessionId()
+}
+
+func samlTime(t time.Time) string {
+	return t.UTC().Format(samlTimeFormat)
+}
+
+func (idp *SAMLIdentityProvider) assertion(sp *SAMLServiceProvider, user *SAMLUser, inResponseTo string, now time.Time) *etree.Element {
+	notOnOrAfter := samlTime(now.Add(config.SAML.AssertionLifetime.Duration))
+
+	a := etree.NewElement("saml:Assertion")
+	a.CreateAttr("xmlns:saml", samlAssertionNS)
+	a.CreateAttr("ID", samlID())
+	a.CreateAttr("Version", "2.0")
+	a.CreateAttr("IssueInstant", samlTime(now))
+	a.CreateElement("saml:Issuer").SetText(samlEntityID())
+
+	subject := a.CreateElement("saml:Subject")
+	nameID := subject.CreateElement("saml:NameID")
+	nameID.CreateAttr("Format", samlNameIDUnspecified)
+	nameID.SetText(user.attribute(sp.NameID)[0])
+
+	confirmation := subject.CreateElement("saml:SubjectConfirmation")
+	confirmation.CreateAttr("Method", "urn:oasis:names:tc:SAML:2.0:cm:bearer")
+	data := confirmation.CreateElement("saml:SubjectConfirmationData")
+	if inResponseTo != "" {
+		data.CreateAttr("InResponseTo", inResponseTo)
+	}
+	data.CreateAttr("NotOnOrAfter", notOnOrAfter)
+	data.CreateAttr("Recipient", sp.ACSURL)
+
+	conditions := a.CreateElement("saml:Conditions")
+	//A little leeway for service providers whose clocks run ahead of ours
+	conditions.CreateAttr("NotBefore", samlTime(now.Add(-time.Minute)))
+	conditions.CreateAttr("NotOnOrAfter", notOnOrAfter)
+	conditions.CreateElement("saml:AudienceRestriction").CreateElement("saml:Audience").SetText(sp.EntityID)
+
+	authn := a.CreateElement("saml:AuthnStatement")
+	authn.CreateAttr("AuthnInstant", samlTime(user.AuthnInstant))
+	authn.CreateAttr("SessionIndex", user.SessionId)
+	authn.CreateElement("saml:AuthnContext").CreateElement("saml:AuthnContextClassRef").SetText("urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport")
+
+	if len(sp.Attributes) > 0 {
+		statement := a.CreateElement("saml:AttributeStatement")
+		for _, name := range []string{"username", "id", "admin", "groups"} {
+			samlName, ok := sp.Attributes[name]; if !ok {
+				continue
+			}
+
+			attribute := statement.CreateElement("saml:Attribute")
+			attribute.CreateAttr("Name", samlName)
+			attribute.CreateAttr("NameFormat", "urn:oasis:names:tc:SAML:2.0:attrname-format:basic")
+			for _, value := range user.attribute(name) {
+				attribute.CreateElement("saml:AttributeValue").SetText(value)
+			}
+		}
+	}
+
+	return a
+}
+
+//Signs the assertion and puts the signature right after its Issuer where the schema wants it
+func (idp *SAMLIdentityProvider) sign(el *etree.Element) (*etree.Element, error) {
+	ctx, err := dsig.NewSigningContext(idp.signer, idp.chain); if err != nil {
+		return nil, err
+	}
+	ctx.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
+
+	signed, err := ctx.SignEnveloped(el); if err != nil {
+		return nil, err
+	}
+
+	//SignEnveloped appends the signature without parenting it, so RemoveChild can't take it out
+	signature := signed.Child[len(signed.Child) - 1]
+	signed.Child = signed.Child[:len(signed.Child) - 1]
+	signed.InsertChildAt(1, signature)
+	return signed, nil
+}
+
+//Builds a signed SAML Response, base64 encoded for the HTTP-POST binding
+func (idp *SAMLIdentityProvider) Response(sp *SAMLServiceProvider, user *SAMLUser, inResponseTo string, now time.Time) (string, error) {
+	assertion, err := idp.sign(idp.assertion(sp, user, inResponseTo, now)); if err != nil {
+		return "", err
+	}
+
+	resp := etree.NewElement("samlp:Response")
+	resp.CreateAttr("xmlns:samlp", samlProtocolNS)
+	resp.CreateAttr("xmlns:saml", samlAssertionNS)
+	resp.CreateAttr("ID", samlID())
+	resp.CreateAttr("Version", "2.0")
+	resp.CreateAttr("IssueInstant", samlTime(now))
+	resp.CreateAttr("Destination", sp.ACSURL)
+	if inResponseTo != "" {
+		resp.CreateAttr("InResponseTo", inResponseTo)
+	}
+	resp.CreateElement("saml:Issuer").SetText(samlEntityID())
+	resp.CreateElement("samlp:Status").CreateElement("samlp:StatusCode").CreateAttr("Value", "urn:oasis:names:tc:SAML:2.0:status:Success")
+	resp.AddChild(assertion)
+
+	doc := etree.NewDocument()
+	doc.SetRoot(resp)
+	raw, err := doc.WriteToBytes(); if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(raw), nil
+}
+
+func (idp *SAMLIdentityProvider) Metadata() ([]byte, error) {
+	root := etree.NewElement("md:EntityDescriptor")
+	root.CreateAttr("xmlns:md", samlMetadataNS)
+	root.CreateAttr("xmlns:ds", "http://www.w3.org/2000/09/xmldsig#")
+	root.CreateAttr("entityID", samlEntityID())
+
+	descriptor := root.CreateElement("md:IDPSSODescriptor")
+	descriptor.CreateAttr("WantAuthnRequestsSigned", "false")
+	descriptor.CreateAttr("protocolSupportEnumeration", samlProtocolNS)
+
+	key := descriptor.CreateElement("md:KeyDescriptor")
+	key.CreateAttr("use", "signing")
+	key.CreateElement("ds:KeyInfo").CreateElement("ds:X509Data").CreateElement("ds:X509Certificate").SetText(base64.StdEncoding.EncodeToString(idp.cert.Raw))
+
+	descriptor.CreateElement("md:NameIDFormat").SetText(samlNameIDUnspecified)
+	for _, binding := range []string{samlRedirectBinding, samlPostBinding} {
+		sso := descriptor.CreateElement("md:SingleSignOnService")
+		sso.CreateAttr("Binding", binding)
+		sso.CreateAttr("Location", tokenIssuer() + "/saml/sso")
+	}
+
+	doc := etree.NewDocument()
+	doc.CreateProcInst("xml", `version="1.0" encoding="UTF-8"`)
+	doc.SetRoot(root)
+	doc.Indent(2)
+	return doc.WriteToBytes()
+}
+
+func samlMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireGet(w, r) {
+		return
+	}
+
+	metadata, err := samlIdP.Metadata(); if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	w.Write(metadata)
+}
+
+var samlPostTemplate = template.Must(template.New("saml").Parse(`<!DOCTYPE HTML>
+<html>
+<head>
+  <meta charset="UTF-8">
+  <title>Portal</title>
+</head>
+<body>
+  <form method="POST" action="{{.ACSURL}}">
+    <input type="hidden" name="SAMLResponse" value="{{.Response}}">
+    {{if .RelayState}}<input type="hidden" name="RelayState" value="{{.RelayState}}">{{end}}
+    <noscript><button type="submit">Continue to {{.App}}</button></noscript>
+  </form>
+  <script nonce="{{.Nonce}}">document.forms[0].submit();</script>
+</body>
+</html>
+`))
+
+type samlPostPage struct {
+	App string
+	ACSURL string
+	Response string
+	RelayState string
+	Nonce string
+}
+
+//Reads who is logged in for an assertion, nil when the browser has no session
+func samlUser(r *http.Request, stmt *sql.Stmt) (*SAMLUser, error) {
+	token := sessionToken(r)
+	au, ok := activeUsers.Get(token); if !ok || au.Expired(time.Now()) {
+		return nil, nil
+	}
+
+	user := &SAMLUser{Id: au.Id, Name: au.Name, SessionId: au.SessionId, AuthnInstant: au.LoginAt}
+	err := stmt.QueryRow(au.Id).Scan(&user.Admin); if err != nil {
+		return nil, err
+	}
+
+	setLogUser(r, au.Id)
+	activeUsers.Touch(token, time.Now())
+	return user, nil
+}
+
+//Answers with a page that posts the signed response to the app, the only binding SAML
+//allows for assertions. The page's CSP lets its form post to that app and nowhere else
+func (idp *SAMLIdentityProvider) post(w http.ResponseWriter, r *http.Request, app *App, user *SAMLUser, inResponseTo string, relayState string) {
+	resp, err := idp.Response(app.SAML, user, inResponseTo, time.Now()); if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	signedTokenIssued("saml")
+	activeUsers.UsedBy(sessionToken(r), app.Name)
+	requestLogger(r, "saml").Info("SAML assertion issued", "sp", app.SAML.EntityID)
+
+	acs, _ := url.Parse(app.SAML.ACSURL)
+	nonce := cspNonce(r)
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; script-src 'nonce-" + nonce + "'; form-action " + acs.Scheme + "://" + acs.Host + "; frame-ancestors 'none'; base-uri 'none'")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	samlPostTemplate.Execute(w, &samlPostPage{
+		App: app.Name,
+		ACSURL: app.SAML.ACSURL,
+		Response: resp,
+		RelayState: relayState,
+		Nonce: nonce,
+	})
+}
+
+//Single sign on for both bindings. POSTs come cross-site without the Lax session cookie,
+//so they are parked and picked up again by a same-site GET
+func samlSSOHandler() http.HandlerFunc {
+	stmt := prepareQuery("sql/check_admin.sql")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+
+		var pending *samlPending
+		switch r.Method {
+		case "GET":
+			q := r.URL.Query()
+			if id := q.Get("pending"); id != "" {
+				p, ok := samlIdP.resume(id, now); if !ok {
+					writeError(w, badRequest("expired_saml_request", "SAML request expired, start again from the app"))
+					return
+				}
+				pending = p
+				break
+			}
+
+			req, apiErr := decodeSAMLRequest(q.Get("SAMLRequest"), true); if apiErr != nil {
+				writeError(w, apiErr)
+				return
+			}
+			pending = &samlPending{request: req, relayState: q.Get("RelayState")}
+		case "POST":
+			r.Body = http.MaxBytesReader(w, r.Body, maxSAMLRequestBytes)
+			req, apiErr := decodeSAMLRequest(r.PostFormValue("SAMLRequest"), false); if apiErr != nil {
+				writeError(w, apiErr)
+				return
+			}
+
+			//Only requests from registered service providers are kept around
+			if _, apiErr := req.serviceProvider(); apiErr != nil {
+				writeError(w, apiErr)
+				return
+			}
+
+			id, ok := samlIdP.park(&samlPending{request: req, relayState: r.PostFormValue("RelayState")}, now); if !ok {
+				writeError(w, errTooManyPendingLogins)
+				return
+			}
+			http.Redirect(w, r, "/saml/sso?pending=" + id, http.StatusSeeOther)
+			return
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			writeError(w, &APIError{Status: http.StatusMethodNotAllowed, Code: "method_not_allowed", Message: "This route only accepts GET and POST requests"})
+			return
+		}
+
+		app, apiErr := pending.request.serviceProvider(); if apiErr != nil {
+			writeError(w, apiErr)
+			return
+		}
+		setLogApp(r, app.Name)
+
+		user, err := samlUser(r, stmt); if err != nil {
+			internalError(w, r, err)
+			return
+		}
+
+		if user == nil {
+			id, ok := samlIdP.park(pending, now); if !ok {
+				writeError(w, errTooManyPendingLogins)
+				return
+			}
+			loginFirst(w, r, "/saml/sso?pending=" + id)
+			return
+		}
+
+		samlIdP.post(w, r, app, user, pending.request.ID, pending.relayState)
+	})
+}
+
+//IdP initiated login, the welcome page links SAML apps here
+func samlLaunchHandler() http.HandlerFunc {
+	stmt := prepareQuery("sql/check_admin.sql")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !requireGet(w, r) {
+			return
+		}
+
+		name := r.URL.Query().Get("app")
+		app, ok := apps.App(name); if !ok || app.SAML == nil {
+			writeError(w, notFound("app_not_found", "No SAML app is registered with that name"))
+			return
+		}
+		setLogApp(r, app.Name)
+
+		user, err := samlUser(r, stmt); if err != nil {
+			internalError(w, r, err)
+			return
+		}
+
+		if user == nil {
+			loginFirst(w, r, app.LaunchURL())
+			return
+		}
+
+		samlIdP.post(w, r, app, user, "", app.SAML.RelayState)
+	})
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+func testSAMLIdP(t *testing.T) *SAMLIdentityProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048); if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{CommonName: "portal saml"},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key); if err != nil {
+		t.Fatal(err.Error())
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	return &SAMLIdentityProvider{
+		cert: cert,
+		signer: key,
+		chain: [][]byte{der},
+		pending: make(map[string]*samlPending),
+	}
+}
+
+func withSAMLApps(t *testing.T) func() {
+	return withApps(t, `
+canban = "appsecret"
+
+[vendor]
+secret = "vendorsecret"
+[vendor.saml]
+entity_id = "https://vendor.example.com/saml"
+acs_url = "https://vendor.example.com/saml/acs"
+[vendor.saml.attributes]
+username = "uid"
+admin = "isAdmin"
+groups = "memberOf"
+`)
+}
+
+func TestSAMLServiceProviderRegistry(t *testing.T) {
+	defer withSAMLApps(t)()
+
+	app, ok := apps.ServiceProvider("https://vendor.example.com/saml"); if !ok || app.Name != "vendor" || app.SAML.NameID != "username" {
+		t.Fatal("SAML app was not registered")
+	}
+
+	links := apps.Links("shiba")
+	if len(links) != 2 || links[1].URL != "/saml/launch?app=vendor" || links[0].URL != "/canban" {
+		t.Fatal("Unexpected welcome page links", links)
+	}
+
+	_, err := parseApps("[bad]\nsecret = \"s\"\n[bad.saml]\nentity_id = \"x\"\nacs_url = \"/relative\"\n"); if err == nil {
+		t.Fatal("Relative ACS URL was accepted")
+	}
+
+	_, err = parseApps("[bad]\nsecret = \"s\"\n[bad.saml]\nentity_id = \"x\"\nacs_url = \"https://x\"\n[bad.saml.attributes]\npassword = \"pw\"\n"); if err == nil {
+		t.Fatal("Unknown user attribute was accepted")
+	}
+}
+
+func TestDecodeSAMLRequest(t *testing.T) {
+	defer withSAMLApps(t)()
+
+	xml := `<samlp:AuthnRequest xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="_req1" Version="2.0" AssertionConsumerServiceURL="https://vendor.example.com/saml/acs"><saml:Issuer>https://vendor.example.com/saml</saml:Issuer></samlp:AuthnRequest>`
+
+	var deflated bytes.Buffer
+	fw, _ := flate.NewWriter(&deflated, flate.DefaultCompression)
+	fw.Write([]byte(xml))
+	fw.Close()
+
+	req, apiErr := decodeSAMLRequest(base64.StdEncoding.EncodeToString(deflated.Bytes()), true); if apiErr != nil {
+		t.Fatal("Redirect binding request was not decoded", apiErr.Message)
+	}
+	if req.ID != "_req1" || req.Issuer != "https://vendor.example.com/saml" {
+		t.Fatal("Unexpected request", req)
+	}
+
+	if _, apiErr := req.serviceProvider(); apiErr != nil {
+		t.Fatal("Registered service provider was refused", apiErr.Message)
+	}
+
+	post, apiErr := decodeSAMLRequest(base64.StdEncoding.EncodeToString([]byte(strings.Replace(xml, "/saml/acs", "/evil", 1))), false); if apiErr != nil {
+		t.Fatal("POST binding request was not decoded", apiErr.Message)
+	}
+	if _, apiErr := post.serviceProvider(); apiErr == nil || apiErr.Code != "invalid_acs_url" {
+		t.Fatal("Unregistered ACS URL was accepted")
+	}
+
+	if _, apiErr := decodeSAMLRequest("not base64", true); apiErr == nil {
+		t.Fatal("Garbage request was accepted")
+	}
+}
+
+func TestSAMLResponseIsSigned(t *testing.T) {
+	defer withSAMLApps(t)()
+	idp := testSAMLIdP(t)
+	app, _ := apps.App("vendor")
+
+	user := &SAMLUser{Id: 7, Name: "shiba", Admin: true, SessionId: "abc", AuthnInstant: time.Now()}
+	encoded, err := idp.Response(app.SAML, user, "_req1", time.Now()); if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	raw, _ := base64.StdEncoding.DecodeString(encoded)
+	doc := etree.NewDocument()
+	err = doc.ReadFromBytes(raw); if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	resp := doc.Root()
+	if resp.SelectAttrValue("InResponseTo", "") != "_req1" || resp.SelectAttrValue("Destination", "") != app.SAML.ACSURL {
+		t.Fatal("Response is not addressed to the request")
+	}
+
+	assertion := resp.FindElement("./Assertion")
+	if assertion.ChildElements()[1].Tag != "Signature" {
+		t.Fatal("Signature must follow the assertion issuer")
+	}
+
+	validator := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{Roots: []*x509.Certificate{idp.cert}})
+	validated, err := validator.Validate(assertion); if err != nil {
+		t.Fatal("Assertion signature does not validate", err.Error())
+	}
+
+	if validated.FindElement("./Subject/NameID").Text() != "shiba" || validated.FindElement("./Conditions/AudienceRestriction/Audience").Text() != app.SAML.EntityID {
+		t.Fatal("Assertion names the wrong subject or audience")
+	}
+
+	values := map[string][]string{}
+	for _, attribute := range validated.FindElements("./AttributeStatement/Attribute") {
+		for _, value := range attribute.ChildElements() {
+			values[attribute.SelectAttrValue("Name", "")] = append(values[attribute.SelectAttrValue("Name", "")], value.Text())
+		}
+	}
+	if values["uid"][0] != "shiba" || values["isAdmin"][0] != "true" || len(values["memberOf"]) != 2 {
+		t.Fatal("Attributes were not mapped", values)
+	}
+
+	assertion.FindElement("./Subject/NameID").SetText("admin")
+	if _, err := validator.Validate(assertion); err == nil {
+		t.Fatal("Tampered assertion validated")
+	}
+}
+
+func TestSAMLMetadataAndPendingRequests(t *testing.T) {
+	saved := samlIdP
+	defer func() { samlIdP = saved }()
+	samlIdP = testSAMLIdP(t)
+
+	rec := httptest.NewRecorder()
+	samlMetadataHandler(rec, httptest.NewRequest("GET", "/saml/metadata", nil))
+	body := rec.Body.String()
+	if rec.Code != 200 || !strings.Contains(body, base64.StdEncoding.EncodeToString(samlIdP.cert.Raw)) || !strings.Contains(body, samlRedirectBinding) || !strings.Contains(body, `entityID="` + samlEntityID() + `"`) {
+		t.Fatal("Metadata is incomplete", body)
+	}
+
+	now := time.Now()
+	id, _ := samlIdP.park(&samlPending{request: &samlAuthnRequest{ID: "_req1"}}, now)
+	if _, ok := samlIdP.resume(id, now.Add(returnToLifetime + time.Second)); ok {
+		t.Fatal("Expired pending request was resumed")
+	}
+
+	id, _ = samlIdP.park(&samlPending{request: &samlAuthnRequest{ID: "_req2"}}, now)
+	if p, ok := samlIdP.resume(id, now); !ok || p.request.ID != "_req2" {
+		t.Fatal("Pending request was not resumed")
+	}
+	if _, ok := samlIdP.resume(id, now); ok {
+		t.Fatal("Pending request was resumed twice")
+	}
+
+	for i := 0; i < maxPendingLogins; i++ {
+		samlIdP.park(&samlPending{request: &samlAuthnRequest{ID: "_flood"}}, now)
+	}
+	if _, ok := samlIdP.park(&samlPending{request: &samlAuthnRequest{ID: "_req3"}}, now); ok || len(samlIdP.pending) != maxPendingLogins {
+		t.Fatal("Pending requests are not capped", len(samlIdP.pending))
+	}
+	if _, ok := samlIdP.park(&samlPending{request: &samlAuthnRequest{ID: "_req3"}}, now.Add(returnToLifetime + time.Second)); !ok {
+		t.Fatal("Expired requests still count against the cap")
+	}
+}
+
+func TestReturnToAfterLogin(t *testing.T) {
+	rec := httptest.NewRecorder()
+	loginFirst(rec, httptest.NewRequest("GET", "/saml/launch?app=vendor", nil), "/saml/launch?app=vendor")
+	if rec.Code != 303 || rec.Header().Get("Location") != "/" {
+		t.Fatal("Browser without a session was not sent to log in")
+	}
+
+	r := httptest.NewRequest("GET", "/welcome", nil)
+	for _, c := range rec.Result().Cookies() {
+		r.AddCookie(c)
+	}
+
+	if to, ok := takeReturnTo(httptest.NewRecorder(), r); !ok || to != "/saml/launch?app=vendor" {
+		t.Fatal("Return path was not remembered", to)
+	}
+
+	for _, to := range []string{"https://evil.example.com", "//evil.example.com", "/\\evil.example.com"} {
+		r := httptest.NewRequest("GET", "/welcome", nil)
+		rec := httptest.NewRecorder()
+		setReturnTo(rec, r, to)
+		r.AddCookie(rec.Result().Cookies()[0])
+		if _, ok := takeReturnTo(httptest.NewRecorder(), r); ok {
+			t.Fatal("Off site return path was accepted", to)
+		}
+	}
+}
+
@@ -0,0 +1,1050 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/lib/pq"
+)
+
+//SCIM 2.0 (RFC 7643, RFC 7644) lets a provisioning client like an HR system manage users
+type SCIMConfig struct {
+	//Hex SHA-256 of the bearer token the provisioning client sends
+	TokenHash string `toml:"token_hash"`
+}
+
+func (c *SCIMConfig) Enabled() bool {
+	return c.TokenHash != ""
+}
+
+const (
+	scimUserSchema = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimGroupSchema = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimListSchema = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimPatchSchema = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	scimErrorSchema = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimConfigSchema = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+
+	scimContentType = "application/scim+json"
+	scimPath = "/scim/v2"
+	scimMaxResults = 200
+
+	//Portal has no group directory, these are derived from the admin flag like for SAML
+	scimUsersGroup = "users"
+	scimAdminsGroup = "admins"
+)
+
+func scimLocation(resource string, id string) string {
+	return tokenIssuer() + scimPath + "/" + resource + "/" + id
+}
+
+//SCIM answers errors in its own shape, with status as a string
+type SCIMError struct {
+	Schemas []string `json:"schemas"`
+	Status string `json:"status"`
+	ScimType string `json:"scimType,omitempty"`
+	Detail string `json:"detail"`
+	status int
+}
+
+func (e *SCIMError) Error() string {
+	return e.Detail
+}
+
+func scimError(status int, scimType string, detail string) *SCIMError {
+	return &SCIMError{
+		Schemas: []string{scimErrorSchema},
+		Status: strconv.Itoa(status),
+		ScimType: scimType,
+		Detail: detail,
+		status: status,
+	}
+}
+
+var (
+	errSCIMUserNotFound = scimError(http.StatusNotFound, "", "User does not exist")
+	errSCIMGroupNotFound = scimError(http.StatusNotFound, "", "Group does not exist")
+	errSCIMPrecondition = scimError(http.StatusPreconditionFailed, "", "Resource has changed, fetch it again")
+	errSCIMUniqueness = scimError(http.StatusConflict, "uniqueness", "userName or externalId is already taken")
+)
+
+func writeSCIM(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", scimContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeSCIMError(w http.ResponseWriter, e *SCIMError) {
+	writeSCIM(w, e.status, e)
+}
+
+//Maps errors from the user store onto SCIM errors, anything unexpected is logged and opaque
+func scimStoreError(w http.ResponseWriter, r *http.Request, err error) {
+	if e, ok := err.(*SCIMError); ok {
+		writeSCIMError(w, e)
+		return
+	}
+
+	if err == sql.ErrNoRows {
+		writeSCIMError(w, errSCIMUserNotFound)
+		return
+	}
+
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		writeSCIMError(w, errSCIMUniqueness)
+		return
+	}
+
+	requestLogger(r, "scim").Error("Internal error", "error", err.Error())
+	writeSCIMError(w, scimError(http.StatusInternalServerError, "", "Internal server error"))
+}
+
+//The provisioning client has its own bearer token, it is not a user and has no session
+func scimAuthMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := bearerToken(r)
+		if token == "" || subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(strings.ToLower(config.SCIM.TokenHash))) != 1 {
+			loginFailed("scim", "bad_token")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="scim"`)
+			writeSCIMError(w, scimError(http.StatusUnauthorized, "", "Bearer token is missing or wrong"))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func decodeSCIM(w http.ResponseWriter, r *http.Request, v interface{}) *SCIMError {
+	mediaType, _, _ := strings.Cut(r.Header.Get("Content-Type"), ";")
+	mediaType = strings.TrimSpace(strings.ToLower(mediaType))
+	if mediaType != scimContentType && mediaType != "application/json" {
+		return scimError(http.StatusUnsupportedMediaType, "", "Content-Type must be " + scimContentType)
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+	err := json.NewDecoder(r.Body).Decode(v); if err != nil {
+		return scimError(http.StatusBadRequest, "invalidSyntax", "Request body is not valid JSON")
+	}
+	return nil
+}
+
+//If-Match guards changes, * matches anything that exists
+func etagMatches(header string, etag string) bool {
+	if header == "" {
+		return true
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+type SCIMMeta struct {
+	ResourceType string `json:"resourceType"`
+	Created *time.Time `json:"created,omitempty"`
+	LastModified *time.Time `json:"lastModified,omitempty"`
+	Location string `json:"location"`
+	Version string `json:"version"`
+}
+
+type SCIMRef struct {
+	Value string `json:"value"`
+	Display string `json:"display,omitempty"`
+	Ref string `json:"$ref,omitempty"`
+}
+
+type SCIMUser struct {
+	Schemas []string `json:"schemas"`
+	Id string `json:"id"`
+	ExternalId string `json:"externalId,omitempty"`
+	UserName string `json:"userName"`
+	Active bool `json:"active"`
+	//Read only, membership is changed through /Groups
+	Groups []SCIMRef `json:"groups"`
+	Meta SCIMMeta `json:"meta"`
+}
+
+func scimUser(a *Account) *SCIMUser {
+	id := strconv.FormatInt(a.Id, 10)
+	groups := []SCIMRef{{Value: scimUsersGroup, Display: scimUsersGroup, Ref: scimLocation("Groups", scimUsersGroup)}}
+	if a.Admin {
+		groups = append(groups, SCIMRef{Value: scimAdminsGroup, Display: scimAdminsGroup, Ref: scimLocation("Groups", scimAdminsGroup)})
+	}
+
+	return &SCIMUser{
+		Schemas: []string{scimUserSchema},
+		Id: id,
+		ExternalId: a.ExternalId,
+		UserName: a.Name,
+		Active: a.Active,
+		Groups: groups,
+		Meta: SCIMMeta{
+			ResourceType: "User",
+			Created: &a.Created,
+			LastModified: &a.Modified,
+			Location: scimLocation("Users", id),
+			Version: a.ETag(),
+		},
+	}
+}
+
+func writeSCIMUser(w http.ResponseWriter, status int, a *Account) {
+	u := scimUser(a)
+	w.Header().Set("ETag", u.Meta.Version)
+	w.Header().Set("Location", u.Meta.Location)
+	writeSCIM(w, status, u)
+}
+
+//Attributes Portal doesn't store, like name or emails, are accepted and ignored
+//so clients that always send a full profile keep working
+type SCIMUserRequest struct {
+	UserName string `json:"userName"`
+	ExternalId string `json:"externalId"`
+	Active *scimBool `json:"active"`
+	Password string `json:"password"`
+}
+
+//Some clients send booleans as "True" and "False"
+type scimBool bool
+
+func (b *scimBool) UnmarshalJSON(data []byte) error {
+	switch strings.ToLower(strings.Trim(string(data), `"`)) {
+	case "true":
+		*b = true
+	case "false":
+		*b = false
+	default:
+		return fmt.Errorf("%s is not a boolean", data)
+	}
+	return nil
+}
+
+func scimInvalidValue(apiErr *APIError) *SCIMError {
+	return scimError(http.StatusBadRequest, "invalidValue", apiErr.Message)
+}
+
+//PUT replaces the whole user, so leaving out externalId clears it and leaving out active activates
+func (req *SCIMUserRequest) apply(a *Account) *SCIMError {
+	if apiErr := validateUsername("userName", req.UserName); apiErr != nil {
+		return scimInvalidValue(apiErr)
+	}
+	if len(req.ExternalId) > maxUsernameLength {
+		return scimError(http.StatusBadRequest, "invalidValue", "externalId is too long")
+	}
+	if req.Password != "" {
+		if apiErr := validatePassword("password", req.Password); apiErr != nil {
+			return scimInvalidValue(apiErr)
+		}
+	}
+
+	a.Name = req.UserName
+	a.ExternalId = req.ExternalId
+	a.Active = req.Active == nil || bool(*req.Active)
+	a.Password = req.Password
+	return nil
+}
+
+type SCIMPatchOperation struct {
+	Op string `json:"op"`
+	Path string `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+type SCIMPatchRequest struct {
+	Schemas []string `json:"schemas"`
+	Operations []SCIMPatchOperation `json:"Operations"`
+}
+
+func (req *SCIMPatchRequest) validate() *SCIMError {
+	if len(req.Schemas) > 0 && req.Schemas[0] != scimPatchSchema {
+		return scimError(http.StatusBadRequest, "invalidSyntax", "schemas must be " + scimPatchSchema)
+	}
+	if len(req.Operations) == 0 {
+		return scimError(http.StatusBadRequest, "invalidSyntax", "Operations is required")
+	}
+	for i := range req.Operations {
+		req.Operations[i].Op = strings.ToLower(req.Operations[i].Op)
+		switch req.Operations[i].Op {
+		case "add", "replace", "remove":
+		default:
+			return scimError(http.StatusBadRequest, "invalidSyntax", "Unknown op " + strconv.Quote(req.Operations[i].Op))
+		}
+	}
+	return nil
+}
+
+func setUserAttribute(a *Account, path string, value json.RawMessage) *SCIMError {
+	invalid := scimError(http.StatusBadRequest, "invalidValue", "Invalid value for " + path)
+
+	switch strings.ToLower(path) {
+	case "username":
+		var name string
+		if json.Unmarshal(value, &name) != nil {
+			return invalid
+		}
+		if apiErr := validateUsername("userName", name); apiErr != nil {
+			return scimInvalidValue(apiErr)
+		}
+		a.Name = name
+	case "externalid":
+		var id string
+		if json.Unmarshal(value, &id) != nil || len(id) > maxUsernameLength {
+			return invalid
+		}
+		a.ExternalId = id
+	case "active":
+		var active scimBool
+		if json.Unmarshal(value, &active) != nil {
+			return invalid
+		}
+		a.Active = bool(active)
+	case "password":
+		var password string
+		if json.Unmarshal(value, &password) != nil {
+			return invalid
+		}
+		if apiErr := validatePassword("password", password); apiErr != nil {
+			return scimInvalidValue(apiErr)
+		}
+		a.Password = password
+	case "id", "groups", "meta":
+		return scimError(http.StatusBadRequest, "mutability", path + " is read only")
+	}
+	return nil
+}
+
+//Applies a PatchOp to the user. Operations without a path carry an object of attributes
+func applyUserPatch(a *Account, ops []SCIMPatchOperation) *SCIMError {
+	for _, op := range ops {
+		if op.Op == "remove" {
+			switch strings.ToLower(op.Path) {
+			case "externalid":
+				a.ExternalId = ""
+			case "":
+				return scimError(http.StatusBadRequest, "noTarget", "remove needs a path")
+			case "username", "active", "id", "groups", "meta":
+				return scimError(http.StatusBadRequest, "mutability", op.Path + " can't be removed")
+			}
+			continue
+		}
+
+		if op.Path != "" {
+			if e := setUserAttribute(a, op.Path, op.Value); e != nil {
+				return e
+			}
+			continue
+		}
+
+		var attributes map[string]json.RawMessage
+		if json.Unmarshal(op.Value, &attributes) != nil {
+			return scimError(http.StatusBadRequest, "invalidValue", "Operations without a path need an object value")
+		}
+		for path, value := range attributes {
+			if e := setUserAttribute(a, path, value); e != nil {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+//Only what provisioning clients ask in practice: comparisons with eq joined by and
+func parseSCIMFilter(filter string) (map[string]string, *SCIMError) {
+	invalid := scimError(http.StatusBadRequest, "invalidFilter", "Only filters like userName eq \"value\" joined by and are supported")
+
+	var tokens []string
+	for i := 0; i < len(filter); {
+		switch {
+		case filter[i] == ' ':
+			i++
+		case filter[i] == '"':
+			end := i + 1
+			for end < len(filter) && filter[end] != '"' {
+				if filter[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(filter) {
+				return nil, invalid
+			}
+			var value string
+			if json.Unmarshal([]byte(filter[i:end + 1]), &value) != nil {
+				return nil, invalid
+			}
+			tokens = append(tokens, "\"" + value)
+			i = end + 1
+		default:
+			end := strings.IndexByte(filter[i:], ' ')
+			if end < 0 {
+				end = len(filter) - i
+			}
+			tokens = append(tokens, filter[i:i + end])
+			i += end
+		}
+	}
+
+	comparisons := make(map[string]string)
+	for i := 0; i < len(tokens); i += 4 {
+		if i + 3 > len(tokens) || !strings.EqualFold(tokens[i + 1], "eq") {
+			return nil, invalid
+		}
+		if i + 3 < len(tokens) && !strings.EqualFold(tokens[i + 3], "and") {
+			return nil, invalid
+		}
+		if i + 3 == len(tokens) - 1 {
+			return nil, invalid
+		}
+
+		attribute := strings.ToLower(tokens[i])
+		if _, ok := comparisons[attribute]; ok {
+			return nil, invalid
+		}
+		comparisons[attribute] = strings.TrimPrefix(tokens[i + 2], "\"")
+	}
+
+	return comparisons, nil
+}
+
+func userFilter(filter string) (*AccountFilter, *SCIMError) {
+	comparisons, e := parseSCIMFilter(filter); if e != nil {
+		return nil, e
+	}
+
+	var f AccountFilter
+	for attribute, value := range comparisons {
+		value := value
+		switch attribute {
+		case "id":
+			id, err := strconv.ParseInt(value, 10, 32); if err != nil {
+				//No user has that id
+				id = -1
+			}
+			f.Id = &id
+		case "username":
+			f.Name = &value
+		case "externalid":
+			f.ExternalId = &value
+		case "active":
+			active, err := strconv.ParseBool(value); if err != nil {
+				return nil, scimError(http.StatusBadRequest, "invalidFilter", "active must be compared with true or false")
+			}
+			f.Active = &active
+		default:
+			return nil, scimError(http.StatusBadRequest, "invalidFilter", "Can't filter by " + attribute)
+		}
+	}
+	return &f, nil
+}
+
+//startIndex is 1 based, count is capped at scimMaxResults
+func scimPage(r *http.Request) (int, int) {
+	start, err := strconv.Atoi(r.URL.Query().Get("startIndex")); if err != nil || start < 1 {
+		start = 1
+	}
+
+	count, err := strconv.Atoi(r.URL.Query().Get("count")); if err != nil || count > scimMaxResults {
+		count = scimMaxResults
+	}
+	if count < 0 {
+		count = 0
+	}
+
+	return start, count
+}
+
+type SCIMListResponse struct {
+	Schemas []string `json:"schemas"`
+	TotalResults int `json:"totalResults"`
+	StartIndex int `json:"startIndex"`
+	ItemsPerPage int `json:"itemsPerPage"`
+	Resources []interface{} `json:"Resources"`
+}
+
+func scimList(total int, start int, resources []interface{}) *SCIMListResponse {
+	return &SCIMListResponse{
+		Schemas: []string{scimListSchema},
+		TotalResults: total,
+		StartIndex: start,
+		ItemsPerPage: len(resources),
+		Resources: resources,
+	}
+}
+
+func scimMethodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	writeSCIMError(w, scimError(http.StatusMethodNotAllowed, "", "Method not allowed, use " + allow))
+}
+
+//Parses the id from /scim/v2/<resource>/<id>, an empty id means the collection
+func scimResourceId(r *http.Request, resource string) string {
+	return strings.Trim(strings.TrimPrefix(r.URL.Path, scimPath + "/" + resource), "/")
+}
+
+func scimUsersHandler(w http.ResponseWriter, r *http.Request) {
+	raw := scimResourceId(r, "Users")
+	if raw == "" {
+		switch r.Method {
+		case "GET":
+			listSCIMUsers(w, r)
+		case "POST":
+			createSCIMUser(w, r)
+		default:
+			scimMethodNotAllowed(w, "GET, POST")
+		}
+		return
+	}
+
+	id, err := strconv.ParseInt(raw, 10, 32); if err != nil {
+		writeSCIMError(w, errSCIMUserNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		getSCIMUser(w, r, id)
+	case "PUT", "PATCH":
+		updateSCIMUser(w, r, id)
+	case "DELETE":
+		deleteSCIMUser(w, r, id)
+	default:
+		scimMethodNotAllowed(w, "GET, PUT, PATCH, DELETE")
+	}
+}
+
+func listSCIMUsers(w http.ResponseWriter, r *http.Request) {
+	filter, e := userFilter(r.URL.Query().Get("filter")); if e != nil {
+		writeSCIMError(w, e)
+		return
+	}
+	start, count := scimPage(r)
+
+	accounts, total, err := userStore.List(filter, start - 1, count); if err != nil {
+		scimStoreError(w, r, err)
+		return
+	}
+
+	resources := make([]interface{}, 0, len(accounts))
+	for _, a := range accounts {
+		resources = append(resources, scimUser(a))
+	}
+	writeSCIM(w, http.StatusOK, scimList(total, start, resources))
+}
+
+func getSCIMUser(w http.ResponseWriter, r *http.Request, id int64) {
+	a, err := userStore.Get(id); if err != nil {
+		scimStoreError(w, r, err)
+		return
+	}
+
+	if match := r.Header.Get("If-None-Match"); match != "" && etagMatches(match, a.ETag()) {
+		w.Header().Set("ETag", a.ETag())
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	writeSCIMUser(w, http.StatusOK, a)
+}
+
+func createSCIMUser(w http.ResponseWriter, r *http.Request) {
+	var req SCIMUserRequest
+	if e := decodeSCIM(w, r, &req); e != nil {
+		writeSCIMError(w, e)
+		return
+	}
+
+	var a Account
+	if e := req.apply(&a); e != nil {
+		writeSCIMError(w, e)
+		return
+	}
+
+	//Without a password the user logs in through an identity provider or has an admin reset it
+	if a.Password == "" {
+		a.Password = string(randASCIIBytes(32))
+	}
+
+	err := userStore.Create(&a); if err != nil {
+		scimStoreError(w, r, err)
+		return
+	}
+	adminActionDone("scim_create_user")
+	requestLogger(r, "scim").Info("User provisioned", "target_user_id", a.Id)
+
+	writeSCIMUser(w, http.StatusCreated, &a)
+}
+
+func updateSCIMUser(w http.ResponseWriter, r *http.Request, id int64) {
+	var change func(a *Account) error
+	if r.Method == "PUT" {
+		var req SCIMUserRequest
+		if e := decodeSCIM(w, r, &req); e != nil {
+			writeSCIMError(w, e)
+			return
+		}
+		change = func(a *Account) error {
+			if e := req.apply(a); e != nil {
+				return e
+			}
+			return nil
+		}
+	} else {
+		var req SCIMPatchRequest
+		if e := decodeSCIM(w, r, &req); e != nil {
+			writeSCIMError(w, e)
+			return
+		}
+		if e := req.validate(); e != nil {
+			writeSCIMError(w, e)
+			return
+		}
+		change = func(a *Account) error {
+			if e := applyUserPatch(a, req.Operations); e != nil {
+				return e
+			}
+			return nil
+		}
+	}
+
+	ifMatch := r.Header.Get("If-Match")
+	a, err := userStore.Update(r, id, func(a *Account) error {
+		if !etagMatches(ifMatch, a.ETag()) {
+			return errSCIMPrecondition
+		}
+		return change(a)
+	}); if err != nil {
+		scimStoreError(w, r, err)
+		return
+	}
+	adminActionDone("scim_update_user")
+	requestLogger(r, "scim").Info("User updated", "target_user_id", a.Id, "active", a.Active)
+
+	writeSCIMUser(w, http.StatusOK, a)
+}
+
+func deleteSCIMUser(w http.ResponseWriter, r *http.Request, id int64) {
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		a, err := userStore.Get(id); if err != nil {
+			scimStoreError(w, r, err)
+			return
+		}
+		if !etagMatches(ifMatch, a.ETag()) {
+			writeSCIMError(w, errSCIMPrecondition)
+			return
+		}
+	}
+
+	err := userStore.Delete(r, id); if err != nil {
+		scimStoreError(w, r, err)
+		return
+	}
+	adminActionDone("scim_delete_user")
+	requestLogger(r, "scim").Info("User deprovisioned", "target_user_id", id)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type SCIMGroup struct {
+	Schemas []string `json:"schemas"`
+	Id string `json:"id"`
+	DisplayName string `json:"displayName"`
+	Members []SCIMRef `json:"members,omitempty"`
+	Meta SCIMMeta `json:"meta"`
+}
+
+//Lists the members of a group, everyone is in users
+func groupMembers(group string) ([]*Account, error) {
+	filter := &AccountFilter{}
+	if group == scimAdminsGroup {
+		admin := true
+		filter.Admin = &admin
+	}
+
+	var members []*Account
+	for offset := 0; ; offset += scimMaxResults {
+		page, total, err := userStore.List(filter, offset, scimMaxResults); if err != nil {
+			return nil, err
+		}
+		members = append(members, page...)
+		if len(members) >= total || len(page) == 0 {
+			return members, nil
+		}
+	}
+}
+
+func scimGroup(group string, members []*Account, withMembers bool) *SCIMGroup {
+	g := &SCIMGroup{
+		Schemas: []string{scimGroupSchema},
+		Id: group,
+		DisplayName: group,
+		Meta: SCIMMeta{
+			ResourceType: "Group",
+			Location: scimLocation("Groups", group),
+		},
+	}
+
+	var ids strings.Builder
+	for _, m := range members {
+		id := strconv.FormatInt(m.Id, 10)
+		ids.WriteString(id + ",")
+		if withMembers {
+			g.Members = append(g.Members, SCIMRef{Value: id, Display: m.Name, Ref: scimLocation("Users", id)})
+		}
+	}
+	g.Meta.Version = weakETag(group + "\x00" + ids.String())
+
+	return g
+}
+
+func scimGroupsHandler(w http.ResponseWriter, r *http.Request) {
+	group := scimResourceId(r, "Groups")
+	withMembers := !strings.Contains(r.URL.Query().Get("excludedAttributes"), "members")
+
+	if group == "" {
+		if r.Method == "POST" {
+			writeSCIMError(w, scimError(http.StatusNotImplemented, "", "Groups are fixed, Portal only has users and admins"))
+			return
+		}
+		if r.Method != "GET" {
+			scimMethodNotAllowed(w, "GET")
+			return
+		}
+		listSCIMGroups(w, r, withMembers)
+		return
+	}
+
+	if group != scimUsersGroup && group != scimAdminsGroup {
+		writeSCIMError(w, errSCIMGroupNotFound)
+		return
+	}
+
+	members, err := groupMembers(group); if err != nil {
+		scimStoreError(w, r, err)
+		return
+	}
+	g := scimGroup(group, members, withMembers)
+
+	switch r.Method {
+	case "GET":
+		if match := r.Header.Get("If-None-Match"); match != "" && etagMatches(match, g.Meta.Version) {
+			w.Header().Set("ETag", g.Meta.Version)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", g.Meta.Version)
+		writeSCIM(w, http.StatusOK, g)
+	case "PUT", "PATCH":
+		if !etagMatches(r.Header.Get("If-Match"), g.Meta.Version) {
+			writeSCIMError(w, errSCIMPrecondition)
+			return
+		}
+		if group == scimUsersGroup {
+			writeSCIMError(w, scimError(http.StatusBadRequest, "mutability", "Every user is in users, deactivate or delete the user instead"))
+			return
+		}
+		updateSCIMAdmins(w, r)
+	case "DELETE":
+		writeSCIMError(w, scimError(http.StatusNotImplemented, "", "Groups are fixed, Portal only has users and admins"))
+	default:
+		scimMethodNotAllowed(w, "GET, PUT, PATCH")
+	}
+}
+
+func listSCIMGroups(w http.ResponseWriter, r *http.Request, withMembers bool) {
+	comparisons, e := parseSCIMFilter(r.URL.Query().Get("filter")); if e != nil {
+		writeSCIMError(w, e)
+		return
+	}
+
+	resources := make([]interface{}, 0)
+	for _, group := range []string{scimUsersGroup, scimAdminsGroup} {
+		matches := true
+		for attribute, value := range comparisons {
+			if attribute != "id" && attribute != "displayname" {
+				writeSCIMError(w, scimError(http.StatusBadRequest, "invalidFilter", "Can't filter by " + attribute))
+				return
+			}
+			matches = matches && value == group
+		}
+		if !matches {
+			continue
+		}
+
+		members, err := groupMembers(group); if err != nil {
+			scimStoreError(w, r, err)
+			return
+		}
+		resources = append(resources, scimGroup(group, members, withMembers))
+	}
+
+	start, count := scimPage(r)
+	total := len(resources)
+	if start > total {
+		resources = resources[:0]
+	} else {
+		resources = resources[start - 1:]
+	}
+	if count < len(resources) {
+		resources = resources[:count]
+	}
+
+	writeSCIM(w, http.StatusOK, scimList(total, start, resources))
+}
+
+func parseMemberIds(value json.RawMessage) ([]int64, *SCIMError) {
+	var members []SCIMRef
+	if json.Unmarshal(value, &members) != nil {
+		return nil, scimError(http.StatusBadRequest, "invalidValue", "members must be a list of {\"value\": \"<user id>\"}")
+	}
+
+	ids := make([]int64, 0, len(members))
+	for _, m := range members {
+		id, err := strconv.ParseInt(m.Value, 10, 32); if err != nil {
+			return nil, scimError(http.StatusBadRequest, "invalidValue", "Unknown member " + strconv.Quote(m.Value))
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+//Works out which users become admins and which stop being admins, then changes them all in
+//one transaction through the user store. The group's ETag is checked again once the admins are
+//locked, so a change made since the client read the group is refused instead of overwritten
+func updateSCIMAdmins(w http.ResponseWriter, r *http.Request) {
+	//Ids the request can add, the current admins are locked anyway
+	var ids []int64
+	var patch []SCIMPatchOperation
+
+	if r.Method == "PUT" {
+		var req struct {
+			DisplayName string `json:"displayName"`
+			Members json.RawMessage `json:"members"`
+		}
+		if e := decodeSCIM(w, r, &req); e != nil {
+			writeSCIMError(w, e)
+			return
+		}
+		if req.DisplayName != "" && req.DisplayName != scimAdminsGroup {
+			writeSCIMError(w, scimError(http.StatusBadRequest, "mutability", "displayName is read only"))
+			return
+		}
+
+		ids = []int64{}
+		if len(req.Members) > 0 {
+			var e *SCIMError
+			ids, e = parseMemberIds(req.Members); if e != nil {
+				writeSCIMError(w, e)
+				return
+			}
+		}
+	} else {
+		var req SCIMPatchRequest
+		if e := decodeSCIM(w, r, &req); e != nil {
+			writeSCIMError(w, e)
+			return
+		}
+		if e := req.validate(); e != nil {
+			writeSCIMError(w, e)
+			return
+		}
+
+		//Whether an id ends up in the group only depends on the operations naming it, so
+		//patching an empty group finds every id the patch can add
+		added := make(map[int64]bool)
+		if e := applyGroupPatch(added, req.Operations); e != nil {
+			writeSCIMError(w, e)
+			return
+		}
+		for id := range added {
+			ids = append(ids, id)
+		}
+		patch = req.Operations
+	}
+
+	changed, err := userStore.SetAdmins(r, ids, func(locked []*Account) (map[int64]bool, error) {
+		var admins []*Account
+		found := make(map[int64]bool)
+		for _, a := range locked {
+			found[a.Id] = true
+			if a.Admin {
+				admins = append(admins, a)
+			}
+		}
+
+		if !etagMatches(r.Header.Get("If-Match"), scimGroup(scimAdminsGroup, admins, false).Meta.Version) {
+			return nil, errSCIMPrecondition
+		}
+
+		wanted := make(map[int64]bool)
+		if r.Method == "PUT" {
+			for _, id := range ids {
+				wanted[id] = true
+			}
+		} else {
+			for _, a := range admins {
+				wanted[a.Id] = true
+			}
+			if e := applyGroupPatch(wanted, patch); e != nil {
+				return nil, e
+			}
+		}
+
+		for id := range wanted {
+			if !found[id] {
+				return nil, scimError(http.StatusBadRequest, "invalidValue", "Unknown member " + strconv.FormatInt(id, 10))
+			}
+		}
+		return wanted, nil
+	}); if err != nil {
+		scimStoreError(w, r, err)
+		return
+	}
+
+	for _, a := range changed {
+		if a.Admin {
+			requestLogger(r, "scim").Info("Admin rights granted", "target_user_id", a.Id)
+		} else {
+			requestLogger(r, "scim").Info("Admin rights revoked", "target_user_id", a.Id)
+		}
+	}
+	adminActionDone("scim_update_group")
+
+	members, err := groupMembers(scimAdminsGroup); if err != nil {
+		scimStoreError(w, r, err)
+		return
+	}
+	g := scimGroup(scimAdminsGroup, members, true)
+	w.Header().Set("ETag", g.Meta.Version)
+	writeSCIM(w, http.StatusOK, g)
+}
+
+//Membership changes on a set of user ids. Members are removed either by
+//value or with a members[value eq "<id>"] path
+func applyGroupPatch(members map[int64]bool, ops []SCIMPatchOperation) *SCIMError {
+	for _, op := range ops {
+		path := op.Path
+		value := op.Value
+
+		if path == "" && op.Op != "remove" {
+			var attributes map[string]json.RawMessage
+			if json.Unmarshal(op.Value, &attributes) != nil {
+				return scimError(http.StatusBadRequest, "invalidValue", "Operations without a path need an object value")
+			}
+			for attribute, v := range attributes {
+				if strings.EqualFold(attribute, "displayName") {
+					return scimError(http.StatusBadRequest, "mutability", "displayName is read only")
+				}
+				if strings.EqualFold(attribute, "members") {
+					path, value = "members", v
+				}
+			}
+			if path == "" {
+				continue
+			}
+		}
+
+		lower := strings.ToLower(path)
+		if strings.HasPrefix(lower, "members[") && strings.HasSuffix(lower, "]") && op.Op == "remove" {
+			comparisons, e := parseSCIMFilter(path[len("members["):len(path) - 1]); if e != nil {
+				return e
+			}
+			id, err := strconv.ParseInt(comparisons["value"], 10, 32); if err != nil || len(comparisons) != 1 {
+				return scimError(http.StatusBadRequest, "invalidFilter", "Members are selected with value eq \"<user id>\"")
+			}
+			delete(members, id)
+			continue
+		}
+
+		if lower == "displayname" {
+			return scimError(http.StatusBadRequest, "mutability", "displayName is read only")
+		}
+		if lower != "members" {
+			return scimError(http.StatusBadRequest, "invalidPath", "Only members can be changed")
+		}
+
+		if op.Op == "remove" && len(value) == 0 {
+			for id := range members {
+				delete(members, id)
+			}
+			continue
+		}
+
+		ids, e := parseMemberIds(value); if e != nil {
+			return e
+		}
+		if op.Op == "replace" {
+			for id := range members {
+				delete(members, id)
+			}
+		}
+		for _, id := range ids {
+			if op.Op == "remove" {
+				delete(members, id)
+			} else {
+				members[id] = true
+			}
+		}
+	}
+	return nil
+}
+
+type scimSupported struct {
+	Supported bool `json:"supported"`
+}
+
+type scimFilterSupport struct {
+	Supported bool `json:"supported"`
+	MaxResults int `json:"maxResults"`
+}
+
+type scimBulkSupport struct {
+	Supported bool `json:"supported"`
+	MaxOperations int `json:"maxOperations"`
+	MaxPayloadSize int `json:"maxPayloadSize"`
+}
+
+type scimAuthenticationScheme struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+	Description string `json:"description"`
+}
+
+type SCIMServiceProviderConfig struct {
+	Schemas []string `json:"schemas"`
+	Patch scimSupported `json:"patch"`
+	Bulk scimBulkSupport `json:"bulk"`
+	Filter scimFilterSupport `json:"filter"`
+	ChangePassword scimSupported `json:"changePassword"`
+	Sort scimSupported `json:"sort"`
+	ETag scimSupported `json:"etag"`
+	AuthenticationSchemes []scimAuthenticationScheme `json:"authenticationSchemes"`
+}
+
+func scimServiceProviderConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		scimMethodNotAllowed(w, "GET")
+		return
+	}
+
+	writeSCIM(w, http.StatusOK, &SCIMServiceProviderConfig{
+		Schemas: []string{scimConfigSchema},
+		Patch: scimSupported{Supported: true},
+		Filter: scimFilterSupport{Supported: true, MaxResults: scimMaxResults},
+		ChangePassword: scimSupported{Supported: true},
+		ETag: scimSupported{Supported: true},
+		AuthenticationSchemes: []scimAuthenticationScheme{{
+			Type: "oauthbearertoken",
+			Name: "Bearer token",
+			Description: "The token whose SHA-256 is token_hash under [scim]",
+		}},
+	})
+}
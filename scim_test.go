@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSCIMFilter(t *testing.T) {
+	f, e := userFilter(`userName eq "shiba" and ACTIVE eq true`); if e != nil {
+		t.Fatal("Filter was refused", e.Detail)
+	}
+	if *f.Name != "shiba" || !*f.Active || f.ExternalId != nil {
+		t.Fatal("Unexpected filter", f)
+	}
+
+	f, e = userFilter(`externalId eq "hr \"42\" and more"`); if e != nil || *f.ExternalId != `hr "42" and more` {
+		t.Fatal("Quoted value was not parsed")
+	}
+
+	if f, e := userFilter(""); e != nil || f.Name != nil {
+		t.Fatal("Empty filter should match everyone")
+	}
+
+	for _, filter := range []string{`userName sw "s"`, `userName eq`, `userName eq "a" and`, `userName eq "a" or id eq "1"`, `emails eq "a"`, `userName eq "a`, `active eq maybe`} {
+		if _, e := userFilter(filter); e == nil || e.ScimType != "invalidFilter" {
+			t.Fatal("Unsupported filter was accepted", filter)
+		}
+	}
+}
+
+func TestSCIMUserPatch(t *testing.T) {
+	a := &Account{Id: 7, Name: "shiba", Active: true, ExternalId: "hr-1"}
+	etag := a.ETag()
+
+	var req SCIMPatchRequest
+	json.Unmarshal([]byte(`{"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"], "Operations": [
+		{"op": "Replace", "path": "active", "value": "False"},
+		{"op": "replace", "value": {"userName": "shiba2", "name.givenName": "Shiba"}},
+		{"op": "remove", "path": "externalId"}
+	]}`), &req)
+	if e := req.validate(); e != nil {
+		t.Fatal("Patch was refused", e.Detail)
+	}
+	if e := applyUserPatch(a, req.Operations); e != nil {
+		t.Fatal("Patch was not applied", e.Detail)
+	}
+
+	if a.Active || a.Name != "shiba2" || a.ExternalId != "" || a.ETag() == etag {
+		t.Fatal("Unexpected user after patch", a)
+	}
+
+	if e := applyUserPatch(a, []SCIMPatchOperation{{Op: "replace", Path: "id", Value: json.RawMessage(`"8"`)}}); e == nil || e.ScimType != "mutability" {
+		t.Fatal("Read only attribute was changed")
+	}
+
+	if e := applyUserPatch(a, []SCIMPatchOperation{{Op: "replace", Path: "userName", Value: json.RawMessage(`"has space"`)}}); e == nil || e.ScimType != "invalidValue" {
+		t.Fatal("Invalid userName was accepted")
+	}
+
+	req = SCIMPatchRequest{Operations: []SCIMPatchOperation{{Op: "move"}}}
+	if e := req.validate(); e == nil {
+		t.Fatal("Unknown op was accepted")
+	}
+}
+
+func TestSCIMGroupPatch(t *testing.T) {
+	members := map[int64]bool{1: true, 2: true}
+
+	var req SCIMPatchRequest
+	json.Unmarshal([]byte(`{"Operations": [
+		{"op": "add", "path": "members", "value": [{"value": "3"}, {"value": "4"}]},
+		{"op": "remove", "path": "members[value eq \"1\"]"},
+		{"op": "remove", "path": "members", "value": [{"value": "4"}]}
+	]}`), &req)
+	req.validate()
+	if e := applyGroupPatch(members, req.Operations); e != nil {
+		t.Fatal("Group patch was not applied", e.Detail)
+	}
+	if len(members) != 2 || !members[2] || !members[3] {
+		t.Fatal("Unexpected members", members)
+	}
+
+	if e := applyGroupPatch(members, []SCIMPatchOperation{{Op: "replace", Value: json.RawMessage(`{"members": [{"value": "9"}]}`)}}); e != nil || len(members) != 1 || !members[9] {
+		t.Fatal("Members were not replaced", members)
+	}
+
+	if e := applyGroupPatch(members, []SCIMPatchOperation{{Op: "replace", Path: "displayName", Value: json.RawMessage(`"root"`)}}); e == nil || e.ScimType != "mutability" {
+		t.Fatal("Group was renamed")
+	}
+
+	if e := applyGroupPatch(members, []SCIMPatchOperation{{Op: "add", Path: "members", Value: json.RawMessage(`[{"value": "nobody"}]`)}}); e == nil {
+		t.Fatal("Member that isn't a user id was accepted")
+	}
+}
+
+func TestSCIMAuthentication(t *testing.T) {
+	saved := config.SCIM
+	defer func() { config.SCIM = saved }()
+	config.SCIM.TokenHash = hashToken("provisioning")
+
+	handler := scimAuthMiddleware(http.HandlerFunc(scimServiceProviderConfigHandler))
+
+	for _, token := range []string{"", "wrong", hashToken("provisioning")} {
+		r := httptest.NewRequest("GET", "/scim/v2/ServiceProviderConfig", nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer " + token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+
+		var e SCIMError
+		json.NewDecoder(rec.Body).Decode(&e)
+		if rec.Code != 401 || e.Status != "401" || e.Schemas[0] != scimErrorSchema || rec.Header().Get("WWW-Authenticate") == "" {
+			t.Fatal("Wrong token was accepted", token, rec.Code)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/scim/v2/ServiceProviderConfig", nil)
+	r.Header.Set("Authorization", "Bearer provisioning")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+
+	var spc SCIMServiceProviderConfig
+	json.NewDecoder(rec.Body).Decode(&spc)
+	if rec.Code != 200 || rec.Header().Get("Content-Type") != scimContentType || !spc.Patch.Supported || !spc.ETag.Supported {
+		t.Fatal("Service provider config was not served", rec.Code)
+	}
+}
+
+func TestSCIMPagingAndETags(t *testing.T) {
+	start, count := scimPage(httptest.NewRequest("GET", "/scim/v2/Users?startIndex=0&count=5000", nil))
+	if start != 1 || count != scimMaxResults {
+		t.Fatal("Paging was not clamped", start, count)
+	}
+
+	start, count = scimPage(httptest.NewRequest("GET", "/scim/v2/Users?startIndex=11&count=10", nil))
+	if start != 11 || count != 10 {
+		t.Fatal("Unexpected page", start, count)
+	}
+
+	a := &Account{Id: 1, Name: "shiba", Active: true}
+	if !etagMatches("", a.ETag()) || !etagMatches("*", a.ETag()) || !etagMatches(`W/"x", ` + a.ETag(), a.ETag()) {
+		t.Fatal("Matching ETag was refused")
+	}
+
+	stale := a.ETag()
+	a.Admin = true
+	if etagMatches(stale, a.ETag()) {
+		t.Fatal("Stale ETag matched")
+	}
+}
@@ -0,0 +1,6 @@
+#!/bin/sh
+
+set -e
+
+# Needs protoc, protoc-gen-go and protoc-gen-go-grpc on the PATH
+protoc --proto_path=portalpb --go_out=portalpb --go_opt=paths=source_relative --go-grpc_out=portalpb --go-grpc_opt=paths=source_relative portal.proto
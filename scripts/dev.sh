@@ -1,2 +1,2 @@
 psql -d portal -a -f sql/test.sql
-go run server.go middleware.go
+go run $(ls *.go | grep -v _test.go)
@@ -1,3 +1,10 @@
 go get github.com/BurntSushi/toml
 go get github.com/lib/pq
 go get github.com/robfig/cron
+go get github.com/prometheus/client_golang/prometheus
+go get github.com/beevik/etree
+go get github.com/russellhaering/goxmldsig
+go get github.com/coreos/go-oidc/v3/oidc
+go get golang.org/x/oauth2
+go get google.golang.org/grpc
+go get google.golang.org/protobuf
@@ -3,7 +3,6 @@ package main
 import (
 	"log"
 	"database/sql"
-	"encoding/json"
 	"net/http"
 	"io/ioutil"
 	"html/template"
@@ -13,12 +12,32 @@ import (
 	"github.com/BurntSushi/toml"
 	"github.com/robfig/cron"
 	"crypto/rand"
+	"crypto/subtle"
+	"sync"
 	_ "github.com/lib/pq"
 )
 
 type Config struct {
 	Port string
 	Domain string
+	AllowedOrigins []string `toml:"allowed_origins"`
+	TLS TLSConfig
+	Server ServerConfig
+	Session SessionConfig
+	Log LogConfig
+	SecurityHeaders SecurityHeadersConfig `toml:"security_headers"`
+	Tokens TokensConfig
+	SAML SAMLConfig
+	OIDC map[string]OIDCProviderConfig `toml:"oidc"`
+	SCIM SCIMConfig
+	Webhooks WebhooksConfig
+	GRPC GRPCConfig `toml:"grpc"`
+	Metrics MetricsConfig
+}
+
+type SessionConfig struct {
+	Lifetime Duration
+	GCInterval Duration `toml:"gc_interval"`
 }
 
 func loadConfig() *Config {
@@ -26,7 +45,34 @@ func loadConfig() *Config {
 		log.Fatal(err.Error())
 	}
 
-	var config Config
+	config := Config{
+		Server: ServerConfig{
+			ReadTimeout: Duration{10 * time.Second},
+			WriteTimeout: Duration{30 * time.Second},
+			IdleTimeout: Duration{2 * time.Minute},
+			ShutdownTimeout: Duration{30 * time.Second},
+		},
+		Session: SessionConfig{
+			Lifetime: Duration{2 * time.Hour},
+			GCInterval: Duration{2 * time.Hour},
+		},
+		Log: LogConfig{
+			Level: "info",
+		},
+		Tokens: TokensConfig{
+			Lifetime: Duration{5 * time.Minute},
+			RotationInterval: Duration{24 * time.Hour},
+		},
+		SAML: SAMLConfig{
+			AssertionLifetime: Duration{5 * time.Minute},
+		},
+		Webhooks: WebhooksConfig{
+			PollInterval: Duration{10 * time.Second},
+			Timeout: Duration{10 * time.Second},
+			MaxAttempts: 12,
+			RetentionDays: 30,
+		},
+	}
 	_, err = toml.Decode(string(tomlData), &config); if err != nil {
 		log.Fatal(err.Error())
 	}
@@ -75,47 +121,40 @@ func dbConnection() *sql.DB {
 
 var db *sql.DB = dbConnection()
 
+//Every prepared statement is kept so they can be closed on shutdown
+var statements []*sql.Stmt
+
 func prepareQuery(filename string) *sql.Stmt {
 	content, err := ioutil.ReadFile(filename); if err != nil {
-		log.Fatal(err.Error())
+		fatal(logger.With("component", "db", "query", filename), "Reading query failed", err)
 	}
 
 	stmt, err := db.Prepare(string(content)); if err != nil {
-		log.Fatal(err.Error())
+		fatal(logger.With("component", "db", "query", filename), "Preparing query failed", err)
 	}
 
+	statements = append(statements, stmt)
 	return stmt
 }
 
-type Apps struct{
-	Map map[string]string
-	List []string
-}
-
-func loadApps() *Apps {
-	tomlData, err := ioutil.ReadFile("apps.toml"); if err != nil {
-		log.Fatal(err.Error())
-	}
-	
-	var apps map[string]string
-	_, err = toml.Decode(string(tomlData), &apps); if err != nil {
-		log.Fatal(err.Error())
+//Brings tables created by an older Portal up to date, before any query is prepared against them.
+//Safe to run on every start, and instances starting together take turns
+func migrate() {
+	l := logger.With("component", "db")
+	content, err := ioutil.ReadFile("sql/migrate.sql"); if err != nil {
+		fatal(l, "Reading migration failed", err)
 	}
 
-	appNames := make([]string, 0)
-	for k, _ := range apps {
-		appNames = append(appNames, k)
-	}
-
-	return &Apps{
-		Map: apps,
-		List: appNames,
+	_, err = db.Exec(string(content)); if err != nil {
+		fatal(l, "Migrating database failed", err)
 	}
 }
 
-func (a *Apps) Get(app string) (string, bool) {
-	v, ok := a.Map[app]
-	return v, ok
+func closeStatements() {
+	for _, stmt := range statements {
+		stmt.Close()
+	}
+	statements = nil
 }
 
 var apps *Apps = loadApps()
@@ -129,90 +168,282 @@ type ActiveUser struct{
 	Id int64 `json:"id"`
 	AccessToken string `json:"accessToken"`
 	Name string `json:"name"`
+	CSRFToken string `json:"csrfToken"`
 	LoginAt time.Time
+	SessionId string `json:"sessionId"`
+	TokenHash string `json:"-"`
+	LastSeen time.Time `json:"-"`
+	IP string `json:"-"`
+	UserAgent string `json:"-"`
+	LoginMethod string `json:"-"`
+	//Apps the session has been used with, they get a back-channel logout when it ends
+	Apps []string `json:"-"`
 }
 
 func (a *ActiveUser) Expired(now time.Time) bool {
-	dif := a.LoginAt.Sub(now)
-	return dif.Hours() < 2//TODO: Should be a configurable parameter
+	return now.Sub(a.LoginAt) > config.Session.Lifetime.Duration
 }
 
-type ActiveUsers map[string]*ActiveUser
+//Sessions keyed by the hash of their access token, the token itself is never stored
+type ActiveUsers struct{
+	mu sync.RWMutex
+	users map[string]*ActiveUser
+	cron *cron.Cron
+	closed bool
+}
 
-var activeUsers ActiveUsers = make(ActiveUsers)
+var activeUsers *ActiveUsers = &ActiveUsers{users: make(map[string]*ActiveUser)}
 
-func (a ActiveUsers) GarbageCollect() {
-	c := cron.New()
-	c.AddFunc("@every 2h", func() {//TODO: Should be a configurable parameter
-		now := time.Now()
-		for token, user := range a {
-			if user.Expired(now) {
-				delete(a, token)
-			}
+func (a *ActiveUsers) Get(token string) (*ActiveUser, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	au, ok := a.users[hashToken(token)]
+	return au, ok
+}
+
+func (a *ActiveUsers) Len() int {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return len(a.users)
+}
+
+func (a *ActiveUsers) Add(au *ActiveUser) {
+	stored := *au
+	stored.TokenHash = hashToken(au.AccessToken)
+	stored.AccessToken = ""
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.users[stored.TokenHash] = &stored
+}
+
+//Records activity on a session, used for the last seen time in session listings
+func (a *ActiveUsers) Touch(token string, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if au, ok := a.users[hashToken(token)]; ok {
+		au.LastSeen = now
+	}
+}
+
+func (a *ActiveUser) UsedWith(app string) bool {
+	for _, used := range a.Apps {
+		if used == app {
+			return true
 		}
-	})
-	c.Start()
+	}
+	return false
 }
 
-func verifyAccessToken(token string) bool {
-	au, ok := activeUsers[token]
-	return ok && au.Expired(time.Now())
+//Records that a session was used with app. The slice is replaced rather than appended to in
+//place, so snapshots taken by ListUser never see it change
+func (a *ActiveUsers) UsedBy(token string, app string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	au, ok := a.users[hashToken(token)]; if ok {
+		au.markUsed(app)
+	}
 }
 
-func verifyUserAccess(token string, id int64) bool {
-	au, ok := activeUsers[token]; if !ok {
-		return false
+//Like UsedBy for a session known by its public id, only if it belongs to user id
+func (a *ActiveUsers) SessionUsedBy(id int64, sessionId string, app string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, au := range a.users {
+		if au.SessionId == sessionId && au.Id == id {
+			au.markUsed(app)
+			return
+		}
 	}
+}
 
-	if au.Id != id {
-		return false
+//Callers hold the write lock
+func (au *ActiveUser) markUsed(app string) {
+	if au.UsedWith(app) {
+		return
 	}
+	au.Apps = append(append(make([]string, 0, len(au.Apps) + 1), au.Apps...), app)
+}
 
-	return true
+//Snapshot of a user's sessions, copies so callers can read them without the lock
+func (a *ActiveUsers) ListUser(id int64) []ActiveUser {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	sessions := make([]ActiveUser, 0)
+	for _, au := range a.users {
+		if au.Id == id {
+			sessions = append(sessions, *au)
+		}
+	}
+	return sessions
 }
 
-const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+//Whether user id still has the session, signed tokens name it but outlive a logout otherwise
+func (a *ActiveUsers) HasSession(id int64, sessionId string, now time.Time) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, au := range a.users {
+		if au.SessionId == sessionId && au.Id == id {
+			return !au.Expired(now)
+		}
+	}
+	return false
+}
 
-//Taken from here: https://medium.com/@kpbird/golang-generate-fixed-size-random-string-dd6dbd5e63c0
-func randASCIIBytes(n int) []byte {
-	output := make([]byte, n)
+//Revokes a session by its public id, only if it belongs to user id
+func (a *ActiveUsers) DeleteSession(id int64, sessionId string) bool {
+	a.mu.Lock()
+	var removed []ActiveUser
+	for token, au := range a.users {
+		if au.SessionId == sessionId && au.Id == id {
+			delete(a.users, token)
+			removed = append(removed, *au)
+			break
+		}
+	}
+	a.mu.Unlock()
 
-	// We will take n bytes, one byte for each character of output.
-	randomness := make([]byte, n)
+	sessionsRevoked(id, removed)
+	return len(removed) > 0
+}
+
+func (a *ActiveUsers) Delete(token string) bool {
+	a.mu.Lock()
+	hash := hashToken(token)
+	au, ok := a.users[hash]
+	delete(a.users, hash)
+	a.mu.Unlock()
+
+	if ok {
+		sessionsRevoked(au.Id, []ActiveUser{*au})
+	}
+	return ok
+}
 
-	// read all random
-	_, err := rand.Read(randomness)
-	if err != nil {
-		panic(err)
+//Revokes every session of a user except the one with token keep, which may be empty
+func (a *ActiveUsers) DeleteUser(id int64, keep string) int {
+	keepHash := ""
+	if keep != "" {
+		keepHash = hashToken(keep)
 	}
 
-	l := len(letterBytes)
-	// fill output
-	for pos := range output {
-		// get random item
-		random := uint8(randomness[pos])
+	a.mu.Lock()
+	var removed []ActiveUser
+	for hash, user := range a.users {
+		if user.Id == id && hash != keepHash {
+			delete(a.users, hash)
+			removed = append(removed, *user)
+		}
+	}
+	a.mu.Unlock()
 
-		// random % 64
-		randomPos := random % uint8(l)
+	sessionsRevoked(id, removed)
+	return len(removed)
+}
 
-		// put into output
-		output[pos] = letterBytes[randomPos]
+//Drops expired sessions. Expiry is no revocation so no webhook is sent, but apps still get a back-channel logout
+func (a *ActiveUsers) sweep(now time.Time) int {
+	a.mu.Lock()
+	var expired []ActiveUser
+	for token, user := range a.users {
+		if user.Expired(now) {
+			delete(a.users, token)
+			expired = append(expired, *user)
+		}
+	}
+	a.mu.Unlock()
+
+	backchannelLogout(expired)
+	return len(expired)
+}
+
+func (a *ActiveUsers) GarbageCollect() {
+	a.cron = cron.New()
+	a.cron.AddFunc(fmt.Sprintf("@every %s", config.Session.GCInterval.Duration), func() {
+		now := time.Now()
+		collected := a.sweep(now)
+		gcSwept(collected, now)
+		logger.Info("Session garbage collected", "component", "session", "collected", collected, "remaining", a.Len())
+	})
+	a.cron.Start()
+}
+
+//Stops the garbage collector and drops every session so no token outlives the process.
+//Runs before the webhook queue closes, so apps still get a back-channel logout for each
+func (a *ActiveUsers) Close() {
+	if a.cron != nil {
+		a.cron.Stop()
+	}
+
+	a.mu.Lock()
+	dropped := make([]ActiveUser, 0, len(a.users))
+	for _, au := range a.users {
+		dropped = append(dropped, *au)
+	}
+	a.users = make(map[string]*ActiveUser)
+	a.closed = true
+	a.mu.Unlock()
+
+	backchannelLogout(dropped)
+}
+
+func (a *ActiveUsers) Ping() error {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		return fmt.Errorf("Session store is closed")
+	}
+	return nil
+}
+
+const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+//Random letters without modulo bias: bytes at or above the largest multiple of
+//len(letterBytes) are thrown away instead of wrapping onto the first letters
+func randASCIIBytes(n int) []byte {
+	output := make([]byte, 0, n)
+	limit := 256 - 256 % len(letterBytes)
+
+	randomness := make([]byte, n)
+	for len(output) < n {
+		_, err := rand.Read(randomness)
+		if err != nil {
+			panic(err)
+		}
+
+		for _, random := range randomness {
+			if int(random) >= limit {
+				continue
+			}
+
+			output = append(output, letterBytes[int(random) % len(letterBytes)])
+			if len(output) == n {
+				break
+			}
+		}
 	}
 
 	return output
 }
 
-func activateUser(user *User) *ActiveUser {
-	var token string = string(randASCIIBytes(10))
+func activateUser(user *User, r *http.Request, method string) *ActiveUser {
+	var token string = newSessionToken()
+	now := time.Now()
 	
 	au := &ActiveUser{
 		Id: user.Id,
 		Name: user.Name,
 		AccessToken: token,
-		LoginAt: time.Now(),
+		CSRFToken: newCSRFToken(),
+		LoginAt: now,
+		SessionId: newSessionId(),
+		LastSeen: now,
+		IP: remoteIP(r),
+		UserAgent: r.UserAgent(),
+		LoginMethod: method,
 	}
 	
-	activeUsers[token] = au
+	activeUsers.Add(au)
 	return au
 }
 
@@ -220,14 +451,42 @@ type Welcome struct{
 	Name string
 	Id int64
 	AccessToken string
-	Apps []string
+	CSRFToken string
+	Apps []AppLink
 	Admin bool
+	Nonce string
+}
+
+//Writes the error response and returns false unless the user is an admin
+func requireAdmin(w http.ResponseWriter, r *http.Request, stmt *sql.Stmt, p *Principal) bool {
+	//A personal token only acts as admin when it was made for that
+	if p.TokenType == personalTokenType && !p.HasScope(portalAdminScope) {
+		writeError(w, errInsufficientScope)
+		return false
+	}
+
+	var admin bool
+	err := stmt.QueryRow(p.Id).Scan(&admin); if err == sql.ErrNoRows {
+		//The session outlived its user
+		writeError(w, errInvalidSession)
+		return false
+	} else if err != nil {
+		internalError(w, r, err)
+		return false
+	}
+
+	if !admin {
+		writeError(w, errNotAdmin)
+		return false
+	}
+
+	return true
 }
 
 func welcomePageHandler() http.HandlerFunc {
 	
 	t, err := template.ParseFiles("./static/welcome.html"); if err != nil {
-		log.Fatal(err.Error())
+		fatal(logger.With("component", "http"), "Parsing welcome template failed", err)
 	}
 
 	stmt := prepareQuery("sql/check_admin.sql")
@@ -235,44 +494,64 @@ func welcomePageHandler() http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		
 		q := r.URL.Query()
-		
-		if q["access_token"] == nil || q["user_id"] == nil {
-			http.Error(w, "Must include access_token and user_id in query params to access this page", 401)
-			return			
-			
-		}
 
-		id, err := strconv.ParseInt(q["user_id"][0], 10, 64); if err != nil {
-			http.Error(w, err.Error(), 500)
+		//Logins that redirect here only set the session cookie
+		accessToken := q.Get("access_token")
+		if accessToken == "" {
+			accessToken = sessionToken(r)
+		}
+		if accessToken == "" {
+			writeError(w, unauthorized("missing_token", "Must include access_token in query params or the session cookie to access this page"))
 			return
 		}
 
-		accessToken := q["access_token"][0]		
-		if !verifyUserAccess(accessToken, id) {
-			http.Error(w, "Acccess token unauthorized for user", 401)
+		au, ok := activeUsers.Get(accessToken); if !ok || au.Expired(time.Now()) {
+			writeError(w, errInvalidSession)
 			return
 		}
 
-		au, _ := activeUsers[accessToken]
+		//user_id is redundant with the token, kept for links minted by older login pages
+		if q.Get("user_id") != "" {
+			id, err := strconv.ParseInt(q.Get("user_id"), 10, 64); if err != nil {
+				writeError(w, badRequest("invalid_field", "user_id must be an integer"))
+				return
+			}
+
+			if id != au.Id {
+				writeError(w, errForbiddenUser)
+				return
+			}
+		}
+
+		setLogUser(r, au.Id)
+		activeUsers.Touch(accessToken, time.Now())
 
 		var admin bool
-		err = stmt.QueryRow(au.Id).Scan(&admin); if err != nil {
-			http.Error(w, err.Error(), 401)
+		err := stmt.QueryRow(au.Id).Scan(&admin); if err == sql.ErrNoRows {
+			writeError(w, errInvalidSession)
+			return
+		} else if err != nil {
+			internalError(w, r, err)
 			return
-		}		
+		}
 
-		w.Header().Set("Set-Cookie", au.AccessToken)
+		setSessionCookie(w, r, accessToken)
+
+		//Flows that needed a login first, like a SAML request, pick up where they left off
+		if to, ok := takeReturnTo(w, r); ok {
+			http.Redirect(w, r, to, http.StatusSeeOther)
+			return
+		}
 		
 		t.Execute(w, &Welcome{
 			Name: au.Name,
 			Id: au.Id,
-			AccessToken: au.AccessToken,
-			Apps: apps.List,
+			AccessToken: accessToken,
+			CSRFToken: au.CSRFToken,
+			Apps: apps.Links(au.Name),
 			Admin: admin,
+			Nonce: cspNonce(r),
 		})
-
-		
-		return
 	})
 }
 
@@ -288,170 +567,260 @@ func loginCredentialsHandler() http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
 		var creds Credentials
-		err := json.NewDecoder(r.Body).Decode(&creds); if err != nil {
-			http.Error(w, err.Error(), 400)
+		if apiErr := decodeJSON(w, r, &creds); apiErr != nil {
+			loginFailed("password", "bad_request")
+			writeError(w, apiErr)
 			return
 		}
 
 		var u User
-		err = stmt.QueryRow(creds.UserName, creds.Password).Scan(&u.Id, &u.Name); if err != nil {
-			http.Error(w, err.Error(), 401)
+		err := stmt.QueryRow(creds.UserName, creds.Password).Scan(&u.Id, &u.Name); if err == sql.ErrNoRows {
+			loginFailed("password", "invalid_credentials")
+			requestLogger(r, "auth").Warn("Login failed", "method", "password", "username", creds.UserName, "reason", "invalid_credentials")
+			writeError(w, unauthorized("invalid_credentials", "Username or password is incorrect"))
+			return
+		} else if err != nil {
+			loginFailed("password", "error")
+			internalError(w, r, err)
 			return
 		}
 
-		au := activateUser(&u)
+		au := activateUser(&u, r, "password")
+		loginSucceeded("password")
+		setLogUser(r, u.Id)
+		requestLogger(r, "auth").Info("Login succeeded", "method", "password")
 
-		w.Header().Set("Set-Cookie", au.AccessToken)
+		setSessionCookie(w, r, au.AccessToken)
 		
-		json.NewEncoder(w).Encode(&au)
+		writeJSON(w, http.StatusOK, loginResponse(r, au))
 	})
 }
 
 func registerCredentialsHandler() http.HandlerFunc {
 	
-	stmt := prepareQuery("sql/new_user_credentials.sql")
-	stmt2 := prepareQuery("sql/check_admin.sql")
+	stmt := prepareQuery("sql/check_admin.sql")
 	
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-		var data map[string]string
-		err := json.NewDecoder(r.Body).Decode(&data); if err != nil {
-			http.Error(w, err.Error(), 500)
+		var req RegisterRequest
+		if apiErr := decodeJSON(w, r, &req); apiErr != nil {
+			writeError(w, apiErr)
 			return
 		}
 
-		id, err := strconv.ParseInt(data["id"], 10, 64); if err != nil {
-			http.Error(w, err.Error(), 500)
+		p, ok := actingUser(w, r, req.Id); if !ok {
 			return
 		}
 
-		if !verifyUserAccess(r.Header.Get("Cookie"), id) {
-			http.Error(w, "Access token is not authorized for user", 401)
+		if !requireAdmin(w, r, stmt, p) {
 			return
 		}
 
-		var admin bool
-		err = stmt2.QueryRow(id).Scan(&admin); if err != nil {
-			http.Error(w, err.Error(), 401)
+		err := userStore.Create(&Account{Name: req.UserName, Password: req.Password, Admin: bool(req.Admin), Active: true}); if err != nil {
+			dbError(w, r, err)
 			return
 		}
+		adminActionDone("register")
 
-		newAdmin := false
-		if data["admin"] == "true" {
-			newAdmin = true
-		}
+		writeJSON(w, http.StatusOK, &MessageResponse{Message: "New user has been registered"})
+	})
+}
 
-		_, err = stmt.Exec(data["username"], data["password"], newAdmin); if err != nil {
-			http.Error(w, err.Error(), 500)
-			return
-		}
+var errInvalidApp = unauthorized("invalid_client", "App name or secret is incorrect")
 
-		fmt.Fprintf(w, "%s", "New user has been registered")
-	})
+//Checks an app's own credentials. Unknown apps and wrong secrets must look the same to
+//callers so app names can't be probed, known only tells them apart for metrics and logs
+func checkAppSecret(app string, secret string) (known bool, ok bool) {
+	expected, known := apps.Get(app); if !known {
+		return false, false
+	}
+	return true, subtle.ConstantTimeCompare([]byte(expected), []byte(secret)) == 1
 }
 
-func verifyTokenHandler(w http.ResponseWriter, r *http.Request) {
-	
-	q := r.URL.Query()
-	if q["access_token"] == nil || q["user_id"] == nil || q["secret"] == nil || q["app_name"] == nil {
-		http.Error(w, "Must include access_token, user_id, app_name, and secret in query params to access this page", 401)
-		return	
+//Checks a token a user handed to an authenticated app, shared by /verify/token and the
+//gRPC service. userId is who the app expects the token to belong to, only gRPC callers
+//may leave it nil to ask whose token it is
+//Session, personal and signed user tokens, client tokens are for introspection
+func verifyAppToken(app string, token string, userId *int64) (*Principal, *APIError) {
+	p, ok := tokenPrincipal(token); if !ok || !p.Human() {
+		tokenVerified(app, "unauthorized")
+		return nil, unauthorized("invalid_token", "Access token is unauthorized")
+	}
+
+	if userId != nil && p.Id != *userId {
+		tokenVerified(app, "wrong_user")
+		return nil, errForbiddenUser
+	}
+
+	if !p.AllowsApp(app) {
+		tokenVerified(app, "app_not_allowed")
+		return nil, forbidden("app_not_allowed", "Token is not valid for this app")
 	}
 
-	secret, ok := apps.Get(q["app_name"][0]); if !ok {
-		http.Error(w, "App name is unrecognized", 401)
+	tokenVerified(app, "authorized")
+	if p.TokenType == sessionTokenType {
+		activeUsers.Touch(token, time.Now())
+		activeUsers.UsedBy(token, app)
+	}
+	return p, nil
+}
+
+func verifyTokenHandler(w http.ResponseWriter, r *http.Request) {
+
+	req, apiErr := parseVerifyTokenRequest(r); if apiErr != nil {
+		tokenVerified(req.AppName, "missing_params")
+		writeError(w, apiErr)
 		return
 	}
 
-	if secret != q["secret"][0] {
-		http.Error(w, "Incorrect secret for application", 401)
+	app := req.AppName
+	setLogApp(r, app)
+
+	known, ok := checkAppSecret(app, req.Secret); if !ok {
+		if known {
+			tokenVerified(app, "bad_secret")
+		} else {
+			tokenVerified(app, "unknown_app")
+		}
+		writeError(w, errInvalidApp)
 		return
 	}
 
-	if !verifyAccessToken(q["access_token"][0]) {
-		http.Error(w, "Access token is unauthorized", 401)
+	userId := int64(req.UserId)
+	p, apiErr := verifyAppToken(app, req.AccessToken, &userId); if apiErr != nil {
+		writeError(w, apiErr)
 		return
 	}
 
-	id, err := strconv.ParseInt(q["user_id"][0], 10, 64); if err != nil {
-		http.Error(w, err.Error(), 500)
+	writeJSON(w, http.StatusOK, &VerifyTokenResponse{
+		Message: "Authorized",
+		TokenType: p.TokenType,
+		Scopes: p.Scopes,
+	})
+}
+
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := principalFrom(r); if !ok {
+		writeError(w, errInvalidSession)
 		return
 	}
 
-	if !verifyUserAccess(q["access_token"][0], id) {
-		http.Error(w, "Access token is not authorized for user", 401)
+	activeUsers.Delete(p.Token)
+	clearSessionCookie(w, r)
+	requestLogger(r, "session").Info("Logged out")
+
+	writeJSON(w, http.StatusOK, &MessageResponse{Message: "Logged out"})
+}
+
+func logoutAllHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := principalFrom(r); if !ok {
+		writeError(w, errInvalidSession)
 		return
 	}
 
-	data := make(map[string]string)
-	data["message"]="Authorized"
-	json.NewEncoder(w).Encode(&data)
+	revoked := activeUsers.DeleteUser(p.Id, "")
+	clearSessionCookie(w, r)
+	requestLogger(r, "session").Info("Logged out everywhere", "revoked", revoked)
+
+	writeJSON(w, http.StatusOK, &MessageResponse{Message: "Logged out of every session"})
 }
 
-func updatePasswordHandler() http.HandlerFunc {
-	stmt := prepareQuery("sql/get_password.sql")
-	stmt2 := prepareQuery("sql/update_user_password.sql")
+func userInfoHandler() http.HandlerFunc {
+	stmt := prepareQuery("sql/check_admin.sql")
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-		var data map[string]string
-		err := json.NewDecoder(r.Body).Decode(&data); if err != nil {
-			http.Error(w, err.Error(), 400)
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			writeError(w, &APIError{Status: http.StatusMethodNotAllowed, Code: "method_not_allowed", Message: "This route only accepts GET request"})
 			return
 		}
 
-		id, err := strconv.ParseInt(data["id"], 10, 64); if err != nil {
-			http.Error(w, err.Error(), 500)
+		p, ok := principalFrom(r); if !ok {
+			writeError(w, errInvalidSession)
+			return
+		}
+
+		var admin bool
+		err := stmt.QueryRow(p.Id).Scan(&admin); if err == sql.ErrNoRows {
+			writeError(w, errInvalidSession)
+			return
+		} else if err != nil {
+			internalError(w, r, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, &UserInfoResponse{
+			Id: p.Id,
+			Name: p.Name,
+			Admin: admin,
+		})
+	})
+}
+
+func updatePasswordHandler() http.HandlerFunc {
+	stmt := prepareQuery("sql/get_password.sql")
+	stmt2 := prepareQuery("sql/update_user_password.sql")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		var req UpdatePasswordRequest
+		if apiErr := decodeJSON(w, r, &req); apiErr != nil {
+			writeError(w, apiErr)
 			return
 		}
 		
-		if !verifyUserAccess(r.Header.Get("Cookie"), id) {
-			http.Error(w, "Access token is not authorized for user", 401)
+		p, ok := actingUser(w, r, req.Id); if !ok {
 			return
 		}
 		
 		//get password
 		var password string
-		err = stmt.QueryRow(id).Scan(&password); if err != nil {
-			http.Error(w, err.Error(), 401)
+		err := stmt.QueryRow(p.Id).Scan(&password); if err != nil {
+			dbError(w, r, err)
 			return
 		}
 
-		if password != data["old_password"] {
-			http.Error(w, "Old password is incorrect", 401)
+		if password != req.OldPassword {
+			writeError(w, forbidden("invalid_credentials", "Old password is incorrect"))
 			return
 		}
 
-		_, err = stmt2.Exec(id, data["new_password"]); if err != nil {
-			http.Error(w, err.Error(), 401)
+		_, err = stmt2.Exec(p.Id, req.NewPassword); if err != nil {
+			dbError(w, r, err)
 			return
 		}
+
+		webhooks.Emit(eventPasswordChanged, &UserEventData{UserId: p.Id, Username: p.Name})
+
+		//Whoever knew the old password may still hold a session, keep only the one changing it
+		revoked := activeUsers.DeleteUser(p.Id, p.Token)
+		requestLogger(r, "session").Info("Sessions revoked after password change", "revoked", revoked)
+
+		writeJSON(w, http.StatusOK, &MessageResponse{Message: "Password has been updated"})
 	})
 }
 
 func updateUsernameHandler() http.HandlerFunc {
-	stmt := prepareQuery("sql/update_user_name.sql")
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-		var data map[string]string
-		err := json.NewDecoder(r.Body).Decode(&data); if err != nil {
-			http.Error(w, err.Error(), 400)
-			return
-		}
-
-		id, err := strconv.ParseInt(data["id"], 10, 64); if err != nil {
-			http.Error(w, err.Error(), 500)
+		var req UpdateUsernameRequest
+		if apiErr := decodeJSON(w, r, &req); apiErr != nil {
+			writeError(w, apiErr)
 			return
 		}
 		
-		if !verifyUserAccess(r.Header.Get("Cookie"), id) {
-			http.Error(w, "Access token is not authorized for user", 401)
+		p, ok := actingUser(w, r, req.Id); if !ok {
 			return
 		}
 
-		_, err = stmt.Exec(id, data["username"]); if err != nil {
-			http.Error(w, err.Error(), 401)
+		_, err := userStore.Update(r, p.Id, func(a *Account) error {
+			a.Name = req.UserName
+			return nil
+		}); if err != nil {
+			dbError(w, r, err)
 			return
 		}
+
+		writeJSON(w, http.StatusOK, &MessageResponse{Message: "Username has been updated"})
 	})
 }
 
@@ -460,214 +829,297 @@ func adminNewPasswordHandler() http.HandlerFunc {
 	stmt2 := prepareQuery("sql/update_other_user_password.sql")
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-		var data map[string]string
-		err := json.NewDecoder(r.Body).Decode(&data); if err != nil {
-			http.Error(w, err.Error(), 400)
+		var req AdminUserRequest
+		if apiErr := decodeJSON(w, r, &req); apiErr != nil {
+			writeError(w, apiErr)
 			return
 		}
 
-		id, err := strconv.ParseInt(data["id"], 10, 64); if err != nil {
-			http.Error(w, err.Error(), 500)
+		p, ok := actingUser(w, r, req.Id); if !ok {
 			return
 		}
 
-		if !verifyUserAccess(r.Header.Get("Cookie"), id) {
-			http.Error(w, "Access token is not authorized for user", 401)
-			return
-		}		
-
-		var admin bool
-		err = stmt.QueryRow(id).Scan(&admin); if err != nil {
-			http.Error(w, err.Error(), 401)
-			return
-		}
-
-		if !admin {
-			http.Error(w, "User is not an admin. Unauthorized action.", 401)
+		if !requireAdmin(w, r, stmt, p) {
 			return
 		}
 
 		newPassword := string(randASCIIBytes(10))
 
-		_, err = stmt2.Exec(data["username"], newPassword); if err != nil {
-			http.Error(w, err.Error(), 500)
+		var target int64
+		err := stmt2.QueryRow(req.UserName, newPassword).Scan(&target); if err != nil {
+			dbError(w, r, err)
 			return
 		}
+		adminActionDone("reset_password")
+		webhooks.Emit(eventPasswordChanged, &UserEventData{UserId: target, Username: req.UserName})
 
-		var body map[string]string = make(map[string]string)
-		body["password"] = newPassword
-		json.NewEncoder(w).Encode(&body)
+		revoked := activeUsers.DeleteUser(target, "")
+		requestLogger(r, "session").Info("Sessions revoked after admin password reset", "target_user_id", target, "revoked", revoked)
+
+		writeJSON(w, http.StatusOK, &NewPasswordResponse{Password: newPassword})
 	})
 }
 
 func adminMakeAdminHandler() http.HandlerFunc {
 	stmt := prepareQuery("sql/check_admin.sql")	
-	stmt2 := prepareQuery("sql/update_admin.sql")
+	stmt2 := prepareQuery("sql/get_user_by_name.sql")
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-		var data map[string]string
-		err := json.NewDecoder(r.Body).Decode(&data); if err != nil {
-			http.Error(w, err.Error(), 400)
+		var req AdminUserRequest
+		if apiErr := decodeJSON(w, r, &req); apiErr != nil {
+			writeError(w, apiErr)
 			return
 		}
 
-		id, err := strconv.ParseInt(data["id"], 10, 64); if err != nil {
-			http.Error(w, err.Error(), 500)
+		p, ok := actingUser(w, r, req.Id); if !ok {
 			return
 		}
 
-		if !verifyUserAccess(r.Header.Get("Cookie"), id) {
-			http.Error(w, "Access token is not authorized for user", 401)
-			return
-		}		
-
-		var admin bool
-		err = stmt.QueryRow(id).Scan(&admin); if err != nil {
-			http.Error(w, err.Error(), 401)
+		if !requireAdmin(w, r, stmt, p) {
 			return
 		}
 
-		if !admin {
-			http.Error(w, "User is not an admin. Unauthorized action.", 401)
+		u, ok := targetUser(w, r, stmt2, req.UserName); if !ok {
 			return
 		}
 
-		_, err = stmt2.Exec(data["username"], true); if err != nil {
-			http.Error(w, err.Error(), 500)
+		err := userStore.SetAdmin(r, u.Id, true); if err != nil {
+			dbError(w, r, err)
 			return
 		}
+		adminActionDone("grant_admin")
+
+		writeJSON(w, http.StatusOK, &MessageResponse{Message: "User is now an admin"})
 	})
 }
 
 func adminRevokeAdminHandler() http.HandlerFunc {
 	
 	stmt := prepareQuery("sql/check_admin.sql")
-	stmt2 := prepareQuery("sql/get_user_name.sql")
-	stmt3 := prepareQuery("sql/update_admin.sql")
+	stmt2 := prepareQuery("sql/get_user_by_name.sql")
 	
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-		var data map[string]string
-		err := json.NewDecoder(r.Body).Decode(&data); if err != nil {
-			http.Error(w, err.Error(), 400)
+		var req AdminUserRequest
+		if apiErr := decodeJSON(w, r, &req); apiErr != nil {
+			writeError(w, apiErr)
 			return
 		}
 
-		id, err := strconv.ParseInt(data["id"], 10, 64); if err != nil {
-			http.Error(w, err.Error(), 500)
+		p, ok := actingUser(w, r, req.Id); if !ok {
 			return
 		}
 
-		if !verifyUserAccess(r.Header.Get("Cookie"), id) {
-			http.Error(w, "Access token is not authorized for user", 401)
-			return
-		}		
-
-		var admin bool
-		err = stmt.QueryRow(id).Scan(&admin); if err != nil {
-			http.Error(w, err.Error(), 401)
+		if !requireAdmin(w, r, stmt, p) {
 			return
 		}
 
-		if !admin {
-			http.Error(w, "User is not an admin. Unauthorized action.", 401)
+		u, ok := targetUser(w, r, stmt2, req.UserName); if !ok {
 			return
 		}
 
-		var name string
-		err = stmt2.QueryRow(id).Scan(&name); if err != nil {
-			http.Error(w, err.Error(), 500)
+		if u.Id == p.Id {
+			writeError(w, conflict("cannot_modify_self", "Cannot revoke your own admin rights"))
 			return
 		}
 
-		if data["username"] == name {
-			http.Error(w, err.Error(), 500)
+		err := userStore.SetAdmin(r, u.Id, false); if err != nil {
+			dbError(w, r, err)
 			return
 		}
+		adminActionDone("revoke_admin")
 
-		_, err = stmt3.Exec(data["username"], false); if err != nil {
-			http.Error(w, err.Error(), 500)
-			return
-		}
+		writeJSON(w, http.StatusOK, &MessageResponse{Message: "Admin rights have been revoked"})
 	})
 }
 
 func adminDeleteUserHandler() http.HandlerFunc {
 	
 	stmt := prepareQuery("sql/check_admin.sql")
-	stmt2 := prepareQuery("sql/get_user_name.sql")
-	stmt3 := prepareQuery("sql/delete_user.sql")
+	stmt2 := prepareQuery("sql/get_user_by_name.sql")
 	
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-		var data map[string]string
-		err := json.NewDecoder(r.Body).Decode(&data); if err != nil {
-			http.Error(w, err.Error(), 400)
+		var req AdminUserRequest
+		if apiErr := decodeJSON(w, r, &req); apiErr != nil {
+			writeError(w, apiErr)
 			return
 		}
 
-		id, err := strconv.ParseInt(data["id"], 10, 64); if err != nil {
-			http.Error(w, err.Error(), 500)
+		p, ok := actingUser(w, r, req.Id); if !ok {
 			return
 		}
 
-		if !verifyUserAccess(r.Header.Get("Cookie"), id) {
-			http.Error(w, "Access token is not authorized for user", 401)
-			return
-		}		
-
-		var admin bool
-		err = stmt.QueryRow(id).Scan(&admin); if err != nil {
-			http.Error(w, err.Error(), 401)
+		if !requireAdmin(w, r, stmt, p) {
 			return
 		}
 
-		if !admin {
-			http.Error(w, "User is not an admin. Unauthorized action.", 401)
+		u, ok := targetUser(w, r, stmt2, req.UserName); if !ok {
 			return
 		}
 
-		var name string
-		err = stmt2.QueryRow(id).Scan(&name); if err != nil {
-			http.Error(w, err.Error(), 500)
+		if u.Id == p.Id {
+			writeError(w, conflict("cannot_modify_self", "Cannot delete yourself"))
 			return
 		}
 
-		if data["username"] == name {
-			http.Error(w, "Cannot delete yourself", 500)
+		err := userStore.Delete(r, u.Id); if err != nil {
+			dbError(w, r, err)
 			return
 		}
+		adminActionDone("delete_user")
 
-		_, err = stmt3.Exec(data["username"]); if err != nil {
-			http.Error(w, err.Error(), 500)
-			return
-		}
+		writeJSON(w, http.StatusOK, &MessageResponse{Message: "User has been deleted"})
 	})
 }
 
 func postDefense(h http.HandlerFunc) http.Handler {
-	return originMiddleware(cookieMiddleware(postMiddleware(h)))
+	return originMiddleware(authMiddleware(csrfMiddleware(postMiddleware(h))))
 }
 
 func main() {
+	migrate()
+
 	http.Handle("/", http.FileServer(http.Dir("./static")))
 
 	//Review Cookie Security, may have messed this up...
 	http.Handle("/welcome", welcomePageHandler())
 	
 	http.Handle("/login/credentials", originMiddleware(postMiddleware(loginCredentialsHandler())))
+
+	//Machine users calling this route send no Origin, the client certificate is the proof of intent
+	if certificateLoginEnabled() {
+		http.Handle("/login/certificate", postMiddleware(certificateLoginHandler()))
+	}
+
+	http.HandleFunc("/login/providers", loginProvidersHandler)
+	if len(config.OIDC) > 0 {
+		f, err := newFederation(config.OIDC); if err != nil {
+			fatal(logger.With("component", "oidc"), "Loading identity providers failed", err)
+		}
+		federation = f
+
+		http.HandleFunc("/login/oidc", federation.loginHandler)
+		http.Handle("/login/oidc/callback", federatedCallbackHandler())
+	}
 	
+	http.Handle("/csrf/token", authMiddleware(http.HandlerFunc(csrfTokenHandler)))
+
+	userStore = newUserStore()
+	webhooks = newWebhookQueue()
 	http.Handle("/register/credentials", postDefense(registerCredentialsHandler()))
 	
 	http.HandleFunc("/verify/token", verifyTokenHandler)
+	http.Handle("/user/info", corsMiddleware(appCredentialedCORS, authMiddleware(userInfoHandler())))
+	http.Handle("/session/token", corsMiddleware(appCredentialedCORS, authMiddleware(http.HandlerFunc(sessionSignedTokenHandler))))
+	http.HandleFunc("/.well-known/jwks.json", jwksHandler)
+
+	personalTokens = newPersonalTokenStore()
+	http.Handle("/tokens", authMiddleware(http.HandlerFunc(listPersonalTokensHandler)))
+	http.Handle("/tokens/create", postDefense(createPersonalTokenHandler))
+	http.Handle("/tokens/revoke", postDefense(revokePersonalTokenHandler))
+
+	if config.SAML.Enabled() {
+		idp, err := newSAMLIdentityProvider(&config.SAML); if err != nil {
+			fatal(logger.With("component", "saml"), "Loading SAML signing key failed", err)
+		}
+		samlIdP = idp
+
+		http.HandleFunc("/saml/metadata", samlMetadataHandler)
+		http.Handle("/saml/sso", samlSSOHandler())
+		http.Handle("/saml/launch", samlLaunchHandler())
+	}
+
+	//The provisioning client has a bearer token of its own and sends no cookies
+	if config.SCIM.Enabled() {
+		http.Handle(scimPath + "/Users", scimAuthMiddleware(http.HandlerFunc(scimUsersHandler)))
+		http.Handle(scimPath + "/Users/", scimAuthMiddleware(http.HandlerFunc(scimUsersHandler)))
+		http.Handle(scimPath + "/Groups", scimAuthMiddleware(http.HandlerFunc(scimGroupsHandler)))
+		http.Handle(scimPath + "/Groups/", scimAuthMiddleware(http.HandlerFunc(scimGroupsHandler)))
+		http.Handle(scimPath + "/ServiceProviderConfig", scimAuthMiddleware(http.HandlerFunc(scimServiceProviderConfigHandler)))
+	}
+
+	//Backend clients authenticate with their secret, there is no browser or session involved
+	http.HandleFunc("/oauth/token", oauthTokenHandler)
+	http.HandleFunc("/oauth/introspect", oauthIntrospectHandler)
+	http.HandleFunc("/launch/", launchHandler)
+	http.Handle("/launch/exchange", launchExchangeHandler())
 	
+	http.Handle("/logout", postDefense(logoutHandler))
+	http.Handle("/logout/all", postDefense(logoutAllHandler))
+
+	http.Handle("/sessions", authMiddleware(http.HandlerFunc(listSessionsHandler)))
+	http.Handle("/sessions/revoke", postDefense(revokeSessionHandler))
+	http.Handle("/admin/sessions", authMiddleware(adminListSessionsHandler()))
+	http.Handle("/admin/sessions/revoke", postDefense(adminRevokeSessionHandler()))
+
 	http.Handle("/update/username", postDefense(updateUsernameHandler()))
 	http.Handle("/update/password", postDefense(updatePasswordHandler()))
 	http.Handle("/admin/password", postDefense(adminNewPasswordHandler()))
 	http.Handle("/admin/new", postDefense(adminMakeAdminHandler()))
 	http.Handle("/admin/revoke", postDefense(adminRevokeAdminHandler()))
 	http.Handle("/admin/delete/user", postDefense(adminDeleteUserHandler()))
+	http.Handle("/admin/webhooks", authMiddleware(adminWebhookDeliveriesHandler()))
+	http.Handle("/admin/webhooks/retry", postDefense(adminRetryWebhookHandler()))
+
+	//Probes come from load balancers and orchestrators, never through origin or cookie checks
+	http.HandleFunc("/healthz", healthzHandler)
+	http.Handle("/readyz", readyzHandler())
+
+	handler := requestIDMiddleware(accessLogMiddleware(metricsMiddleware(http.DefaultServeMux, securityHeadersMiddleware(http.DefaultServeMux, http.DefaultServeMux))))
+	l := logger.With("component", "lifecycle")
 	
-	fmt.Println("Running Portal server at port 3333")
-	log.Fatal(http.ListenAndServe(":3333", nil))
+	activeUsers.GarbageCollect()
+	webhooks.Start()
+
+	err := signingKeys.Load(config.Tokens.KeyDir); if err != nil {
+		fatal(l.With("component", "keys"), "Loading signing keys failed", err)
+	}
+	_, err = signingKeys.Rotate(time.Now()); if err != nil {
+		fatal(l.With("component", "keys"), "Generating signing key failed", err)
+	}
+	signingKeys.AutoRotate()
+	startGRPC()
+
+	servers := make([]*http.Server, 0)
+
+	if config.Metrics.Address != "" {
+		metrics := metricsServer(&config.Metrics)
+		servers = append(servers, metrics)
+
+		l.Info("Serving metrics", "address", config.Metrics.Address)
+		go serve(metrics.ListenAndServe)
+	}
+
+	if !config.TLS.Enabled() {
+		server := newServer(config.Port, handler)
+		servers = append(servers, server)
+
+		l.Info("Running Portal server", "port", config.Port)
+		go serve(server.ListenAndServe)
+		waitForShutdown(servers)
+		return
+	}
+
+	tlsConfig, err := newTLSConfig(&config.TLS); if err != nil {
+		fatal(l, "Configuring TLS failed", err)
+	}
+
+	server := newServer(config.Port, hstsMiddleware(handler))
+	server.TLSConfig = tlsConfig
+	servers = append(servers, server)
+
+	if config.TLS.RedirectPort != "" {
+		redirect := newServer(config.TLS.RedirectPort, redirectHandler())
+		servers = append(servers, redirect)
+
+		l.Info("Redirecting HTTP traffic", "port", config.TLS.RedirectPort)
+		go serve(redirect.ListenAndServe)
+	}
+
+	l.Info("Running Portal server with TLS", "port", config.Port)
+	go serve(func() error {
+		return server.ListenAndServeTLS("", "")
+	})
+	waitForShutdown(servers)
 }
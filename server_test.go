@@ -4,10 +4,17 @@ import (
 	"testing"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"io/ioutil"
 	"encoding/json"
 	"bytes"
 	"fmt"
+	"strings"
+	"strconv"
+	"time"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"portal/portalpb"
 )
 
 func checkBody(t *testing.T, r *http.Response) {
@@ -26,8 +33,7 @@ func checkStatusCode(t *testing.T, r *http.Response, message string) {
 func postRequest(url string, data []byte) (*http.Response, error) {
 	client := &http.Client{}
 	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(data))
-	req.Header.Set("Origin", config.Domain)
-	req.Header.Set("Referer", fmt.Sprintf("http://localhost%s", config.Port))
+	req.Header.Set("Origin", allowedOrigins()[0])
 	req.Header.Set("Content-Type", "application/json")
 	resp, err := client.Do(req);
 
@@ -39,10 +45,12 @@ func postRequestToken(url string, data []byte, token string) (*http.Response, er
 	req, err := http.NewRequest("POST", url, bytes.NewBuffer(data)); if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Origin", config.Domain)
-	req.Header.Set("Referer", fmt.Sprintf("http://localhost%s", config.Port))	
+	req.Header.Set("Origin", allowedOrigins()[0])
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Cookie", token)
+	if au, ok := activeUsers.Get(token); ok {
+		req.Header.Set(csrfHeader, au.CSRFToken)
+	}
 	resp, err := client.Do(req);
 
 	return resp, err	
@@ -124,17 +132,17 @@ func verifyToken(t *testing.T, token string) {
 	checkStatusCode(t, resp, "Verifying token failed with")
 	checkBody(t, resp)	
 
-	var data map[string]string
+	var data VerifyTokenResponse
 	err = json.NewDecoder(resp.Body).Decode(&data); if err != nil {
 		t.Fatal("Verifying token failed with", err.Error())
 	}
 
-	message, ok := data["message"]; if !ok {
-		t.Fatal("Message field missing from response body")
+	if data.Message != "Authorized" {
+		t.Fatal("Access token is not authorized")
 	}
 
-	if message != "Authorized" {
-		t.Fatal("Access token is not authorized")
+	if data.TokenType == "" {
+		t.Fatal("Token type missing from response body")
 	}
 }
 
@@ -259,6 +267,34 @@ func adminRevokeAdmin(t *testing.T, admin *ActiveUser, username string) {
 	}
 }
 
+func adminRevokeSelf(t *testing.T, admin *ActiveUser, username string) {
+	server := httptest.NewServer(postDefense(adminRevokeAdminHandler()))
+	defer server.Close()
+
+	data := make(map[string]string)
+	data["username"] = username
+	data["id"] = fmt.Sprintf("%d", admin.Id)
+	res, _ := json.Marshal(data)
+
+	resp, err := postRequestToken(server.URL, res, admin.AccessToken); if err != nil {
+		t.Fatal("Admin revoke self failed with:", err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 409 {
+		t.Fatal("Revoking your own admin rights should conflict, got", resp.StatusCode)
+	}
+
+	var body ErrorResponse
+	err = json.NewDecoder(resp.Body).Decode(&body); if err != nil || body.Error == nil {
+		t.Fatal("Error response is not a JSON error envelope")
+	}
+
+	if body.Error.Code != "cannot_modify_self" {
+		t.Fatal("Unexpected error code", body.Error.Code)
+	}
+}
+
 func adminDeleteUser(t *testing.T, admin *ActiveUser, username string) {
 	server := httptest.NewServer(postDefense(adminDeleteUserHandler()))
 	defer server.Close()
@@ -282,6 +318,378 @@ func adminDeleteUser(t *testing.T, admin *ActiveUser, username string) {
 	}
 }
 
+func logout(t *testing.T, au *ActiveUser) {
+	server := httptest.NewServer(postDefense(logoutHandler))
+	defer server.Close()
+
+	resp, err := postRequestToken(server.URL, []byte("{}"), au.AccessToken); if err != nil {
+		t.Fatal("Logout failed with:", err.Error())
+	}
+
+	checkStatusCode(t, resp, "Logout has error")
+
+	resp, err = postRequestToken(server.URL, []byte("{}"), au.AccessToken); if err != nil {
+		t.Fatal("Logout failed with:", err.Error())
+	}
+
+	if resp.StatusCode != 401 {
+		t.Fatal("Session still valid after logout")
+	}
+}
+
+func personalTokenFlow(t *testing.T, au *ActiveUser) {
+	if personalTokens == nil {
+		personalTokens = newPersonalTokenStore()
+	}
+
+	server := httptest.NewServer(postDefense(createPersonalTokenHandler))
+	defer server.Close()
+
+	resp, err := postRequestToken(server.URL, []byte(`{"name": "ci", "scopes": ["read"], "apps": ["canban"]}`), au.AccessToken); if err != nil {
+		t.Fatal("Creating personal token failed with:", err.Error())
+	}
+
+	checkStatusCode(t, resp, "Creating personal token has error")
+
+	var created NewPersonalTokenResponse
+	err = json.NewDecoder(resp.Body).Decode(&created); if err != nil || !isPersonalToken(created.Token) {
+		t.Fatal("Personal token missing from response")
+	}
+
+	var stored int
+	db.QueryRow("SELECT COUNT(*) FROM personal_tokens WHERE token_hash = $1", hashToken(created.Token)).Scan(&stored)
+	if stored != 1 {
+		t.Fatal("Personal token was not stored by its hash")
+	}
+
+	verifyToken(t, created.Token)
+
+	//Personal tokens can read but not mint more tokens
+	resp, err = postRequestToken(server.URL, []byte(`{"name": "escalate"}`), created.Token); if err != nil {
+		t.Fatal(err.Error())
+	}
+	if resp.StatusCode == 200 {
+		t.Fatal("Personal token minted another token")
+	}
+
+	list := httptest.NewServer(authMiddleware(http.HandlerFunc(listPersonalTokensHandler)))
+	defer list.Close()
+	adminSessions := httptest.NewServer(authMiddleware(adminListSessionsHandler()))
+	defer adminSessions.Close()
+
+	get := func(url string, token string) *http.Response {
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header.Set("Authorization", "Bearer " + token)
+		resp, err := http.DefaultClient.Do(req); if err != nil {
+			t.Fatal(err.Error())
+		}
+		return resp
+	}
+
+	//A token for canban with an app scope is no key to Portal itself
+	for _, url := range []string{list.URL, adminSessions.URL + "?username=" + au.Name} {
+		if resp := get(url, created.Token); resp.StatusCode != 403 {
+			t.Fatal("Restricted personal token reached a Portal route", url, resp.StatusCode)
+		}
+	}
+
+	resp, err = postRequestToken(server.URL, []byte(`{"name": "cli", "scopes": ["portal:read"]}`), au.AccessToken); if err != nil {
+		t.Fatal(err.Error())
+	}
+	checkStatusCode(t, resp, "Creating personal token has error")
+
+	var reader NewPersonalTokenResponse
+	json.NewDecoder(resp.Body).Decode(&reader)
+	defer personalTokens.delete.Exec(reader.Id, au.Id)
+
+	resp = get(list.URL, reader.Token)
+	checkStatusCode(t, resp, "Listing personal tokens with a bearer token has error")
+
+	var tokens PersonalTokensResponse
+	json.NewDecoder(resp.Body).Decode(&tokens)
+	if len(tokens.Tokens) != 2 {
+		t.Fatal("Unexpected personal token listing", tokens)
+	}
+
+	if resp := get(adminSessions.URL + "?username=" + au.Name, reader.Token); resp.StatusCode != 403 {
+		t.Fatal("Personal token without portal:admin listed a user's sessions", resp.StatusCode)
+	}
+
+	revoke := httptest.NewServer(postDefense(revokePersonalTokenHandler))
+	defer revoke.Close()
+
+	resp, err = postRequestToken(revoke.URL, []byte(fmt.Sprintf(`{"id": %d}`, created.Id)), au.AccessToken); if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	checkStatusCode(t, resp, "Revoking personal token has error")
+
+	if _, ok := userPrincipal(created.Token); ok {
+		t.Fatal("Revoked personal token still works")
+	}
+}
+
+func federatedLoginFlow(t *testing.T, au *ActiveUser) {
+	idp := newFakeIdP(t)
+	defer withFederation(t, idp)()
+	callback := federatedCallbackHandler()
+
+	login := func(r *http.Request) *ActiveUser {
+		rec := httptest.NewRecorder()
+		callback(rec, r)
+		if rec.Code != 303 || rec.Header().Get("Location") != "/welcome" {
+			t.Fatal("Federated login has error", rec.Code, rec.Body.String())
+		}
+		var token string
+		for _, c := range rec.Result().Cookies() {
+			if c.Name == sessionCookieName {
+				token = c.Value
+			}
+		}
+		session, ok := activeUsers.Get(token)
+		if !ok || session.LoginMethod != "oidc:partner" {
+			t.Fatal("Federated login did not start a session")
+		}
+		return session
+	}
+
+	provisioned := login(oidcCallback(t, idp))
+	if provisioned.Name != "otter" {
+		t.Fatal("User was not provisioned from the ID token", provisioned.Name)
+	}
+
+	if again := login(oidcCallback(t, idp)); again.Id != provisioned.Id {
+		t.Fatal("Known identity was provisioned twice")
+	}
+
+	//A provisioned user has no credentials until a password is set for them
+	_, err := userStore.Update(httptest.NewRequest("PUT", "/scim/v2/Users", nil), provisioned.Id, func(a *Account) error {
+		a.Password = "otterpassword"
+		return nil
+	}); if err != nil {
+		t.Fatal("Setting a provisioned user's password failed", err)
+	}
+	var password string
+	err = prepareQuery("sql/get_password.sql").QueryRow(provisioned.Id).Scan(&password); if err != nil || password != "otterpassword" {
+		t.Fatal("Password of a provisioned user was not stored", err)
+	}
+
+	//Logging in upstream while logged in to Portal links the identity instead
+	idp.subject = "u-2"
+	r := oidcCallback(t, idp)
+	r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: au.AccessToken})
+	if linked := login(r); linked.Id != au.Id {
+		t.Fatal("Identity was not linked to the logged in user")
+	}
+}
+
+func readiness(t *testing.T) {
+	rec := httptest.NewRecorder()
+	readyzHandler()(rec, httptest.NewRequest("GET", "/readyz", nil))
+
+	var status HealthStatus
+	json.NewDecoder(rec.Body).Decode(&status)
+	if status.Components["database"].Status != "ok" || status.Components["statements"].Status != "ok" {
+		t.Fatal("Database is not ready", rec.Body.String())
+	}
+}
+
+func scimRequest(t *testing.T, handler http.HandlerFunc, method string, path string, body string, ifMatch string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Content-Type", scimContentType)
+	if ifMatch != "" {
+		r.Header.Set("If-Match", ifMatch)
+	}
+	rec := httptest.NewRecorder()
+	handler(rec, r)
+	return rec
+}
+
+func scimFlow(t *testing.T) {
+	rec := scimRequest(t, scimUsersHandler, "POST", "/scim/v2/Users", `{"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User"], "userName": "beaver", "externalId": "hr-9", "password": "dam", "name": {"givenName": "Beaver"}}`, "")
+	if rec.Code != 201 || rec.Header().Get("ETag") == "" {
+		t.Fatal("Provisioning user has error", rec.Code, rec.Body.String())
+	}
+
+	var created SCIMUser
+	json.NewDecoder(rec.Body).Decode(&created)
+	if !created.Active || created.ExternalId != "hr-9" || len(created.Groups) != 1 {
+		t.Fatal("Unexpected provisioned user", created)
+	}
+	location := "/scim/v2/Users/" + created.Id
+
+	rec = scimRequest(t, scimUsersHandler, "POST", "/scim/v2/Users", `{"userName": "beaver"}`, "")
+	if rec.Code != 409 || !strings.Contains(rec.Body.String(), "uniqueness") {
+		t.Fatal("Duplicate userName was provisioned", rec.Code)
+	}
+
+	rec = scimRequest(t, scimUsersHandler, "GET", `/scim/v2/Users?filter=externalId+eq+%22hr-9%22`, "", "")
+	var list SCIMListResponse
+	json.NewDecoder(rec.Body).Decode(&list)
+	if rec.Code != 200 || list.TotalResults != 1 || list.ItemsPerPage != 1 {
+		t.Fatal("Filtering users by externalId has error", rec.Code, list)
+	}
+
+	var u User
+	id, _ := strconv.ParseInt(created.Id, 10, 64)
+	u.Id, u.Name = id, "beaver"
+	au := activateUser(&u, httptest.NewRequest("GET", "/", nil), "password")
+
+	deactivate := `{"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"], "Operations": [{"op": "replace", "path": "active", "value": false}]}`
+	rec = scimRequest(t, scimUsersHandler, "PATCH", location, deactivate, `W/"stale"`)
+	if rec.Code != 412 {
+		t.Fatal("Patch with a stale ETag was applied", rec.Code)
+	}
+
+	rec = scimRequest(t, scimUsersHandler, "PATCH", location, deactivate, created.Meta.Version)
+	if rec.Code != 200 || rec.Header().Get("ETag") == created.Meta.Version {
+		t.Fatal("Deactivating user has error", rec.Code, rec.Body.String())
+	}
+	if _, ok := activeUsers.Get(au.AccessToken); ok {
+		t.Fatal("Deactivated user kept their session")
+	}
+
+	login := httptest.NewRecorder()
+	loginCredentialsHandler()(login, httptest.NewRequest("POST", "/login/credentials", strings.NewReader(`{"username": "beaver", "password": "dam"}`)))
+	if login.Code != 401 {
+		t.Fatal("Deactivated user logged in", login.Code)
+	}
+
+	rec = scimRequest(t, scimGroupsHandler, "GET", "/scim/v2/Groups/admins", "", "")
+	admins := rec.Header().Get("ETag")
+
+	rec = scimRequest(t, scimGroupsHandler, "PATCH", "/scim/v2/Groups/admins", `{"Operations": [{"op": "add", "path": "members", "value": [{"value": "` + created.Id + `"}]}]}`, admins)
+	if rec.Code != 200 || !strings.Contains(rec.Body.String(), `"display":"beaver"`) {
+		t.Fatal("Adding admin through SCIM has error", rec.Code, rec.Body.String())
+	}
+
+	//The group changed since admins was read, replacing it from that copy would undo the change
+	rec = scimRequest(t, scimGroupsHandler, "PUT", "/scim/v2/Groups/admins", `{"members": []}`, admins)
+	if rec.Code != 412 {
+		t.Fatal("Group was replaced from a stale copy", rec.Code)
+	}
+
+	rec = scimRequest(t, scimGroupsHandler, "PATCH", "/scim/v2/Groups/admins", `{"Operations": [{"op": "add", "path": "members", "value": [{"value": "999999"}]}]}`, "")
+	if rec.Code != 400 {
+		t.Fatal("Unknown member was added", rec.Code)
+	}
+
+	rec = scimRequest(t, scimUsersHandler, "DELETE", location, "", "")
+	if rec.Code != 204 {
+		t.Fatal("Deprovisioning user has error", rec.Code, rec.Body.String())
+	}
+
+	rec = scimRequest(t, scimUsersHandler, "GET", location, "", "")
+	if rec.Code != 404 {
+		t.Fatal("Deleted user is still served", rec.Code)
+	}
+}
+
+func webhookFlow(t *testing.T) {
+	var events []string
+	var logout LogoutClaims
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/logout" {
+			signingKeys.VerifyTyped(logoutTokenType, r.PostFormValue("logout_token"), &logout)
+			events = append(events, backchannelLogoutDelivery)
+			return
+		}
+		events = append(events, r.Header.Get("Portal-Event"))
+	}))
+	defer receiver.Close()
+
+	savedApps := apps
+	defer func() { apps, webhooks = savedApps, nil }()
+	registry, err := parseApps("[canban]\nsecret = \"appsecret\"\nbackchannel_logout_uri = \"" + receiver.URL + "/logout\"\n[canban.webhook]\nurl = \"" + receiver.URL + "\"\nevents = [\"user.created\", \"user.deleted\"]\n"); if err != nil {
+		t.Fatal(err.Error())
+	}
+	apps = registry
+	webhooks = newWebhookQueue()
+	if signingKeys.Current() == nil {
+		signingKeys.Rotate(time.Now())
+	}
+
+	r := httptest.NewRequest("POST", "/admin/delete/user", nil)
+	a := &Account{Name: "heron", Password: "fish", Active: true}
+	err = userStore.Create(a); if err != nil {
+		t.Fatal("Creating user has error", err.Error())
+	}
+	activeUsers.Add(&ActiveUser{Id: a.Id, Name: a.Name, AccessToken: "pst_heron", SessionId: "heron-session", LoginAt: time.Now()})
+	activeUsers.UsedBy("pst_heron", "canban")
+	err = userStore.Delete(r, a.Id); if err != nil {
+		t.Fatal("Deleting user has error", err.Error())
+	}
+
+	if n := webhooks.dispatch(time.Now()); n != 3 || len(events) != 3 || events[0] != eventUserCreated || events[1] != eventUserDeleted || events[2] != backchannelLogoutDelivery {
+		t.Fatal("Webhooks were not delivered in order", n, events)
+	}
+
+	if logout.SessionId != "heron-session" || logout.Audience != "canban" {
+		t.Fatal("Back-channel logout does not name the session", logout)
+	}
+
+	var delivered int
+	db.QueryRow("SELECT COUNT(*) FROM webhook_deliveries WHERE status = 'delivered' AND app = 'canban' AND payload LIKE '%heron%'").Scan(&delivered)
+	if delivered != 2 {
+		t.Fatal("Delivery log does not show the deliveries")
+	}
+
+	if n := webhooks.dispatch(time.Now()); n != 0 {
+		t.Fatal("Delivered webhooks were sent again", n)
+	}
+}
+
+func grpcFlow(t *testing.T) {
+	portal := withGRPCService(t)
+	ctx := appContext("reporter", "reportersecret")
+
+	a := &Account{Name: "egret", Password: "fish", Admin: true, Active: true, ExternalId: "hr-egret"}
+	err := userStore.Create(a); if err != nil {
+		t.Fatal("Creating user has error", err.Error())
+	}
+	defer userStore.Delete(httptest.NewRequest("POST", "/admin/delete/user", nil), a.Id)
+
+	byName, err := portal.GetUser(ctx, &portalpb.GetUserRequest{User: &portalpb.GetUserRequest_Username{Username: "egret"}}); if err != nil {
+		t.Fatal(err)
+	}
+	byId, err := portal.GetUser(ctx, &portalpb.GetUserRequest{User: &portalpb.GetUserRequest_Id{Id: a.Id}}); if err != nil {
+		t.Fatal(err)
+	}
+	if byName.Id != a.Id || byId.Username != "egret" || !byId.Admin || !byId.Active || byId.ExternalId != "hr-egret" {
+		t.Fatal("Unexpected user", byName, byId)
+	}
+
+	if _, err := portal.GetUser(ctx, &portalpb.GetUserRequest{User: &portalpb.GetUserRequest_Username{Username: "nobody"}}); status.Code(err) != codes.NotFound {
+		t.Fatal("Unknown user was found", err)
+	}
+
+	groups, err := portal.ListUserGroups(ctx, &portalpb.ListUserGroupsRequest{UserId: a.Id}); if err != nil || len(groups.Groups) != 2 || groups.Groups[1] != "admins" {
+		t.Fatal("Unexpected groups", groups, err)
+	}
+}
+
+func launchFlow(t *testing.T, au *ActiveUser) {
+	defer withLaunchApps(t)()
+
+	to, _ := url.Parse(launch("canban", au.AccessToken).Header().Get("Location"))
+	exchange := launchExchangeHandler()
+	form := url.Values{"code": {to.Query().Get("code")}}
+
+	rec := oauthPost(exchange, form, "canban", "appsecret")
+	var user LaunchExchangeResponse
+	json.NewDecoder(rec.Body).Decode(&user)
+	if rec.Code != 200 || user.Id != au.Id || user.Name != au.Name || user.SessionId != au.SessionId {
+		t.Fatal("Launch code was not exchanged", rec.Code, user)
+	}
+
+	if rec := oauthPost(exchange, form, "canban", "appsecret"); rec.Code != 400 {
+		t.Fatal("Launch code was exchanged twice", rec.Code)
+	}
+	if rec := oauthPost(exchange, form, "canban", "wrong"); rec.Code != 401 {
+		t.Fatal("Launch code was exchanged with a wrong secret", rec.Code)
+	}
+}
+
 func l(s string) {
      fmt.Println(s)
 }
@@ -289,12 +697,35 @@ func l(s string) {
 func TestIntegrationApi(t *testing.T) {
      
 
+	userStore = newUserStore()
+
+	l("Readiness")
+	readiness(t)
+
 	l("Login")
 	au := loginCreds(t)
 	
 	l("Verify")
 	verifyToken(t, au.AccessToken)
 
+	l("Personal tokens")
+	personalTokenFlow(t, au)
+
+	l("Federated login")
+	federatedLoginFlow(t, au)
+
+	l("SCIM")
+	scimFlow(t)
+
+	l("Webhooks")
+	webhookFlow(t)
+
+	l("gRPC")
+	grpcFlow(t)
+
+	l("Launch")
+	launchFlow(t, au)
+
 	l("Update username")
 	updateUsername(t, au)
 
@@ -313,6 +744,12 @@ func TestIntegrationApi(t *testing.T) {
 	l("Admin revoke")
 	adminRevokeAdmin(t, au, "foo")
 
+	l("Admin revoke self")
+	adminRevokeSelf(t, au, "shiba2")
+
 	l("Admin delete")
-	adminDeleteUser(t, au, "foo")	
+	adminDeleteUser(t, au, "foo")
+
+	l("Logout")
+	logout(t, au)
 }
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"testing"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+func TestLogoutRevokesSessions(t *testing.T) {
+	now := time.Now()
+	current := &ActiveUser{Id: 45, Name: "shibe", AccessToken: "logouttoken1", CSRFToken: newCSRFToken(), LoginAt: now}
+	other := &ActiveUser{Id: 45, Name: "shibe", AccessToken: "logouttoken2", CSRFToken: newCSRFToken(), LoginAt: now}
+	stranger := &ActiveUser{Id: 46, Name: "akita", AccessToken: "logouttoken3", CSRFToken: newCSRFToken(), LoginAt: now}
+	activeUsers.Add(current)
+	activeUsers.Add(other)
+	activeUsers.Add(stranger)
+
+	request := func(au *ActiveUser) *http.Request {
+		r := httptest.NewRequest("POST", "/logout", nil)
+		r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: au.AccessToken})
+		return withPrincipal(r, &Principal{Id: au.Id, Name: au.Name, TokenType: sessionTokenType, Token: au.AccessToken})
+	}
+
+	rec := httptest.NewRecorder()
+	logoutHandler(rec, request(current))
+
+	if _, ok := activeUsers.Get(current.AccessToken); ok {
+		t.Fatal("Logout did not revoke the current session")
+	}
+
+	if _, ok := activeUsers.Get(other.AccessToken); !ok {
+		t.Fatal("Logout revoked another session of the user")
+	}
+
+	cleared := false
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == sessionCookieName && c.MaxAge < 0 {
+			cleared = true
+		}
+	}
+	if !cleared {
+		t.Fatal("Logout did not clear the session cookie")
+	}
+
+	logoutAllHandler(httptest.NewRecorder(), request(other))
+
+	if _, ok := activeUsers.Get(other.AccessToken); ok {
+		t.Fatal("Logout everywhere left a session behind")
+	}
+
+	if _, ok := activeUsers.Get(stranger.AccessToken); !ok {
+		t.Fatal("Logout everywhere revoked another user's session")
+	}
+}
+
+func TestSessionTokenCookie(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "named"})
+	if sessionToken(r) != "named" {
+		t.Fatal("Named session cookie was not read")
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Cookie", "baretoken")
+	if sessionToken(r) != "baretoken" {
+		t.Fatal("Bare token cookie header was not accepted")
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Cookie", "other=value")
+	if sessionToken(r) != "" {
+		t.Fatal("Unrelated cookie was taken as a session token")
+	}
+}
+
+func TestParseUserAgent(t *testing.T) {
+	cases := map[string]string{
+		"Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0": "Firefox on Linux",
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Safari/537.36 Edg/120.0": "Edge on Windows",
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Mobile/15E148 Safari/604.1": "Safari on iOS",
+		"curl/8.4.0": "curl",
+		"": "Unknown browser",
+	}
+
+	for ua, expected := range cases {
+		if got := parseUserAgent(ua); got != expected {
+			t.Fatal("Parsing", ua, "expected", expected, "got", got)
+		}
+	}
+}
+
+func TestListAndRevokeMySessions(t *testing.T) {
+	login := func(name string, id int64, ua string) *ActiveUser {
+		r := httptest.NewRequest("POST", "/login/credentials", nil)
+		r.Header.Set("User-Agent", ua)
+		return activateUser(&User{Id: id, Name: name}, r, "password")
+	}
+
+	laptop := login("beagle", 47, "Mozilla/5.0 (X11; Linux x86_64) Firefox/120.0")
+	phone := login("beagle", 47, "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) Safari/604.1")
+	stranger := login("poodle", 48, "curl/8.4.0")
+
+	principal := &Principal{Id: laptop.Id, Name: laptop.Name, TokenType: sessionTokenType, Token: laptop.AccessToken}
+
+	rec := httptest.NewRecorder()
+	listSessionsHandler(rec, withPrincipal(httptest.NewRequest("GET", "/sessions", nil), principal))
+
+	var body SessionsResponse
+	err := json.NewDecoder(rec.Body).Decode(&body); if err != nil {
+		t.Fatal("Decoding sessions failed", err.Error())
+	}
+
+	if len(body.Sessions) != 2 {
+		t.Fatal("Expected both of the user's sessions, got", len(body.Sessions))
+	}
+
+	for _, s := range body.Sessions {
+		if s.Current != (s.Id == laptop.SessionId) {
+			t.Fatal("Current session was not flagged correctly")
+		}
+		if s.LoginMethod != "password" || s.Device == "" {
+			t.Fatal("Session metadata is missing")
+		}
+	}
+
+	revoke := func(sessionId string) int {
+		r := httptest.NewRequest("POST", "/sessions/revoke", bytes.NewBufferString(`{"session_id": "` + sessionId + `"}`))
+		rec := httptest.NewRecorder()
+		revokeSessionHandler(rec, withPrincipal(r, principal))
+		return rec.Code
+	}
+
+	if revoke(stranger.SessionId) != 404 {
+		t.Fatal("Revoking another user's session was not refused")
+	}
+
+	if _, ok := activeUsers.Get(stranger.AccessToken); !ok {
+		t.Fatal("Another user's session was revoked")
+	}
+
+	if revoke(phone.SessionId) != 200 {
+		t.Fatal("Revoking my own session failed")
+	}
+
+	if _, ok := activeUsers.Get(phone.AccessToken); ok {
+		t.Fatal("Revoked session is still active")
+	}
+}
+
+func TestSessionTokensAreHashed(t *testing.T) {
+	token := newSessionToken()
+	if !isSessionToken(token) || len(token) != len(sessionTokenPrefix) + 43 {
+		t.Fatal("Unexpected session token format", token)
+	}
+
+	if newSessionToken() == token {
+		t.Fatal("Session tokens repeat")
+	}
+
+	store := &ActiveUsers{users: make(map[string]*ActiveUser)}
+	store.Add(&ActiveUser{Id: 47, Name: "pug", AccessToken: token, LoginAt: time.Now()})
+
+	for key, au := range store.users {
+		if key == token || au.AccessToken != "" || au.TokenHash != hashToken(token) {
+			t.Fatal("Session store keeps the raw token")
+		}
+	}
+
+	if _, ok := store.Get(token); !ok {
+		t.Fatal("Session can't be found by its token")
+	}
+
+	if _, ok := store.Get(hashToken(token)); ok {
+		t.Fatal("Session can be found by its hash")
+	}
+
+	if store.DeleteUser(47, token) != 0 {
+		t.Fatal("Kept session was deleted")
+	}
+}
+
+func TestRandASCIIBytesUnbiased(t *testing.T) {
+	counts := make(map[byte]int)
+	for _, c := range randASCIIBytes(52 * 2000) {
+		counts[c]++
+	}
+
+	//Modulo bias made the first 48 letters 1.25 times as likely as the last four
+	if len(counts) != len(letterBytes) || counts['W'] * 10 < 2000 * 9 || counts['Z'] * 10 < 2000 * 9 {
+		t.Fatal("Letters are not uniformly distributed", counts)
+	}
+}
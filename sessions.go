@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+//Public identifier of a session, safe to show and pass around unlike the access token
+func newSessionId() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b); if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+var userAgentBrowsers = []struct{
+	token string
+	name string
+}{
+	//Order matters, Edge and Opera also claim to be Chrome, Chrome also claims to be Safari
+	{"Edg/", "Edge"},
+	{"OPR/", "Opera"},
+	{"Firefox/", "Firefox"},
+	{"Chrome/", "Chrome"},
+	{"Safari/", "Safari"},
+	{"curl/", "curl"},
+	{"Go-http-client/", "Go"},
+	{"python-requests/", "Python"},
+}
+
+var userAgentSystems = []struct{
+	token string
+	name string
+}{
+	{"Android", "Android"},
+	{"iPhone", "iOS"},
+	{"iPad", "iOS"},
+	{"Windows", "Windows"},
+	{"Mac OS X", "macOS"},
+	{"CrOS", "ChromeOS"},
+	{"Linux", "Linux"},
+}
+
+//Short human description of a user agent such as "Firefox on Linux"
+func parseUserAgent(ua string) string {
+	browser := "Unknown browser"
+	for _, b := range userAgentBrowsers {
+		if strings.Contains(ua, b.token) {
+			browser = b.name
+			break
+		}
+	}
+
+	for _, s := range userAgentSystems {
+		if strings.Contains(ua, s.token) {
+			return browser + " on " + s.name
+		}
+	}
+
+	return browser
+}
+
+type SessionInfo struct {
+	Id string `json:"id"`
+	CreatedAt time.Time `json:"createdAt"`
+	LastSeen time.Time `json:"lastSeen"`
+	IP string `json:"ip"`
+	UserAgent string `json:"userAgent"`
+	Device string `json:"device"`
+	LoginMethod string `json:"loginMethod"`
+	//Apps the session has been used with
+	Apps []string `json:"apps"`
+	Current bool `json:"current"`
+}
+
+type SessionsResponse struct {
+	Sessions []SessionInfo `json:"sessions"`
+}
+
+func sessionInfos(id int64, currentToken string) *SessionsResponse {
+	now := time.Now()
+	currentHash := hashToken(currentToken)
+	infos := make([]SessionInfo, 0)
+	for _, au := range activeUsers.ListUser(id) {
+		if au.Expired(now) {
+			continue
+		}
+
+		infos = append(infos, SessionInfo{
+			Id: au.SessionId,
+			CreatedAt: au.LoginAt,
+			LastSeen: au.LastSeen,
+			IP: au.IP,
+			UserAgent: au.UserAgent,
+			Device: parseUserAgent(au.UserAgent),
+			LoginMethod: au.LoginMethod,
+			Apps: append([]string{}, au.Apps...),
+			Current: au.TokenHash == currentHash,
+		})
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].LastSeen.After(infos[j].LastSeen)
+	})
+
+	return &SessionsResponse{Sessions: infos}
+}
+
+type RevokeSessionRequest struct {
+	SessionId string `json:"session_id"`
+	UserName string `json:"username"`
+}
+
+func (req *RevokeSessionRequest) Validate() *APIError {
+	if req.SessionId == "" {
+		return badRequest("missing_field", "session_id is required")
+	}
+	return nil
+}
+
+var errSessionNotFound = notFound("session_not_found", "Session does not exist")
+
+func requireGet(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeError(w, &APIError{Status: http.StatusMethodNotAllowed, Code: "method_not_allowed", Message: "This route only accepts GET request"})
+		return false
+	}
+	return true
+}
+
+func listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireGet(w, r) {
+		return
+	}
+
+	p, ok := principalFrom(r); if !ok {
+		writeError(w, errInvalidSession)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, sessionInfos(p.Id, p.Token))
+}
+
+func revokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	var req RevokeSessionRequest
+	if apiErr := decodeJSON(w, r, &req); apiErr != nil {
+		writeError(w, apiErr)
+		return
+	}
+
+	p, ok := principalFrom(r); if !ok {
+		writeError(w, errInvalidSession)
+		return
+	}
+
+	if !activeUsers.DeleteSession(p.Id, req.SessionId) {
+		writeError(w, errSessionNotFound)
+		return
+	}
+	requestLogger(r, "session").Info("Session revoked", "session_id", req.SessionId)
+
+	writeJSON(w, http.StatusOK, &MessageResponse{Message: "Session has been revoked"})
+}
+
+//Looks up the user an admin request targets by name
+func targetUser(w http.ResponseWriter, r *http.Request, stmt *sql.Stmt, name string) (*User, bool) {
+	if apiErr := validateUsername("username", name); apiErr != nil {
+		writeError(w, apiErr)
+		return nil, false
+	}
+
+	var u User
+	err := stmt.QueryRow(name).Scan(&u.Id, &u.Name); if err != nil {
+		dbError(w, r, err)
+		return nil, false
+	}
+
+	return &u, true
+}
+
+func adminListSessionsHandler() http.HandlerFunc {
+	stmt := prepareQuery("sql/check_admin.sql")
+	stmt2 := prepareQuery("sql/get_user_by_name.sql")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !requireGet(w, r) {
+			return
+		}
+
+		p, ok := principalFrom(r); if !ok {
+			writeError(w, errInvalidSession)
+			return
+		}
+
+		if !requireAdmin(w, r, stmt, p) {
+			return
+		}
+
+		u, ok := targetUser(w, r, stmt2, r.URL.Query().Get("username")); if !ok {
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusOK, sessionInfos(u.Id, p.Token))
+	})
+}
+
+func adminRevokeSessionHandler() http.HandlerFunc {
+	stmt := prepareQuery("sql/check_admin.sql")
+	stmt2 := prepareQuery("sql/get_user_by_name.sql")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req RevokeSessionRequest
+		if apiErr := decodeJSON(w, r, &req); apiErr != nil {
+			writeError(w, apiErr)
+			return
+		}
+
+		p, ok := principalFrom(r); if !ok {
+			writeError(w, errInvalidSession)
+			return
+		}
+
+		if !requireAdmin(w, r, stmt, p) {
+			return
+		}
+
+		u, ok := targetUser(w, r, stmt2, req.UserName); if !ok {
+			return
+		}
+
+		if !activeUsers.DeleteSession(u.Id, req.SessionId) {
+			writeError(w, errSessionNotFound)
+			return
+		}
+		adminActionDone("revoke_session")
+		requestLogger(r, "session").Info("Session revoked by admin", "target_user_id", u.Id, "session_id", req.SessionId)
+
+		writeJSON(w, http.StatusOK, &MessageResponse{Message: "Session has been revoked"})
+	})
+}
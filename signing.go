@@ -0,0 +1,475 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"github.com/robfig/cron"
+)
+
+type TokensConfig struct {
+	//Defaults to https://<domain>
+	Issuer string
+	Lifetime Duration
+	RotationInterval Duration `toml:"rotation_interval"`
+	//Signing keys only live in memory when empty, so a restart invalidates every signed token
+	KeyDir string `toml:"key_dir"`
+}
+
+func tokenIssuer() string {
+	if config.Tokens.Issuer != "" {
+		return config.Tokens.Issuer
+	}
+	return "https://" + config.Domain
+}
+
+type SigningKey struct {
+	Id string
+	Private ed25519.PrivateKey
+	Public ed25519.PublicKey
+	CreatedAt time.Time
+}
+
+//Key ids are derived from the public key so the same key always gets the same id
+func newSigningKey(now time.Time) (*SigningKey, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader); if err != nil {
+		return nil, err
+	}
+	return signingKeyFrom(private, now), nil
+}
+
+func signingKeyFrom(private ed25519.PrivateKey, createdAt time.Time) *SigningKey {
+	public := private.Public().(ed25519.PublicKey)
+	sum := sha256.Sum256(public)
+	return &SigningKey{
+		Id: base64.RawURLEncoding.EncodeToString(sum[:12]),
+		Private: private,
+		Public: public,
+		CreatedAt: createdAt,
+	}
+}
+
+//Generates, rotates and retires the Ed25519 keys signed access tokens are signed with.
+//The newest key signs, older keys stay published until every token they signed has expired
+type KeyManager struct {
+	mu sync.RWMutex
+	keys []*SigningKey
+	dir string
+	cron *cron.Cron
+}
+
+var signingKeys *KeyManager = &KeyManager{}
+
+func (k *KeyManager) keyPath(id string) string {
+	return filepath.Join(k.dir, id + ".pem")
+}
+
+func (k *KeyManager) save(key *SigningKey) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key.Private); if err != nil {
+		return err
+	}
+
+	block := &pem.Block{
+		Type: "PRIVATE KEY",
+		Headers: map[string]string{"Created": key.CreatedAt.UTC().Format(time.RFC3339)},
+		Bytes: der,
+	}
+	return os.WriteFile(k.keyPath(key.Id), pem.EncodeToMemory(block), 0600)
+}
+
+//Loads the keys a previous run left in dir, tokens they signed stay valid across restarts
+func (k *KeyManager) Load(dir string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.dir = dir
+	if dir == "" {
+		return nil
+	}
+
+	err := os.MkdirAll(dir, 0700); if err != nil {
+		return err
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.pem")); if err != nil {
+		return err
+	}
+
+	keys := make([]*SigningKey, 0, len(files))
+	for _, file := range files {
+		content, err := os.ReadFile(file); if err != nil {
+			return err
+		}
+
+		block, _ := pem.Decode(content)
+		if block == nil || block.Type != "PRIVATE KEY" {
+			return fmt.Errorf("%s is not a PEM private key", file)
+		}
+
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes); if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+
+		private, ok := parsed.(ed25519.PrivateKey); if !ok {
+			return fmt.Errorf("%s is not an Ed25519 key", file)
+		}
+
+		createdAt, err := time.Parse(time.RFC3339, block.Headers["Created"]); if err != nil {
+			return fmt.Errorf("%s has no valid Created header: %w", file, err)
+		}
+
+		keys = append(keys, signingKeyFrom(private, createdAt))
+	}
+
+	//Newest first
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.After(keys[j].CreatedAt)
+	})
+	k.keys = keys
+	return nil
+}
+
+//Generates a new signing key once the current one is older than the rotation interval and
+//retires keys whose last token has expired. Returns whether a new key was generated
+func (k *KeyManager) Rotate(now time.Time) (bool, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	rotated := false
+	if len(k.keys) == 0 || now.Sub(k.keys[0].CreatedAt) >= config.Tokens.RotationInterval.Duration {
+		key, err := newSigningKey(now); if err != nil {
+			return false, err
+		}
+
+		if k.dir != "" {
+			err = k.save(key); if err != nil {
+				return false, err
+			}
+		}
+
+		k.keys = append([]*SigningKey{key}, k.keys...)
+		rotated = true
+	}
+
+	//A key stopped signing when its successor was created
+	kept := k.keys[:1]
+	for i := 1; i < len(k.keys); i++ {
+		if now.Sub(k.keys[i - 1].CreatedAt) > config.Tokens.Lifetime.Duration {
+			if k.dir != "" {
+				err := os.Remove(k.keyPath(k.keys[i].Id)); if err != nil && !os.IsNotExist(err) {
+					return rotated, err
+				}
+			}
+			continue
+		}
+		kept = append(kept, k.keys[i])
+	}
+	k.keys = kept
+
+	return rotated, nil
+}
+
+//Checks for rotation as often as tokens expire, so retired keys leave the JWKS promptly
+func (k *KeyManager) AutoRotate() {
+	k.cron = cron.New()
+	k.cron.AddFunc(fmt.Sprintf("@every %s", config.Tokens.Lifetime.Duration), func() {
+		l := logger.With("component", "keys")
+		rotated, err := k.Rotate(time.Now()); if err != nil {
+			l.Error("Signing key rotation failed", "error", err.Error())
+			return
+		}
+		if rotated {
+			signingKeyRotated()
+			l.Info("Signing key rotated", "kid", k.Current().Id, "published", len(k.Published()))
+		}
+	})
+	k.cron.Start()
+}
+
+func (k *KeyManager) Close() {
+	if k.cron != nil {
+		k.cron.Stop()
+	}
+}
+
+func (k *KeyManager) Current() *SigningKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if len(k.keys) == 0 {
+		return nil
+	}
+	return k.keys[0]
+}
+
+func (k *KeyManager) Published() []*SigningKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	keys := make([]*SigningKey, len(k.keys))
+	copy(keys, k.keys)
+	return keys
+}
+
+func (k *KeyManager) Find(id string) (*SigningKey, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	for _, key := range k.keys {
+		if key.Id == id {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+func (k *KeyManager) Ping() error {
+	if k.Current() == nil {
+		return fmt.Errorf("No signing key")
+	}
+	return nil
+}
+
+//Claims of a signed access token, apps verify them locally against the JWKS
+type AccessClaims struct {
+	Issuer string `json:"iss"`
+	Subject string `json:"sub"`
+	//The app a user token was issued to, every other app must refuse it
+	Audience string `json:"aud,omitempty"`
+	Name string `json:"name,omitempty"`
+	SessionId string `json:"sid,omitempty"`
+	//Set on tokens a client got for itself, such tokens have no user behind them
+	ClientId string `json:"client_id,omitempty"`
+	Scope string `json:"scope,omitempty"`
+	IssuedAt int64 `json:"iat"`
+	ExpiresAt int64 `json:"exp"`
+	Id string `json:"jti"`
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+const signedTokenAlg = "EdDSA"
+
+var b64 = base64.RawURLEncoding
+
+//Signs claims into a compact JWT with the current key
+func (k *KeyManager) Sign(claims interface{}) (string, error) {
+	return k.SignTyped("JWT", claims)
+}
+
+//Like Sign with an explicit typ header, for tokens that must not be mistaken for access tokens
+func (k *KeyManager) SignTyped(typ string, claims interface{}) (string, error) {
+	key := k.Current(); if key == nil {
+		return "", fmt.Errorf("No signing key")
+	}
+
+	header, err := json.Marshal(&jwtHeader{Alg: signedTokenAlg, Typ: typ, Kid: key.Id}); if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(claims); if err != nil {
+		return "", err
+	}
+
+	signingInput := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+	signature := ed25519.Sign(key.Private, []byte(signingInput))
+	return signingInput + "." + b64.EncodeToString(signature), nil
+}
+
+var errInvalidSignedToken = fmt.Errorf("Signed token is malformed or its signature does not verify")
+
+//Verifies the signature of a compact JWT and decodes its claims into claims.
+//Callers still check expiry, issuer and whatever else their token type needs
+func (k *KeyManager) Verify(token string, claims interface{}) error {
+	return k.VerifyTyped("JWT", token, claims)
+}
+
+//Like Verify for tokens signed with SignTyped. The typ must match, so a logout token
+//handed to an app can never be replayed to Portal as an access token
+func (k *KeyManager) VerifyTyped(typ string, token string, claims interface{}) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errInvalidSignedToken
+	}
+
+	rawHeader, err := b64.DecodeString(parts[0]); if err != nil {
+		return errInvalidSignedToken
+	}
+
+	var header jwtHeader
+	err = json.Unmarshal(rawHeader, &header); if err != nil || header.Alg != signedTokenAlg || header.Typ != typ {
+		return errInvalidSignedToken
+	}
+
+	key, ok := k.Find(header.Kid); if !ok {
+		return errInvalidSignedToken
+	}
+
+	signature, err := b64.DecodeString(parts[2]); if err != nil {
+		return errInvalidSignedToken
+	}
+
+	if !ed25519.Verify(key.Public, []byte(parts[0] + "." + parts[1]), signature) {
+		return errInvalidSignedToken
+	}
+
+	payload, err := b64.DecodeString(parts[1]); if err != nil {
+		return errInvalidSignedToken
+	}
+
+	err = json.Unmarshal(payload, claims); if err != nil {
+		return errInvalidSignedToken
+	}
+
+	return nil
+}
+
+func newAccessClaims(au *ActiveUser, app *App, now time.Time) *AccessClaims {
+	return &AccessClaims{
+		Issuer: tokenIssuer(),
+		Subject: strconv.FormatInt(au.Id, 10),
+		Audience: app.Name,
+		Name: au.Name,
+		SessionId: au.SessionId,
+		IssuedAt: now.Unix(),
+		ExpiresAt: now.Add(config.Tokens.Lifetime.Duration).Unix(),
+		Id: newSessionId(),
+	}
+}
+
+func parseAccessToken(token string, now time.Time) (*AccessClaims, error) {
+	var claims AccessClaims
+	err := signingKeys.Verify(token, &claims); if err != nil {
+		return nil, err
+	}
+
+	if claims.Issuer != tokenIssuer() || now.Unix() >= claims.ExpiresAt {
+		return nil, fmt.Errorf("Signed token is expired or from another issuer")
+	}
+
+	return &claims, nil
+}
+
+type SignedTokenResponse struct {
+	Token string `json:"token"`
+	TokenType string `json:"tokenType"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+//Short lived signed token for a session, meant for app only. Nil when signing fails so logins never fail on it
+func signedTokenFor(r *http.Request, au *ActiveUser, app *App) *SignedTokenResponse {
+	now := time.Now()
+	claims := newAccessClaims(au, app, now)
+	token, err := signingKeys.Sign(claims); if err != nil {
+		requestLogger(r, "keys").Error("Signing access token failed", "error", err.Error())
+		return nil
+	}
+
+	signedTokenIssued("session")
+	return &SignedTokenResponse{
+		Token: token,
+		TokenType: "Bearer",
+		ExpiresAt: time.Unix(claims.ExpiresAt, 0).UTC(),
+	}
+}
+
+//What the login routes answer, the session plus a signed access token apps can verify locally
+type LoginResponse struct {
+	*ActiveUser
+	SignedToken *SignedTokenResponse `json:"signedToken,omitempty"`
+}
+
+//Only logins from an app's origin get a signed token, it is bound to that app
+func loginResponse(r *http.Request, au *ActiveUser) *LoginResponse {
+	resp := &LoginResponse{ActiveUser: au}
+	if app, ok := apps.ForOrigin(r.Header.Get("Origin")); ok {
+		resp.SignedToken = signedTokenFor(r, au, app)
+	}
+	return resp
+}
+
+var errNotAppOrigin = forbidden("not_app_origin", "Signed tokens are only issued to the origins of registered apps")
+
+//Lets app frontends trade the session cookie for a fresh signed token once theirs expires.
+//The token's audience is the app whose origin asked, CORS already checked the origin
+func sessionSignedTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireGet(w, r) {
+		return
+	}
+
+	app, ok := apps.ForOrigin(r.Header.Get("Origin")); if !ok {
+		writeError(w, errNotAppOrigin)
+		return
+	}
+	setLogApp(r, app.Name)
+
+	p, ok := principalFrom(r); if !ok {
+		writeError(w, errInvalidSession)
+		return
+	}
+
+	au, ok := activeUsers.Get(p.Token); if !ok {
+		writeError(w, errInvalidSession)
+		return
+	}
+
+	signed := signedTokenFor(r, au, app); if signed == nil {
+		writeError(w, errInternal)
+		return
+	}
+	activeUsers.UsedBy(p.Token, app.Name)
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, signed)
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X string `json:"x"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+func jwks() *JWKS {
+	set := &JWKS{Keys: make([]JWK, 0)}
+	for _, key := range signingKeys.Published() {
+		set.Keys = append(set.Keys, JWK{
+			Kty: "OKP",
+			Crv: "Ed25519",
+			X: b64.EncodeToString(key.Public),
+			Kid: key.Id,
+			Use: "sig",
+			Alg: signedTokenAlg,
+		})
+	}
+	return set
+}
+
+//Apps should refetch the set when they see a kid they don't know, a new key signs right away
+func jwksHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireGet(w, r) {
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, jwks())
+}
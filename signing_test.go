@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignedTokenRoundTrip(t *testing.T) {
+	keys := &KeyManager{}
+	now := time.Now()
+	keys.Rotate(now)
+
+	claims := &AccessClaims{Issuer: tokenIssuer(), Subject: "42", Name: "akita", IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Minute).Unix(), Id: "x"}
+	token, err := keys.Sign(claims); if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded AccessClaims
+	err = keys.Verify(token, &decoded); if err != nil {
+		t.Fatal(err)
+	}
+	if decoded != *claims {
+		t.Fatal("Claims changed in the round trip", decoded)
+	}
+
+	parts := strings.Split(token, ".")
+	forged, _ := json.Marshal(&AccessClaims{Issuer: tokenIssuer(), Subject: "1", ExpiresAt: claims.ExpiresAt})
+	if keys.Verify(parts[0] + "." + b64.EncodeToString(forged) + "." + parts[2], &decoded) == nil {
+		t.Fatal("Tampered claims verified")
+	}
+
+	unsigned := b64.EncodeToString([]byte(`{"alg":"none","kid":"` + keys.Current().Id + `"}`)) + "." + parts[1] + "."
+	if keys.Verify(unsigned, &decoded) == nil {
+		t.Fatal("Unsigned token verified")
+	}
+
+	other := &KeyManager{}
+	other.Rotate(now)
+	if other.Verify(token, &decoded) == nil {
+		t.Fatal("Token verified against an unknown key")
+	}
+}
+
+func TestSigningKeyRotation(t *testing.T) {
+	keys := &KeyManager{}
+	now := time.Now()
+	keys.Rotate(now)
+	first := keys.Current()
+
+	token, _ := keys.Sign(&AccessClaims{Subject: "1"})
+
+	rotated, _ := keys.Rotate(now.Add(config.Tokens.RotationInterval.Duration / 2))
+	if rotated {
+		t.Fatal("Key rotated before the rotation interval")
+	}
+
+	later := now.Add(config.Tokens.RotationInterval.Duration)
+	rotated, _ = keys.Rotate(later)
+	if !rotated || keys.Current() == first {
+		t.Fatal("Key was not rotated")
+	}
+
+	if len(keys.Published()) != 2 || keys.Verify(token, &AccessClaims{}) != nil {
+		t.Fatal("Retired key must stay published while its tokens are valid")
+	}
+
+	keys.Rotate(later.Add(config.Tokens.Lifetime.Duration + time.Second))
+	if len(keys.Published()) != 1 || keys.Verify(token, &AccessClaims{}) == nil {
+		t.Fatal("Retired key is still published after its tokens expired")
+	}
+}
+
+func TestSigningKeysPersist(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now().Truncate(time.Second)
+
+	keys := &KeyManager{}
+	keys.Load(dir)
+	keys.Rotate(now)
+	keys.Rotate(now.Add(config.Tokens.RotationInterval.Duration))
+
+	restarted := &KeyManager{}
+	err := restarted.Load(dir); if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(restarted.Published()) != 2 || restarted.Current().Id != keys.Current().Id {
+		t.Fatal("Keys were not restored in order")
+	}
+
+	keys.Rotate(now.Add(config.Tokens.RotationInterval.Duration + config.Tokens.Lifetime.Duration + time.Second))
+	restarted = &KeyManager{}
+	restarted.Load(dir)
+	if len(restarted.Published()) != 1 {
+		t.Fatal("Retired key file was not removed")
+	}
+}
+
+func TestJWKSAndSessionToken(t *testing.T) {
+	saved := signingKeys
+	defer func() { signingKeys = saved }()
+	signingKeys = &KeyManager{}
+	signingKeys.Rotate(time.Now())
+
+	rec := httptest.NewRecorder()
+	jwksHandler(rec, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+
+	var set JWKS
+	json.NewDecoder(rec.Body).Decode(&set)
+	if len(set.Keys) != 1 || set.Keys[0].Kid != signingKeys.Current().Id || set.Keys[0].Crv != "Ed25519" {
+		t.Fatal("Unexpected JWKS", set)
+	}
+
+	au := &ActiveUser{Id: 48, Name: "beagle", AccessToken: newSessionToken(), SessionId: newSessionId(), LoginAt: time.Now()}
+	activeUsers.Add(au)
+	defer activeUsers.Delete(au.AccessToken)
+
+	savedApps := apps
+	defer func() { apps = savedApps }()
+	apps, _ = parseApps("[canban]\nsecret = \"s\"\norigins = [\"https://canban.example.com\"]\n")
+
+	p := &Principal{Id: au.Id, Name: au.Name, TokenType: sessionTokenType, Token: au.AccessToken}
+	r := httptest.NewRequest("GET", "/session/token", nil)
+	rec = httptest.NewRecorder()
+	sessionSignedTokenHandler(rec, withPrincipal(r, p))
+	if rec.Code != 403 {
+		t.Fatal("Signed token was issued without an app origin", rec.Code)
+	}
+
+	r = httptest.NewRequest("GET", "/session/token", nil)
+	r.Header.Set("Origin", "https://canban.example.com")
+	rec = httptest.NewRecorder()
+	sessionSignedTokenHandler(rec, withPrincipal(r, p))
+	if rec.Code != 200 {
+		t.Fatal("Expected a signed token, got", rec.Code)
+	}
+
+	var signed SignedTokenResponse
+	json.NewDecoder(rec.Body).Decode(&signed)
+	claims, err := parseAccessToken(signed.Token, time.Now()); if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "48" || claims.SessionId != au.SessionId || claims.Name != "beagle" || claims.Audience != "canban" {
+		t.Fatal("Unexpected claims", claims)
+	}
+
+	if used, _ := activeUsers.Get(au.AccessToken); len(used.Apps) != 1 || used.Apps[0] != "canban" {
+		t.Fatal("Session was not marked as used by the app", used.Apps)
+	}
+
+	_, err = parseAccessToken(signed.Token, time.Now().Add(config.Tokens.Lifetime.Duration)); if err == nil {
+		t.Fatal("Expired token was accepted")
+	}
+}
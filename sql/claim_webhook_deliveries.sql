@@ -0,0 +1,5 @@
+UPDATE webhook_deliveries SET next_attempt_at = NOW() + make_interval(secs => $2)
+ WHERE id IN (
+  SELECT id FROM webhook_deliveries WHERE status = 'pending' AND next_attempt_at <= NOW()
+  ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED
+ ) RETURNING id, app, event, event_id, payload, attempts;
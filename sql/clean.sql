@@ -1,2 +1,5 @@
+DROP TABLE webhook_deliveries;
+DROP TABLE external_identities;
+DROP TABLE personal_tokens;
 DROP TABLE credentials;
 DROP TABLE users;
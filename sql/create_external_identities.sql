@@ -0,0 +1,7 @@
+CREATE TABLE external_identities(
+ provider text NOT NULL,
+ subject text NOT NULL,
+ user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+ created_at TIMESTAMP NOT NULL,
+ PRIMARY KEY (provider, subject)
+);
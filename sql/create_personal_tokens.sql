@@ -0,0 +1,12 @@
+CREATE TABLE personal_tokens(
+ id serial PRIMARY KEY,
+ user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+ name text NOT NULL,
+ token_hash text UNIQUE NOT NULL,
+ scopes text[] NOT NULL,
+ apps text[] NOT NULL,
+ created_at TIMESTAMP NOT NULL,
+ expires_at TIMESTAMP NOT NULL,
+ last_used_at TIMESTAMP,
+ UNIQUE (user_id, name)
+);
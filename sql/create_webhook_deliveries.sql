@@ -0,0 +1,16 @@
+CREATE TABLE webhook_deliveries(
+ id serial PRIMARY KEY,
+ app text NOT NULL,
+ event text NOT NULL,
+ event_id text NOT NULL,
+ payload text NOT NULL,
+ status text NOT NULL,
+ attempts INTEGER NOT NULL DEFAULT 0,
+ last_status INTEGER,
+ last_error text,
+ created_at TIMESTAMP NOT NULL,
+ next_attempt_at TIMESTAMP NOT NULL,
+ last_attempt_at TIMESTAMP,
+ delivered_at TIMESTAMP
+);
+CREATE INDEX webhook_deliveries_due ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
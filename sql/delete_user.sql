@@ -1 +1 @@
-DELETE FROM users WHERE name = $1;
+DELETE FROM users WHERE id = $1 RETURNING id, name;
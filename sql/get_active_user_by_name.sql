@@ -0,0 +1 @@
+SELECT id, name FROM users WHERE name = $1 AND active LIMIT 1;
@@ -0,0 +1,3 @@
+SELECT users.id, users.name, users.active FROM external_identities
+ JOIN users ON users.id = external_identities.user_id
+ WHERE external_identities.provider = $1 AND external_identities.subject = $2;
@@ -0,0 +1,3 @@
+SELECT personal_tokens.id, users.id, users.name, personal_tokens.scopes, personal_tokens.apps,
+ COALESCE(personal_tokens.last_used_at > NOW() - make_interval(secs => $2), FALSE)
+ FROM personal_tokens INNER JOIN users ON users.id = personal_tokens.user_id WHERE personal_tokens.token_hash = $1 AND users.active AND personal_tokens.expires_at > NOW() LIMIT 1;
@@ -0,0 +1 @@
+SELECT id, name FROM users WHERE name = $1 LIMIT 1;
@@ -1 +0,0 @@
-SELECT name FROM users WHERE id = $1;
@@ -0,0 +1 @@
+INSERT INTO external_identities (provider, subject, user_id, created_at) VALUES ($1, $2, $3, NOW());
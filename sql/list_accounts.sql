@@ -0,0 +1,7 @@
+SELECT id, name, admin, active, COALESCE(external_id, ''), created_at, COALESCE(updated_at, created_at) FROM users
+ WHERE ($1::integer IS NULL OR id = $1)
+ AND ($2::text IS NULL OR name = $2)
+ AND ($3::text IS NULL OR external_id = $3)
+ AND ($4::boolean IS NULL OR active = $4)
+ AND ($5::boolean IS NULL OR admin = $5)
+ ORDER BY id LIMIT $6 OFFSET $7;
@@ -0,0 +1 @@
+SELECT id, name, scopes, apps, created_at, expires_at, last_used_at FROM personal_tokens WHERE user_id = $1 AND expires_at > NOW() ORDER BY created_at DESC;
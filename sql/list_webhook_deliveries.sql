@@ -0,0 +1,3 @@
+SELECT id, app, event, event_id, status, attempts, last_status, last_error, created_at, next_attempt_at, delivered_at FROM webhook_deliveries
+ WHERE ($1::text IS NULL OR app = $1) AND ($2::text IS NULL OR status = $2)
+ ORDER BY id DESC LIMIT $3;
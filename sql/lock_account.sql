@@ -0,0 +1 @@
+SELECT id, name, admin, active, COALESCE(external_id, ''), created_at, COALESCE(updated_at, created_at) FROM users WHERE id = $1 FOR UPDATE;
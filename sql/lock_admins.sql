@@ -0,0 +1,2 @@
+SELECT id, name, admin, active, COALESCE(external_id, ''), created_at, COALESCE(updated_at, created_at) FROM users
+ WHERE admin OR id = ANY($1) ORDER BY id FOR UPDATE;
@@ -0,0 +1,21 @@
+SELECT pg_advisory_xact_lock(hashtext('portal_migrate'));
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS active BOOLEAN NOT NULL DEFAULT TRUE;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS external_id text;
+
+DO $$
+BEGIN
+ IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conrelid = 'users'::regclass AND conname = 'users_external_id_key') THEN
+  ALTER TABLE users ADD CONSTRAINT users_external_id_key UNIQUE (external_id);
+ END IF;
+END $$;
+
+DO $$
+BEGIN
+ IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conrelid = 'credentials'::regclass AND conname = 'credentials_user_id_key') THEN
+  DELETE FROM credentials old USING credentials newer
+   WHERE old.user_id = newer.user_id
+   AND (COALESCE(old.updated_at, old.created_at), old.ctid) < (COALESCE(newer.updated_at, newer.created_at), newer.ctid);
+  ALTER TABLE credentials ADD CONSTRAINT credentials_user_id_key UNIQUE (user_id);
+ END IF;
+END $$;
@@ -0,0 +1,9 @@
+WITH new_user AS(
+ INSERT INTO users (name, admin, created_at) VALUES ($3, FALSE, NOW()) RETURNING id
+)
+INSERT INTO external_identities (provider, subject, user_id, created_at) VALUES (
+ $1,
+ $2,
+ (SELECT id FROM new_user),
+ NOW()
+) RETURNING user_id;
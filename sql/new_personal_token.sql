@@ -0,0 +1 @@
+INSERT INTO personal_tokens (user_id, name, token_hash, scopes, apps, created_at, expires_at) VALUES ($1, $2, $3, $4, $5, NOW(), NOW() + make_interval(days => $6)) RETURNING id, created_at, expires_at;
@@ -1,5 +1,5 @@
 WITH new_user AS(
- INSERT INTO users (name, admin, created_at) VALUES ($1, $3, NOW()) RETURNING id
+ INSERT INTO users (name, admin, active, external_id, created_at) VALUES ($1, $3, $5, NULLIF($4, ''), NOW()) RETURNING id
 )
 INSERT INTO credentials (user_id, password, created_at) VALUES (
  (SELECT id FROM new_user),
@@ -0,0 +1 @@
+INSERT INTO webhook_deliveries (app, event, event_id, payload, status, created_at, next_attempt_at) VALUES ($1, $2, $3, $4, 'pending', NOW(), NOW());
@@ -0,0 +1 @@
+DELETE FROM webhook_deliveries WHERE status <> 'pending' AND created_at < NOW() - make_interval(days => $1);
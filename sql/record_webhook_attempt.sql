@@ -0,0 +1,9 @@
+UPDATE webhook_deliveries SET
+ attempts = attempts + 1,
+ status = $2,
+ last_status = $3,
+ last_error = $4,
+ last_attempt_at = NOW(),
+ next_attempt_at = NOW() + make_interval(secs => $5),
+ delivered_at = CASE WHEN $2 = 'delivered' THEN NOW() END
+ WHERE id = $1;
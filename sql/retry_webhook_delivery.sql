@@ -0,0 +1 @@
+UPDATE webhook_deliveries SET status = 'pending', next_attempt_at = NOW() WHERE id = $1 AND status = 'failed' RETURNING id;
@@ -1,5 +1,9 @@
 \i sql/create_users.sql
 \i sql/create_credentials.sql
+\i sql/create_personal_tokens.sql
+\i sql/create_external_identities.sql
+\i sql/create_webhook_deliveries.sql
+\i sql/migrate.sql
 
 WITH new_user AS (
  INSERT INTO users (name, admin, created_at) VALUES ('shiba', TRUE, NOW()) RETURNING id
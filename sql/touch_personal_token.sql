@@ -0,0 +1 @@
+UPDATE personal_tokens SET last_used_at = NOW() WHERE id = $1 AND (last_used_at IS NULL OR last_used_at <= NOW() - make_interval(secs => $2));
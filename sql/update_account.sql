@@ -0,0 +1 @@
+UPDATE users SET name = $2, admin = $3, active = $4, external_id = NULLIF($5, ''), updated_at = NOW() WHERE id = $1 RETURNING updated_at;
@@ -1,4 +1,5 @@
 WITH other_user AS (
  SELECT id FROM users WHERE name = $1
 )
-UPDATE credentials SET password = $2 WHERE user_id = (SELECT id FROM other_user); 
+INSERT INTO credentials (user_id, password, created_at) SELECT id, $2, NOW() FROM other_user
+ ON CONFLICT (user_id) DO UPDATE SET password = EXCLUDED.password, updated_at = NOW() RETURNING user_id;
@@ -1 +0,0 @@
-UPDATE users SET name = $2 WHERE id = $1;
@@ -1 +1,2 @@
-UPDATE credentials SET password = $2 WHERE user_id = $1;
+INSERT INTO credentials (user_id, password, created_at) VALUES ($1, $2, NOW())
+ ON CONFLICT (user_id) DO UPDATE SET password = EXCLUDED.password, updated_at = NOW();
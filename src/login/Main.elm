@@ -24,10 +24,24 @@ type alias ActiveUser =
     }
 
     
+type alias LoginProvider =
+    { name : String
+    , url : String
+    }
+
+
+type alias LoginOptions =
+    { providers : List LoginProvider
+    , certificate : Bool
+    }
+
+
 type alias Model =
     { loginUsernameText : String
     , loginPasswordText : String
     , errorMessage : String
+    , providers : List LoginProvider
+    , certificateLogin : Bool
     }
 
 
@@ -36,8 +50,32 @@ init _ =
     ( { loginUsernameText = ""
       , loginPasswordText = ""
       , errorMessage = ""
+      , providers = []
+      , certificateLogin = False
       }
-    , Cmd.none )
+    , getProviders )
+
+
+getProviders : Cmd Msg
+getProviders =
+          Http.get
+                { url = "/login/providers"
+                , expect = Http.expectJson GotProviders loginOptionsDecoder
+                }
+
+
+loginOptionsDecoder : Decode.Decoder LoginOptions
+loginOptionsDecoder =
+    Decode.map2 LoginOptions
+        (Decode.field "providers" (Decode.list providerDecoder))
+        (Decode.field "certificate" Decode.bool)
+
+
+providerDecoder : Decode.Decoder LoginProvider
+providerDecoder =
+    Decode.map2 LoginProvider
+        (Decode.field "name" Decode.string)
+        (Decode.field "url" Decode.string)
 
 
 postLogin : String -> String -> Cmd Msg
@@ -48,6 +86,15 @@ postLogin username password =
                 , expect = Http.expectJson PostLogin activeUserDecoder
                 }
 
+
+postCertificateLogin : Cmd Msg
+postCertificateLogin =
+          Http.post
+                { url = "/login/certificate"
+                , body = Http.jsonBody (Encode.object [])
+                , expect = Http.expectJson PostLogin activeUserDecoder
+                }
+
               
 activeUserDecoder : Decode.Decoder ActiveUser
 activeUserDecoder =
@@ -71,7 +118,9 @@ type Msg
      = LoginUsernameInput String
      | LoginPasswordInput String
      | SubmitLogin
+     | SubmitCertificateLogin
      | PostLogin (Result Http.Error ActiveUser)
+     | GotProviders (Result Http.Error LoginOptions)
 
 
 activeUserToUrl : ActiveUser -> String
@@ -91,6 +140,9 @@ update msg model =
             SubmitLogin ->
                         ( model, postLogin model.loginUsernameText model.loginPasswordText )
 
+            SubmitCertificateLogin ->
+                        ( model, postCertificateLogin )
+
             PostLogin result ->
                       case result of
                            Ok activeUser ->
@@ -99,6 +151,14 @@ update msg model =
                            Err _ ->
                                ( { model | errorMessage = "An error has occurred" }, Cmd.none )
 
+            GotProviders result ->
+                      case result of
+                           Ok options ->
+                              ( { model | providers = options.providers, certificateLogin = options.certificate }, Cmd.none )
+
+                           Err _ ->
+                               ( model, Cmd.none )
+
 
 -- VIEW
 
@@ -117,4 +177,20 @@ loginView model =
          [ input [ onInput LoginUsernameInput, placeholder "Username", value model.loginUsernameText ] []
          , input [ onInput LoginPasswordInput, placeholder "Password", value model.loginPasswordText ] []
          , button [ onClick SubmitLogin ] [ text "Login" ]
+         , certificateLoginView model.certificateLogin
+         , div [] (List.map providerView model.providers)
          ]
+
+
+certificateLoginView : Bool -> Html Msg
+certificateLoginView enabled =
+     if enabled then
+        button [ onClick SubmitCertificateLogin ] [ text "Login with certificate" ]
+
+     else
+        text ""
+
+
+providerView : LoginProvider -> Html Msg
+providerView provider =
+     a [ href provider.url ] [ text ("Login with " ++ provider.name) ]
@@ -40,18 +40,26 @@ type alias Model =
   , adminChecked : Bool
   , id : Int
   , accessToken : String
+  , csrfToken : String
   , name : String
-  , apps : List String
+  , apps : List AppLink
   , admin : Bool
   }
 
 
+type alias AppLink =
+    { name : String
+    , url : String
+    }
+
+
 type alias Flags =
     { name : String
     , id : Int
     , admin : Bool
     , accessToken : String
-    , apps : List String
+    , csrfToken : String
+    , apps : List AppLink
     }
 
 
@@ -69,6 +77,7 @@ init flags url key =
     , adminChecked = False
     , id = flags.id
     , accessToken = flags.accessToken
+    , csrfToken = flags.csrfToken
     , name = flags.name
     , apps = flags.apps
     , admin = flags.admin
@@ -76,31 +85,42 @@ init flags url key =
   , Cmd.none )
 
 
+-- Every state changing request carries the session's CSRF token
+
+
+postWithCsrf : Model -> String -> Http.Body -> Http.Expect Msg -> Cmd Msg
+postWithCsrf model url body expect =
+    Http.request
+        { method = "POST"
+        , headers = [ Http.header "X-CSRF-Token" model.csrfToken ]
+        , url = url
+        , body = body
+        , expect = expect
+        , timeout = Nothing
+        , tracker = Nothing
+        }
+
+
 postChangeUsername : Model -> Cmd Msg
 postChangeUsername model =
-    Http.post
-        { url = "/update/username"
-        , body = Http.jsonBody (updateUsernameEncoder model)
-        , expect = Http.expectWhatever PostChangeUsername
-        }
+    postWithCsrf model "/update/username"
+        (Http.jsonBody (updateUsernameEncoder model))
+        (Http.expectWhatever PostChangeUsername)
 
 
 updateUsernameEncoder : Model -> Encode.Value
 updateUsernameEncoder model =
     Encode.object
         [ ("username", Encode.string model.changeUsernameText)
-        , ("id", Encode.string (String.fromInt model.id))
         , ("access_token", Encode.string model.accessToken)
         ]
 
         
 postChangePassword : Model -> Cmd Msg
 postChangePassword model =
-    Http.post
-        { url = "/update/password"
-        , body = Http.jsonBody (updatePasswordEncoder model)
-        , expect = Http.expectWhatever PostChangeUsername
-        }
+    postWithCsrf model "/update/password"
+        (Http.jsonBody (updatePasswordEncoder model))
+        (Http.expectWhatever PostChangeUsername)
 
         
 updatePasswordEncoder : Model -> Encode.Value
@@ -108,18 +128,15 @@ updatePasswordEncoder model =
     Encode.object
         [ ("new_password", Encode.string model.changePasswordText)
         , ("old_password", Encode.string model.oldPasswordText)
-        , ("id", Encode.string (String.fromInt model.id))
         , ("access_token", Encode.string model.accessToken)
         ]
         
 
 postNewUser : Model -> Cmd Msg
 postNewUser model =
-    Http.post
-        { url = "/register/credentials"
-        , body = Http.jsonBody (newUserEncoder model)
-        , expect = Http.expectWhatever PostAdminAction
-        }
+    postWithCsrf model "/register/credentials"
+        (Http.jsonBody (newUserEncoder model))
+        (Http.expectWhatever PostAdminAction)
 
         
 newUserEncoder : Model -> Encode.Value
@@ -134,18 +151,15 @@ newUserEncoder model =
         Encode.object
             [ ("username", Encode.string model.newUserUsernameText)
             , ("password", Encode.string model.newUserPasswordText)
-            , ("id", Encode.string (String.fromInt model.id))
             , ("admin", Encode.string admin)
             ]
 
 
 postNewPassword : Model -> Cmd Msg
 postNewPassword model =
-    Http.post
-        { url = "/admin/password"
-        , body = Http.jsonBody (adminActionEncoder model)
-        , expect = Http.expectJson PostNewPassword newPasswordDecoder
-        }
+    postWithCsrf model "/admin/password"
+        (Http.jsonBody (adminActionEncoder model))
+        (Http.expectJson PostNewPassword newPasswordDecoder)
         
         
 type alias NewPasswordBody =
@@ -160,29 +174,30 @@ newPasswordDecoder =
 
 postMakeAdmin : Model -> Cmd Msg
 postMakeAdmin model =
-    Http.post
-        { url = "/admin/new"
-        , body = Http.jsonBody (adminActionEncoder model)
-        , expect = Http.expectWhatever PostAdminAction
-        }
+    postWithCsrf model "/admin/new"
+        (Http.jsonBody (adminActionEncoder model))
+        (Http.expectWhatever PostAdminAction)
 
 
 postRevokeAdmin : Model -> Cmd Msg
 postRevokeAdmin model =
-    Http.post
-        { url = "/admin/revoke"
-        , body = Http.jsonBody (adminActionEncoder model)
-        , expect = Http.expectWhatever PostAdminAction
-        }
+    postWithCsrf model "/admin/revoke"
+        (Http.jsonBody (adminActionEncoder model))
+        (Http.expectWhatever PostAdminAction)
 
 
 postDeleteUser : Model -> Cmd Msg
 postDeleteUser model =
-    Http.post
-        { url = "/admin/delete/user"
-        , body = Http.jsonBody (adminActionEncoder model)
-        , expect = Http.expectWhatever PostAdminAction
-        }
+    postWithCsrf model "/admin/delete/user"
+        (Http.jsonBody (adminActionEncoder model))
+        (Http.expectWhatever PostAdminAction)
+
+
+postLogout : Model -> String -> Cmd Msg
+postLogout model url =
+    postWithCsrf model url
+        (Http.jsonBody (Encode.object []))
+        (Http.expectWhatever PostLogout)
 
 
 adminActionEncoder : Model -> Encode.Value
@@ -190,7 +205,6 @@ adminActionEncoder model =
     Encode.object
         [ ("username", Encode.string model.otherUsernameText)
         , ("access_token", Encode.string model.accessToken)
-        , ("id", Encode.string (String.fromInt model.id))
         ]
         
         
@@ -218,6 +232,17 @@ type Msg
   | PostChangePassword (Result Http.Error ())
   | PostAdminAction (Result Http.Error ())
   | PostNewPassword (Result Http.Error NewPasswordBody)
+  | Logout
+  | LogoutEverywhere
+  | PostLogout (Result Http.Error ())
+
+
+-- App launches are served by Portal itself, the page has to be left for them
+
+
+isLaunch : Url.Url -> Bool
+isLaunch url =
+  String.startsWith "/launch/" url.path || url.path == "/saml/launch"
 
 
 update : Msg -> Model -> ( Model, Cmd Msg )
@@ -226,7 +251,10 @@ update msg model =
     LinkClicked urlRequest ->
       case urlRequest of
         Browser.Internal url ->
-          ( model, Nav.pushUrl model.key (Url.toString url) )
+          if isLaunch url then
+            ( model, Nav.load (Url.toString url) )
+          else
+            ( model, Nav.pushUrl model.key (Url.toString url) )
 
         Browser.External href ->
           ( model, Nav.load href )
@@ -292,6 +320,15 @@ update msg model =
     PostAdminAction _ ->
         ( model, Cmd.none )
 
+    Logout ->
+        ( model, postLogout model "/logout" )
+
+    LogoutEverywhere ->
+        ( model, postLogout model "/logout/all" )
+
+    PostLogout _ ->
+        ( model, Nav.load "/" )
+
 
 -- SUBSCRIPTIONS
 
@@ -344,12 +381,17 @@ viewLink path =
 welcomeView : Model -> Html Msg
 welcomeView model =
     table []
-        [ tr [] ((td [] [ viewLink "/settings"] ) :: List.map appView model.apps) ]
+        [ tr [] ((td [] [ viewLink "/settings"] ) :: List.map appView model.apps)
+        , tr []
+            [ td [] [ button [ onClick Logout ] [ text "Logout" ] ]
+            , td [] [ button [ onClick LogoutEverywhere ] [ text "Logout everywhere" ] ]
+            ]
+        ]
 
             
-appView : String -> Html Msg
-appView name =
-    td [] [ a [ href ("/" ++ name) ] [ text name ] ]
+appView : AppLink -> Html Msg
+appView app =
+    td [] [ a [ href app.url ] [ text app.name ] ]
 
         
 settingsView : Model -> Html Msg
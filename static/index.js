@@ -0,0 +1,3 @@
+var app = Elm.Main.init({
+  node: document.getElementById('elm')
+});
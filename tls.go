@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+type TLSConfig struct {
+	CertFile string `toml:"cert_file"`
+	KeyFile string `toml:"key_file"`
+	MinVersion string `toml:"min_version"`
+	CipherSuites []string `toml:"cipher_suites"`
+	RedirectPort string `toml:"redirect_port"`
+	HSTSMaxAge int `toml:"hsts_max_age"`
+	ClientCAFile string `toml:"client_ca_file"`
+	ClientCertIdentity string `toml:"client_cert_identity"`
+}
+
+func (t *TLSConfig) Enabled() bool {
+	return t.CertFile != "" && t.KeyFile != ""
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func parseTLSVersion(version string) (uint16, error) {
+	if version == "" {
+		return tls.VersionTLS12, nil
+	}
+
+	v, ok := tlsVersions[version]; if !ok {
+		return 0, fmt.Errorf("Unknown TLS min_version %s", version)
+	}
+
+	return v, nil
+}
+
+func parseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[name]; if !ok {
+			return nil, fmt.Errorf("Unknown or insecure TLS cipher suite %s", name)
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+//Reloads the certificate from disk whenever the cert or key file changes,
+//so rotated certificates are picked up without restarting the server
+type certReloader struct {
+	certFile string
+	keyFile string
+	mu sync.RWMutex
+	cert *tls.Certificate
+	certMod time.Time
+	keyMod time.Time
+	//Files of the last pair that failed to load, it is not tried again until they change
+	failedCertMod time.Time
+	failedKeyMod time.Time
+	lastAttempt time.Time
+}
+
+//Least time between two reload attempts, so a rotation written over several seconds isn't retried on every handshake
+const certReloadBackoff = 10 * time.Second
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	c := &certReloader{
+		certFile: certFile,
+		keyFile: keyFile,
+	}
+
+	err := c.reload(); if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *certReloader) modTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(c.certFile); if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	keyInfo, err := os.Stat(c.keyFile); if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+func (c *certReloader) reload() error {
+	certMod, keyMod, err := c.modTimes(); if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile); if err != nil {
+		c.mu.Lock()
+		c.failedCertMod = certMod
+		c.failedKeyMod = keyMod
+		c.mu.Unlock()
+		return err
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.certMod = certMod
+	c.keyMod = keyMod
+	c.mu.Unlock()
+
+	return nil
+}
+
+//Whether the files changed since they were loaded and are worth a try now. Claims the
+//attempt, so concurrent handshakes don't all reload the same files
+func (c *certReloader) due(now time.Time) bool {
+	certMod, keyMod, err := c.modTimes(); if err != nil {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if certMod.Equal(c.certMod) && keyMod.Equal(c.keyMod) {
+		return false
+	}
+	if (certMod.Equal(c.failedCertMod) && keyMod.Equal(c.failedKeyMod)) || now.Sub(c.lastAttempt) < certReloadBackoff {
+		return false
+	}
+	c.lastAttempt = now
+	return true
+}
+
+func (c *certReloader) refresh(now time.Time) {
+	if c.due(now) {
+		//A half written cert/key pair fails to load, keep serving the old one until both are in place
+		err := c.reload(); if err != nil {
+			logger.Error("Reloading TLS certificate failed", "component", "tls", "cert_file", c.certFile, "error", err.Error())
+		}
+	}
+}
+
+func (c *certReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.refresh(time.Now())
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+func newTLSConfig(t *TLSConfig) (*tls.Config, error) {
+	minVersion, err := parseTLSVersion(t.MinVersion); if err != nil {
+		return nil, err
+	}
+
+	cipherSuites, err := parseCipherSuites(t.CipherSuites); if err != nil {
+		return nil, err
+	}
+
+	reloader, err := newCertReloader(t.CertFile, t.KeyFile); if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion: minVersion,
+		CipherSuites: cipherSuites,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if t.ClientCAFile != "" {
+		pool, err := loadClientCAs(t.ClientCAFile); if err != nil {
+			return nil, err
+		}
+
+		//Certificates are optional so password users on the same listener are unaffected,
+		//but any certificate that is presented must chain to the configured CA bundle
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		tlsConfig.ClientCAs = pool
+	}
+
+	return tlsConfig, nil
+}
+
+func hstsMiddleware(next http.Handler) http.Handler {
+	maxAge := config.TLS.HSTSMaxAge
+	if maxAge == 0 {
+		maxAge = 63072000
+	}
+	header := fmt.Sprintf("max-age=%d; includeSubDomains", maxAge)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			w.Header().Set("Strict-Transport-Security", header)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func redirectHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		_, port, _ := net.SplitHostPort(config.Port)
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+
+		http.Redirect(w, r, "https://" + host + r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"testing"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func writeSelfSignedCert(t *testing.T, dir string, commonName string, modTime time.Time) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader); if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject: pkix.Name{CommonName: commonName},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key); if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key); if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	touch(t, certFile, modTime)
+	touch(t, keyFile, modTime)
+
+	return certFile, keyFile
+}
+
+func touch(t *testing.T, filename string, modTime time.Time) {
+	err := os.Chtimes(filename, modTime, modTime); if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func leafCommonName(t *testing.T, r *certReloader) string {
+	cert, err := r.GetCertificate(nil); if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0]); if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	return leaf.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+
+	certFile, keyFile := writeSelfSignedCert(t, dir, "first", now.Add(-time.Minute))
+
+	reloader, err := newCertReloader(certFile, keyFile); if err != nil {
+		t.Fatal("Loading certificate failed", err.Error())
+	}
+
+	if leafCommonName(t, reloader) != "first" {
+		t.Fatal("Initial certificate was not served")
+	}
+
+	writeSelfSignedCert(t, dir, "second", now)
+
+	if leafCommonName(t, reloader) != "second" {
+		t.Fatal("Rotated certificate was not reloaded")
+	}
+
+	//A broken rotation should keep serving the last good certificate
+	err = ioutil.WriteFile(keyFile, []byte("garbage"), 0600); if err != nil {
+		t.Fatal(err.Error())
+	}
+	touch(t, keyFile, now.Add(time.Minute))
+
+	if leafCommonName(t, reloader) != "second" {
+		t.Fatal("Broken certificate replaced the last good one")
+	}
+}
+
+func TestCertReloaderBackoff(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+
+	certFile, keyFile := writeSelfSignedCert(t, dir, "first", now.Add(-time.Minute))
+	reloader, err := newCertReloader(certFile, keyFile); if err != nil {
+		t.Fatal("Loading certificate failed", err.Error())
+	}
+
+	err = ioutil.WriteFile(keyFile, []byte("garbage"), 0600); if err != nil {
+		t.Fatal(err.Error())
+	}
+	touch(t, keyFile, now)
+
+	reloader.refresh(now)
+	if !reloader.lastAttempt.Equal(now) || !reloader.failedKeyMod.Equal(now) {
+		t.Fatal("Failed reload was not recorded")
+	}
+
+	//The same broken files are not tried again, however much time passes
+	reloader.refresh(now.Add(time.Hour))
+	if !reloader.lastAttempt.Equal(now) {
+		t.Fatal("Broken pair was retried before the files changed")
+	}
+
+	//Fixed files are picked up, but no sooner than the backoff allows
+	writeSelfSignedCert(t, dir, "second", now.Add(time.Minute))
+	reloader.refresh(now.Add(time.Second))
+	if leafCommonName(t, reloader) != "first" {
+		t.Fatal("Reload was retried within the backoff")
+	}
+
+	reloader.refresh(now.Add(certReloadBackoff))
+	reloader.mu.RLock()
+	leaf, _ := x509.ParseCertificate(reloader.cert.Certificate[0])
+	reloader.mu.RUnlock()
+	if leaf.Subject.CommonName != "second" {
+		t.Fatal("Fixed certificate was not reloaded after the backoff")
+	}
+}
+
+func TestTLSConfigParsing(t *testing.T) {
+	_, err := parseTLSVersion("1.4"); if err == nil {
+		t.Fatal("Unknown TLS version was accepted")
+	}
+
+	_, err = parseCipherSuites([]string{"TLS_RSA_WITH_RC4_128_SHA"}); if err == nil {
+		t.Fatal("Insecure cipher suite was accepted")
+	}
+
+	ids, err := parseCipherSuites([]string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}); if err != nil || len(ids) != 1 {
+		t.Fatal("Secure cipher suite was rejected")
+	}
+}
+
+func TestCertificateUserName(t *testing.T) {
+	cert := &x509.Certificate{
+		Subject: pkix.Name{CommonName: "kiosk"},
+		EmailAddresses: []string{"kiosk@foo.portal"},
+	}
+
+	name, err := certificateUserName(cert, ""); if err != nil || name != "kiosk" {
+		t.Fatal("Common name was not mapped to a user name")
+	}
+
+	name, err = certificateUserName(cert, "email"); if err != nil || name != "kiosk@foo.portal" {
+		t.Fatal("Email SAN was not mapped to a user name")
+	}
+
+	_, err = certificateUserName(cert, "dns"); if err == nil {
+		t.Fatal("Missing DNS SAN was accepted")
+	}
+}
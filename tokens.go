@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+)
+
+//Every token Portal hands out starts with a prefix naming its type, so a leaked
+//token can be recognized by secret scanners and routed to the right store
+const (
+	sessionTokenPrefix = "pst_"
+	personalTokenPrefix = "pat_"
+)
+
+const tokenBytes = 32
+
+//256 random bits, base64url encoded so every bit of randomness survives
+func newToken(prefix string) string {
+	b := make([]byte, tokenBytes)
+	_, err := rand.Read(b); if err != nil {
+		panic(err)
+	}
+	return prefix + base64.RawURLEncoding.EncodeToString(b)
+}
+
+func newSessionToken() string {
+	return newToken(sessionTokenPrefix)
+}
+
+//Only this hash is kept server-side. Looking tokens up by their SHA-256 means a
+//timing difference in the lookup tells an attacker nothing about the token itself
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newPersonalToken() string {
+	return newToken(personalTokenPrefix)
+}
+
+func isSessionToken(token string) bool {
+	return strings.HasPrefix(token, sessionTokenPrefix)
+}
+
+func isPersonalToken(token string) bool {
+	return strings.HasPrefix(token, personalTokenPrefix)
+}
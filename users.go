@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+	"github.com/lib/pq"
+)
+
+//A user as the admin API and SCIM provisioning see it
+type Account struct {
+	Id int64
+	Name string
+	Admin bool
+	Active bool
+	//Id of the user in the provisioning client, like an HR system
+	ExternalId string
+	Created time.Time
+	Modified time.Time
+	//Write only, set it to change the password
+	Password string
+}
+
+//Weak because it covers what a client sees rather than the exact bytes sent
+func weakETag(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return `W/"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+//Changes whenever anything a client can see about the account does
+func (a *Account) ETag() string {
+	return weakETag(fmt.Sprintf("%d\x00%s\x00%t\x00%t\x00%s", a.Id, a.Name, a.Admin, a.Active, a.ExternalId))
+}
+
+//Only the non nil fields narrow the list
+type AccountFilter struct {
+	Id *int64
+	Name *string
+	ExternalId *string
+	Active *bool
+	Admin *bool
+}
+
+//Account changes shared by the admin API and SCIM, so both follow the same
+//rules and revoke the same sessions whatever route the change came through
+type UserStore struct {
+	create *sql.Stmt
+	get *sql.Stmt
+	lock *sql.Stmt
+	lockAdmins *sql.Stmt
+	update *sql.Stmt
+	password *sql.Stmt
+	list *sql.Stmt
+	count *sql.Stmt
+	delete *sql.Stmt
+}
+
+var userStore *UserStore
+
+func newUserStore() *UserStore {
+	return &UserStore{
+		create: prepareQuery("sql/new_user_credentials.sql"),
+		get: prepareQuery("sql/get_account.sql"),
+		lock: prepareQuery("sql/lock_account.sql"),
+		lockAdmins: prepareQuery("sql/lock_admins.sql"),
+		update: prepareQuery("sql/update_account.sql"),
+		password: prepareQuery("sql/update_user_password.sql"),
+		list: prepareQuery("sql/list_accounts.sql"),
+		count: prepareQuery("sql/count_accounts.sql"),
+		delete: prepareQuery("sql/delete_user.sql"),
+	}
+}
+
+func scanAccount(row *sql.Row) (*Account, error) {
+	var a Account
+	err := row.Scan(&a.Id, &a.Name, &a.Admin, &a.Active, &a.ExternalId, &a.Created, &a.Modified); if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+//Creates the user with password credentials, a is filled in with what was stored
+func (s *UserStore) Create(a *Account) error {
+	err := s.create.QueryRow(a.Name, a.Password, a.Admin, a.ExternalId, a.Active).Scan(&a.Id); if err != nil {
+		return err
+	}
+	a.Password = ""
+
+	stored, err := s.Get(a.Id); if err != nil {
+		return err
+	}
+	*a = *stored
+
+	webhooks.Emit(eventUserCreated, &UserEventData{UserId: a.Id, Username: a.Name})
+	return nil
+}
+
+//Portal has no group directory, everyone is in users and admins are in admins too
+func userGroups(admin bool) []string {
+	if admin {
+		return []string{"users", "admins"}
+	}
+	return []string{"users"}
+}
+
+func (s *UserStore) Get(id int64) (*Account, error) {
+	return scanAccount(s.get.QueryRow(id))
+}
+
+func (s *UserStore) List(filter *AccountFilter, offset int, limit int) ([]*Account, int, error) {
+	args := []interface{}{filter.Id, filter.Name, filter.ExternalId, filter.Active, filter.Admin}
+
+	var total int
+	err := s.count.QueryRow(args...).Scan(&total); if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := s.list.Query(append(args, limit, offset)...); if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	accounts := make([]*Account, 0)
+	for rows.Next() {
+		var a Account
+		err = rows.Scan(&a.Id, &a.Name, &a.Admin, &a.Active, &a.ExternalId, &a.Created, &a.Modified); if err != nil {
+			return nil, 0, err
+		}
+		accounts = append(accounts, &a)
+	}
+
+	return accounts, total, rows.Err()
+}
+
+//Locks the account while change edits it, so concurrent updates can't undo each
+//other. Errors from change are returned as is and nothing is saved. Deactivating
+//the user or changing their password ends all their sessions
+func (s *UserStore) Update(r *http.Request, id int64, change func(a *Account) error) (*Account, error) {
+	tx, err := db.Begin(); if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	a, err := scanAccount(tx.Stmt(s.lock).QueryRow(id)); if err != nil {
+		return nil, err
+	}
+	before := *a
+
+	err = change(a); if err != nil {
+		return nil, err
+	}
+	a.Id = before.Id
+
+	err = tx.Stmt(s.update).QueryRow(a.Id, a.Name, a.Admin, a.Active, a.ExternalId).Scan(&a.Modified); if err != nil {
+		return nil, err
+	}
+
+	//Users from an identity provider have no credentials yet, setting a password creates them
+	if a.Password != "" {
+		_, err = tx.Stmt(s.password).Exec(a.Id, a.Password); if err != nil {
+			return nil, err
+		}
+	}
+
+	err = tx.Commit(); if err != nil {
+		return nil, err
+	}
+
+	if (before.Active && !a.Active) || a.Password != "" {
+		revoked := activeUsers.DeleteUser(a.Id, "")
+		requestLogger(r, "session").Info("Sessions revoked after account change", "target_user_id", a.Id, "revoked", revoked)
+	}
+	accountChanged(&before, a)
+	a.Password = ""
+
+	return a, nil
+}
+
+//Tells apps what changed about an account
+func accountChanged(before *Account, after *Account) {
+	data := &UserEventData{UserId: after.Id, Username: after.Name}
+
+	if before.Name != after.Name {
+		webhooks.Emit(eventUserRenamed, &UserEventData{UserId: after.Id, Username: after.Name, PreviousUsername: before.Name})
+	}
+	if before.Active != after.Active {
+		event := eventUserActivated
+		if !after.Active {
+			event = eventUserDeactivated
+		}
+		webhooks.Emit(event, data)
+	}
+	if before.Admin != after.Admin {
+		event := eventAdminGranted
+		if !after.Admin {
+			event = eventAdminRevoked
+		}
+		webhooks.Emit(event, data)
+	}
+	if after.Password != "" {
+		webhooks.Emit(eventPasswordChanged, data)
+	}
+}
+
+func (s *UserStore) SetAdmin(r *http.Request, id int64, admin bool) error {
+	_, err := s.Update(r, id, func(a *Account) error {
+		a.Admin = admin
+		return nil
+	})
+	return err
+}
+
+//Changes who is an admin in one transaction. The current admins and the users in ids are
+//locked first and handed to change, which returns the ids that should be admins. Errors
+//from change are returned as is and nothing is saved. Returns the accounts that changed
+func (s *UserStore) SetAdmins(r *http.Request, ids []int64, change func(locked []*Account) (map[int64]bool, error)) ([]*Account, error) {
+	tx, err := db.Begin(); if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Stmt(s.lockAdmins).Query(pq.Array(ids)); if err != nil {
+		return nil, err
+	}
+	var locked []*Account
+	for rows.Next() {
+		var a Account
+		err = rows.Scan(&a.Id, &a.Name, &a.Admin, &a.Active, &a.ExternalId, &a.Created, &a.Modified); if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		locked = append(locked, &a)
+	}
+	rows.Close()
+	err = rows.Err(); if err != nil {
+		return nil, err
+	}
+
+	admins, err := change(locked); if err != nil {
+		return nil, err
+	}
+
+	var before, changed []*Account
+	for _, a := range locked {
+		if a.Admin == admins[a.Id] {
+			continue
+		}
+		previous := *a
+		a.Admin = admins[a.Id]
+		err = tx.Stmt(s.update).QueryRow(a.Id, a.Name, a.Admin, a.Active, a.ExternalId).Scan(&a.Modified); if err != nil {
+			return nil, err
+		}
+		before = append(before, &previous)
+		changed = append(changed, a)
+	}
+
+	err = tx.Commit(); if err != nil {
+		return nil, err
+	}
+
+	for i, a := range changed {
+		accountChanged(before[i], a)
+	}
+	return changed, nil
+}
+
+//Deletes the user along with their credentials, tokens and sessions
+func (s *UserStore) Delete(r *http.Request, id int64) error {
+	var name string
+	err := s.delete.QueryRow(id).Scan(&id, &name); if err != nil {
+		return err
+	}
+	webhooks.Emit(eventUserDeleted, &UserEventData{UserId: id, Username: name})
+
+	revoked := activeUsers.DeleteUser(id, "")
+	requestLogger(r, "session").Info("Sessions revoked for deleted user", "target_user_id", id, "revoked", revoked)
+	return nil
+}
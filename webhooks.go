@@ -0,0 +1,453 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"github.com/robfig/cron"
+)
+
+type WebhooksConfig struct {
+	PollInterval Duration `toml:"poll_interval"`
+	Timeout Duration
+	//Deliveries still failing after this many attempts are given up on
+	MaxAttempts int `toml:"max_attempts"`
+	//Finished deliveries are kept this long as the delivery log
+	RetentionDays int `toml:"retention_days"`
+}
+
+const (
+	eventUserCreated = "user.created"
+	eventUserDeleted = "user.deleted"
+	eventUserRenamed = "user.renamed"
+	eventUserDeactivated = "user.deactivated"
+	eventUserActivated = "user.activated"
+	eventPasswordChanged = "user.password_changed"
+	eventSessionRevoked = "session.revoked"
+	eventAdminGranted = "admin.granted"
+	eventAdminRevoked = "admin.revoked"
+)
+
+var webhookEvents = map[string]bool{
+	eventUserCreated: true,
+	eventUserDeleted: true,
+	eventUserRenamed: true,
+	eventUserDeactivated: true,
+	eventUserActivated: true,
+	eventPasswordChanged: true,
+	eventSessionRevoked: true,
+	eventAdminGranted: true,
+	eventAdminRevoked: true,
+}
+
+//Where an app in apps.toml wants to hear about events, under [<app>.webhook]
+type AppWebhook struct {
+	URL string `toml:"url"`
+	//Empty means every event
+	Events []string `toml:"events"`
+}
+
+func (h *AppWebhook) validate() error {
+	u, err := url.Parse(h.URL); if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("webhook url must be an absolute http or https URL")
+	}
+
+	for _, event := range h.Events {
+		if !webhookEvents[event] {
+			return fmt.Errorf("unknown webhook event %s", event)
+		}
+	}
+	return nil
+}
+
+func (h *AppWebhook) Subscribes(event string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, e := range h.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+//What is posted to the app, the same body goes to every subscribed app
+type WebhookEvent struct {
+	Id string `json:"id"`
+	Type string `json:"type"`
+	CreatedAt time.Time `json:"createdAt"`
+	Data interface{} `json:"data"`
+}
+
+type UserEventData struct {
+	UserId int64 `json:"userId"`
+	Username string `json:"username"`
+	PreviousUsername string `json:"previousUsername,omitempty"`
+}
+
+type SessionEventData struct {
+	UserId int64 `json:"userId"`
+	SessionIds []string `json:"sessionIds"`
+}
+
+const (
+	webhookSignatureHeader = "Portal-Signature"
+	webhookPending = "pending"
+	webhookDelivered = "delivered"
+	webhookFailed = "failed"
+	webhookBatchSize = 20
+	webhookMinBackoff = 30 * time.Second
+	webhookMaxBackoff = 6 * time.Hour
+)
+
+//Signs the timestamp and the body with the app secret, like t=1700000000,v1=<hex HMAC-SHA256 of "t.body">.
+//The timestamp lets apps refuse old deliveries replayed at them
+func signWebhook(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+//Doubles from webhookMinBackoff with every failed attempt, up to webhookMaxBackoff
+func webhookBackoff(attempts int) time.Duration {
+	backoff := webhookMinBackoff
+	for i := 1; i < attempts && backoff < webhookMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > webhookMaxBackoff {
+		backoff = webhookMaxBackoff
+	}
+	return backoff
+}
+
+//Deliveries are queued in the database, so events survive restarts and several
+//Portal instances can work the same queue without delivering anything twice
+type WebhookQueue struct {
+	enqueue *sql.Stmt
+	claim *sql.Stmt
+	record *sql.Stmt
+	prune *sql.Stmt
+	list *sql.Stmt
+	retry *sql.Stmt
+
+	client *http.Client
+	cron *cron.Cron
+	running sync.Mutex
+}
+
+//Unit tests run without a database, Emit and backchannelLogout do nothing while it is nil
+var webhooks *WebhookQueue
+
+func newWebhookQueue() *WebhookQueue {
+	return &WebhookQueue{
+		enqueue: prepareQuery("sql/new_webhook_delivery.sql"),
+		claim: prepareQuery("sql/claim_webhook_deliveries.sql"),
+		record: prepareQuery("sql/record_webhook_attempt.sql"),
+		prune: prepareQuery("sql/prune_webhook_deliveries.sql"),
+		list: prepareQuery("sql/list_webhook_deliveries.sql"),
+		retry: prepareQuery("sql/retry_webhook_delivery.sql"),
+		client: &http.Client{
+			Timeout: config.Webhooks.Timeout.Duration,
+			//A redirect is a failed delivery, the app should register the final URL
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+//Queues the event for every app subscribed to it. Failing to queue never fails
+//the change that caused the event, it is logged instead
+func (q *WebhookQueue) Emit(event string, data interface{}) {
+	if q == nil {
+		return
+	}
+
+	e := &WebhookEvent{Id: newToken("evt_"), Type: event, CreatedAt: time.Now().UTC(), Data: data}
+	payload, err := json.Marshal(e); if err != nil {
+		logger.Error("Encoding webhook event failed", "component", "webhooks", "event", event, "error", err.Error())
+		return
+	}
+
+	for name, app := range apps.Map {
+		if app.Webhook == nil || !app.Webhook.Subscribes(event) {
+			continue
+		}
+
+		_, err = q.enqueue.Exec(name, event, e.Id, string(payload)); if err != nil {
+			logger.Error("Queueing webhook delivery failed", "component", "webhooks", "app", name, "event", event, "error", err.Error())
+		}
+	}
+}
+
+type webhookDelivery struct {
+	id int64
+	app string
+	event string
+	eventId string
+	payload string
+	attempts int
+}
+
+func (q *WebhookQueue) deliver(app *App, d *webhookDelivery, now time.Time) (int, error) {
+	req, err := http.NewRequest("POST", app.Webhook.URL, strings.NewReader(d.payload)); if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Portal-Webhooks")
+	req.Header.Set("Portal-Event", d.event)
+	req.Header.Set("Portal-Delivery", strconv.FormatInt(d.id, 10))
+	req.Header.Set(webhookSignatureHeader, signWebhook(app.Secret, now, []byte(d.payload)))
+
+	resp, err := q.client.Do(req); if err != nil {
+		return 0, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64 << 10))
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("app answered HTTP %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+const maxWebhookErrorLength = 200
+
+//How long claimed rows stay hidden from other instances. Deliveries run one after another,
+//so the lease covers every one in the batch timing out plus one timeout of slack
+func webhookLease(timeout time.Duration) time.Duration {
+	return (webhookBatchSize + 1) * timeout
+}
+
+//Claims a batch of due deliveries and attempts each once. A claim leases the rows until the
+//whole batch could have timed out, so a crashed instance's batch is picked up again instead of lost
+func (q *WebhookQueue) dispatch(now time.Time) int {
+	if !q.running.TryLock() {
+		return 0
+	}
+	defer q.running.Unlock()
+	l := logger.With("component", "webhooks")
+
+	rows, err := q.claim.Query(webhookBatchSize, webhookLease(config.Webhooks.Timeout.Duration).Seconds()); if err != nil {
+		l.Error("Claiming webhook deliveries failed", "error", err.Error())
+		return 0
+	}
+
+	var batch []*webhookDelivery
+	for rows.Next() {
+		var d webhookDelivery
+		err = rows.Scan(&d.id, &d.app, &d.event, &d.eventId, &d.payload, &d.attempts); if err != nil {
+			l.Error("Reading webhook delivery failed", "error", err.Error())
+			continue
+		}
+		batch = append(batch, &d)
+	}
+	rows.Close()
+
+	for _, d := range batch {
+		status, err, gone := 0, error(nil), false
+		app, ok := apps.App(d.app)
+		switch {
+		case d.event == backchannelLogoutDelivery && ok && app.BackchannelLogoutURI != "":
+			status, err = q.deliverLogout(app, d, now)
+		case d.event != backchannelLogoutDelivery && ok && app.Webhook != nil:
+			status, err = q.deliver(app, d, now)
+		default:
+			err, gone = fmt.Errorf("app no longer has an endpoint for %s", d.event), true
+		}
+
+		result, next := webhookDelivered, time.Duration(0)
+		var lastError sql.NullString
+		if err != nil {
+			lastError = sql.NullString{String: err.Error(), Valid: true}
+			if len(lastError.String) > maxWebhookErrorLength {
+				lastError.String = lastError.String[:maxWebhookErrorLength]
+			}
+
+			result, next = webhookPending, webhookBackoff(d.attempts + 1)
+			if gone || d.attempts + 1 >= config.Webhooks.MaxAttempts {
+				result = webhookFailed
+			}
+		}
+
+		lastStatus := sql.NullInt64{Int64: int64(status), Valid: status != 0}
+		_, dbErr := q.record.Exec(d.id, result, lastStatus, lastError, next.Seconds()); if dbErr != nil {
+			l.Error("Recording webhook attempt failed", "delivery_id", d.id, "error", dbErr.Error())
+		}
+		webhookAttempted(result)
+
+		if err != nil {
+			l.Warn("Webhook delivery failed", "app", d.app, "event", d.event, "delivery_id", d.id, "attempt", d.attempts + 1, "result", result, "error", lastError.String)
+		} else {
+			l.Info("Webhook delivered", "app", d.app, "event", d.event, "delivery_id", d.id)
+		}
+	}
+
+	return len(batch)
+}
+
+func (q *WebhookQueue) Start() {
+	q.cron = cron.New()
+	q.cron.AddFunc(fmt.Sprintf("@every %s", config.Webhooks.PollInterval.Duration), func() {
+		q.dispatch(time.Now())
+	})
+	q.cron.AddFunc("@hourly", func() {
+		result, err := q.prune.Exec(config.Webhooks.RetentionDays); if err != nil {
+			logger.Error("Pruning webhook delivery log failed", "component", "webhooks", "error", err.Error())
+			return
+		}
+		pruned, _ := result.RowsAffected()
+		logger.Info("Webhook delivery log pruned", "component", "webhooks", "pruned", pruned)
+	})
+	q.cron.Start()
+}
+
+func (q *WebhookQueue) Close() {
+	if q != nil && q.cron != nil {
+		q.cron.Stop()
+	}
+}
+
+type WebhookDeliveryInfo struct {
+	Id int64 `json:"id"`
+	App string `json:"app"`
+	Event string `json:"event"`
+	EventId string `json:"eventId"`
+	Status string `json:"status"`
+	Attempts int `json:"attempts"`
+	LastStatus *int64 `json:"lastStatus"`
+	LastError *string `json:"lastError"`
+	CreatedAt time.Time `json:"createdAt"`
+	NextAttemptAt *time.Time `json:"nextAttemptAt"`
+	DeliveredAt *time.Time `json:"deliveredAt"`
+}
+
+type WebhookDeliveriesResponse struct {
+	Deliveries []WebhookDeliveryInfo `json:"deliveries"`
+}
+
+type RetryWebhookRequest struct {
+	Id int64 `json:"id"`
+}
+
+func (req *RetryWebhookRequest) Validate() *APIError {
+	if req.Id <= 0 {
+		return badRequest("missing_field", "id is required")
+	}
+	return nil
+}
+
+const webhookLogLimit = 100
+
+//The newest deliveries, optionally of one app or in one status
+func adminWebhookDeliveriesHandler() http.HandlerFunc {
+	stmt := prepareQuery("sql/check_admin.sql")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !requireGet(w, r) {
+			return
+		}
+
+		p, ok := principalFrom(r); if !ok {
+			writeError(w, errInvalidSession)
+			return
+		}
+
+		if !requireAdmin(w, r, stmt, p) {
+			return
+		}
+
+		var app, status *string
+		if v := r.URL.Query().Get("app"); v != "" {
+			app = &v
+		}
+		if v := r.URL.Query().Get("status"); v != "" {
+			status = &v
+		}
+
+		rows, err := webhooks.list.Query(app, status, webhookLogLimit); if err != nil {
+			internalError(w, r, err)
+			return
+		}
+		defer rows.Close()
+
+		deliveries := make([]WebhookDeliveryInfo, 0)
+		for rows.Next() {
+			var d WebhookDeliveryInfo
+			var lastStatus sql.NullInt64
+			var lastError sql.NullString
+			var next, delivered sql.NullTime
+			err = rows.Scan(&d.Id, &d.App, &d.Event, &d.EventId, &d.Status, &d.Attempts, &lastStatus, &lastError, &d.CreatedAt, &next, &delivered); if err != nil {
+				internalError(w, r, err)
+				return
+			}
+			if lastStatus.Valid {
+				d.LastStatus = &lastStatus.Int64
+			}
+			if lastError.Valid {
+				d.LastError = &lastError.String
+			}
+			if next.Valid && d.Status == webhookPending {
+				d.NextAttemptAt = &next.Time
+			}
+			if delivered.Valid {
+				d.DeliveredAt = &delivered.Time
+			}
+			deliveries = append(deliveries, d)
+		}
+
+		err = rows.Err(); if err != nil {
+			internalError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusOK, &WebhookDeliveriesResponse{Deliveries: deliveries})
+	})
+}
+
+//Queues a failed delivery again, for after the app has been fixed
+func adminRetryWebhookHandler() http.HandlerFunc {
+	stmt := prepareQuery("sql/check_admin.sql")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req RetryWebhookRequest
+		if apiErr := decodeJSON(w, r, &req); apiErr != nil {
+			writeError(w, apiErr)
+			return
+		}
+
+		p, ok := principalFrom(r); if !ok {
+			writeError(w, errInvalidSession)
+			return
+		}
+
+		if !requireAdmin(w, r, stmt, p) {
+			return
+		}
+
+		var id int64
+		err := webhooks.retry.QueryRow(req.Id).Scan(&id); if err == sql.ErrNoRows {
+			writeError(w, notFound("delivery_not_found", "No failed webhook delivery has that id"))
+			return
+		} else if err != nil {
+			internalError(w, r, err)
+			return
+		}
+		adminActionDone("retry_webhook")
+		requestLogger(r, "webhooks").Info("Webhook delivery queued again", "delivery_id", id)
+
+		writeJSON(w, http.StatusOK, &MessageResponse{Message: "Webhook delivery has been queued again"})
+	})
+}
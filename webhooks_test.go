@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebhookRegistration(t *testing.T) {
+	registry, err := parseApps(`
+[canban]
+secret = "appsecret"
+[canban.webhook]
+url = "https://canban.example.com/portal/events"
+events = ["user.deleted", "session.revoked"]
+
+[reporter]
+secret = "reportersecret"
+[reporter.webhook]
+url = "https://reporter.example.com/hook"
+`); if err != nil {
+		t.Fatal(err)
+	}
+
+	canban, _ := registry.App("canban")
+	if !canban.Webhook.Subscribes(eventUserDeleted) || canban.Webhook.Subscribes(eventUserCreated) {
+		t.Fatal("Event subscription was not honored")
+	}
+
+	reporter, _ := registry.App("reporter")
+	if !reporter.Webhook.Subscribes(eventAdminGranted) {
+		t.Fatal("Webhook without events should get every event")
+	}
+
+	_, err = parseApps("[bad]\nsecret = \"s\"\n[bad.webhook]\nurl = \"/relative\"\n"); if err == nil {
+		t.Fatal("Relative webhook URL was accepted")
+	}
+
+	_, err = parseApps("[bad]\nsecret = \"s\"\n[bad.webhook]\nurl = \"https://x.example.com\"\nevents = [\"user.exploded\"]\n"); if err == nil {
+		t.Fatal("Unknown event was accepted")
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	if webhookBackoff(1) != webhookMinBackoff || webhookBackoff(2) != 2 * webhookMinBackoff || webhookBackoff(4) != 8 * webhookMinBackoff {
+		t.Fatal("Backoff does not double", webhookBackoff(1), webhookBackoff(2), webhookBackoff(4))
+	}
+
+	if webhookBackoff(100) != webhookMaxBackoff {
+		t.Fatal("Backoff is not capped", webhookBackoff(100))
+	}
+}
+
+//A batch whose every delivery times out must still be inside its lease
+func TestWebhookLease(t *testing.T) {
+	timeout := 10 * time.Second
+	if webhookLease(timeout) <= webhookBatchSize * timeout {
+		t.Fatal("Lease is shorter than a batch of timeouts", webhookLease(timeout))
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	var received *http.Request
+	var body []byte
+	status := 204
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer receiver.Close()
+
+	app := &App{Name: "canban", Secret: "appsecret", Webhook: &AppWebhook{URL: receiver.URL}}
+	q := &WebhookQueue{client: &http.Client{Timeout: time.Second, CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}}
+	d := &webhookDelivery{id: 42, app: "canban", event: eventUserDeleted, payload: `{"type":"user.deleted"}`}
+	now := time.Unix(1700000000, 0)
+
+	code, err := q.deliver(app, d, now); if err != nil || code != 204 {
+		t.Fatal("Delivery failed", code, err)
+	}
+
+	if received.Header.Get("Portal-Event") != eventUserDeleted || received.Header.Get("Portal-Delivery") != "42" || string(body) != d.payload {
+		t.Fatal("Delivery is missing event details", received.Header)
+	}
+
+	//What an app does to check the signature
+	signature := received.Header.Get(webhookSignatureHeader)
+	ts, v1, _ := strings.Cut(strings.TrimPrefix(signature, "t="), ",v1=")
+	mac := hmac.New(sha256.New, []byte("appsecret"))
+	mac.Write([]byte(ts + "." + string(body)))
+	if ts != "1700000000" || !hmac.Equal([]byte(v1), []byte(hex.EncodeToString(mac.Sum(nil)))) {
+		t.Fatal("Signature does not verify", signature)
+	}
+
+	if signWebhook("othersecret", now, body) == signature || signWebhook("appsecret", now.Add(time.Second), body) == signature {
+		t.Fatal("Signature does not cover the secret and timestamp")
+	}
+
+	for _, status = range []int{500, 302} {
+		if code, err := q.deliver(app, d, now); err == nil || code != status {
+			t.Fatal("Unsuccessful delivery was not reported", status)
+		}
+	}
+}